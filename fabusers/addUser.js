@@ -80,7 +80,10 @@ Fabric_Client.newDefaultKeyValueStore({ path: store_path
 			isProposalGood = true;
 			console.log('Transaction proposal was good');
 		} else {
-			console.error('Transaction proposal was bad');
+			// the chaincode error (e.g. "NOT_FOUND: ...") is parsed by the offchain service
+			var badResponse = proposalResponses && proposalResponses[0];
+			console.error('Transaction proposal was bad :: ' + (badResponse &&
+				(badResponse.message || (badResponse.response && badResponse.response.message))));
 		}
 	if (isProposalGood) {
 		console.log(util.format(
@@ -5,6 +5,9 @@
  *
  * USER:
  *     node query.js <userlogin>
+ *
+ * The query is signed by admin (run enrollAdmin.js), so deleted users
+ * (their identities are revoked) and unknown users can be queried too
  */
 
 var Fabric_Client = require('fabric-client');
@@ -25,6 +28,9 @@ var member_user = null;
 var store_path = path.join(__dirname, 'hfc-key-store');
 var tx_id = null;
 
+// the query is signed by admin
+var signer = 'admin';
+
 // query for this user
 var userlogin = process.argv[2]
 
@@ -41,13 +47,13 @@ Fabric_Client.newDefaultKeyValueStore({ path: store_path
 	fabric_client.setCryptoSuite(crypto_suite);
 
 	// get the enrolled user from persistence, this user will sign all requests
-	return fabric_client.getUserContext(userlogin, true);
+	return fabric_client.getUserContext(signer, true);
 }).then((user_from_store) => {
 	if (user_from_store && user_from_store.isEnrolled()) {
-		// Successfully loaded @userlogin from persistence
+		// Successfully loaded admin from persistence
 		member_user = user_from_store;
 	} else {
-		throw new Error('Failed to get userlogin.... run registerUser.js');
+		throw new Error('Failed to get admin.... run enrollAdmin.js');
 	}
 
 	// queryUser chaincode function - requires 1 argument, ex: args: ['user1'],
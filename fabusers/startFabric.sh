@@ -29,9 +29,14 @@ docker exec cli sh -c "mkdir $CONTAINER_CHAINCODE_PATH"
 CHAINCODE_PATH=$GOPATH/src/fabusers
 docker cp $CHAINCODE_PATH/fabusers.go cli:$CONTAINER_CHAINCODE_PATH/fabusers.go
 
+# Access rules of the chaincode (see AccessConfig of fabusers.go): users change their own records,
+# the admin (the bootstrap admin of the CA or an identity with the attribute role=admin) changes any record
+ACCESS_CONFIG='{"user_msps":["Org1MSP"],"admin_msps":["Org1MSP"],"admin_attribute":"role","admin_value":"admin","admin_ids":["admin"]}'
+INIT_ARGS="{\"Args\":[\"init\",\"$(printf '%s' "$ACCESS_CONFIG" | sed 's/"/\\"/g')\"]}"
+
 # Install, instantiate chaincode and prime the ledger
 docker exec -e "CORE_PEER_LOCALMSPID=Org1MSP" -e "CORE_PEER_MSPCONFIGPATH=/opt/gopath/src/github.com/hyperledger/fabric/peer/crypto/peerOrganizations/org1.example.com/users/Admin@org1.example.com/msp" cli peer chaincode install -n fabusers -v 1.0 -p "$CC_SRC_PATH" -l "$LANGUAGE"
-docker exec -e "CORE_PEER_LOCALMSPID=Org1MSP" -e "CORE_PEER_MSPCONFIGPATH=/opt/gopath/src/github.com/hyperledger/fabric/peer/crypto/peerOrganizations/org1.example.com/users/Admin@org1.example.com/msp" cli peer chaincode instantiate -o orderer.example.com:7050 -C mychannel -n fabusers -l "$LANGUAGE" -v 1.0 -c '{"Args":[""]}' -P "OR ('Org1MSP.member','Org2MSP.member')"
+docker exec -e "CORE_PEER_LOCALMSPID=Org1MSP" -e "CORE_PEER_MSPCONFIGPATH=/opt/gopath/src/github.com/hyperledger/fabric/peer/crypto/peerOrganizations/org1.example.com/users/Admin@org1.example.com/msp" cli peer chaincode instantiate -o orderer.example.com:7050 -C mychannel -n fabusers -l "$LANGUAGE" -v 1.0 -c "$INIT_ARGS" -P "OR ('Org1MSP.member','Org2MSP.member')"
 sleep 10
 docker exec -e "CORE_PEER_LOCALMSPID=Org1MSP" -e "CORE_PEER_MSPCONFIGPATH=/opt/gopath/src/github.com/hyperledger/fabric/peer/crypto/peerOrganizations/org1.example.com/users/Admin@org1.example.com/msp" cli peer chaincode invoke -o orderer.example.com:7050 -C mychannel -n fabusers -c '{"function":"initLedger","Args":[""]}'
 
@@ -8,13 +8,17 @@ package main
 
 /* Imports
  * 3 utility libraries for formatting, handling bytes, reading and writing JSON, and string manipulation
- * 2 specific Hyperledger Fabric specific libraries for Smart Contracts
+ * 3 specific Hyperledger Fabric specific libraries for Smart Contracts (cid inspects the client identity)
  */
 import (
-	"bytes"
+	"encoding/hex"
 	"encoding/json"
 	"fmt"
+	"strconv"
+	"strings"
+	"time"
 
+	"github.com/hyperledger/fabric/core/chaincode/lib/cid"
 	"github.com/hyperledger/fabric/core/chaincode/shim"
 	sc "github.com/hyperledger/fabric/protos/peer"
 )
@@ -32,20 +36,150 @@ type SmartContract struct {
  */
 type User struct {
 	//UserId    string `json:"user_id"`
-	InfoHash  string `json:"info_hash"`
+	InfoHash string `json:"info_hash"`
+
+	// Deleted marks the tombstone of the deleted user (see deleteUser)
+	Deleted bool `json:"deleted,omitempty"`
+}
+
+/*
+ * Errors of the chaincode are machine-parsable: the message starts with
+ * the error code, e.g. "NOT_FOUND: User ondar07 does not exist"
+ * (the offchain service maps codes to HTTP status codes)
+ */
+const (
+	ERR_ALREADY_EXISTS   = "ALREADY_EXISTS"
+	ERR_NOT_FOUND        = "NOT_FOUND"
+	ERR_INVALID_ARGUMENT = "INVALID_ARGUMENT"
+	ERR_FORBIDDEN        = "FORBIDDEN"
+)
+
+// limits of arguments
+const (
+	MAX_USERNAME_LEN = 256
+	MIN_HASH_LEN     = 32  // hex digits (128 bits)
+	MAX_HASH_LEN     = 128 // hex digits (512 bits)
+	MAX_PAGE_SIZE    = 1000
+)
+
+/*
+ * UserRecord is an element of the user listing (see queryUsersPage)
+ */
+type UserRecord struct {
+	Key    string          `json:"Key"`
+	Record json.RawMessage `json:"Record"`
+}
+
+/*
+ * UsersPage is a page of the user listing, Bookmark is the start
+ * of the next page (empty for the last page)
+ */
+type UsersPage struct {
+	Records  []UserRecord `json:"records"`
+	Fetched  int32        `json:"fetched"`
+	Bookmark string       `json:"bookmark"`
 }
 
+/*
+ * UsersCount is the number of user records (see countUsers),
+ * Deleted is the number of tombstones among them
+ */
+type UsersCount struct {
+	Total   int `json:"total"`
+	Deleted int `json:"deleted"`
+}
+
+/*
+ * AccessConfig is the access rules of the chaincode. The rules are stored in the ledger
+ * (the composite key config~access, so listings of users skip it) and are set by Init:
+ *    the owner (the identity of UserMSPs whose enrollment ID is the username)
+ *    adds and changes its own record,
+ *    the admin (the identity of AdminMSPs with the attribute AdminAttribute=AdminValue
+ *    or with the enrollment ID from AdminIDs) adds, changes and deletes any record
+ */
+type AccessConfig struct {
+	UserMSPs       []string `json:"user_msps"`
+	AdminMSPs      []string `json:"admin_msps"`
+	AdminAttribute string   `json:"admin_attribute"`
+	AdminValue     string   `json:"admin_value"`
+	AdminIDs       []string `json:"admin_ids"` // e.g. the bootstrap admin of the CA (it has no attributes)
+}
+
+// the composite key of the access rules
+const (
+	CONFIG_OBJECT_TYPE = "config"
+	CONFIG_ACCESS      = "access"
+)
 
+/*
+ * defaultAccessConfig is the access rules of the basic network
+ * (Init without arguments)
+ */
+func defaultAccessConfig() AccessConfig {
+	return AccessConfig{
+		UserMSPs:       []string{"Org1MSP"},
+		AdminMSPs:      []string{"Org1MSP"},
+		AdminAttribute: "role",
+		AdminValue:     "admin",
+		AdminIDs:       []string{"admin"},
+	}
+}
+
+/*
+ * UserHistoryRecord is a change of the user record (see getUserHistory)
+ */
+type UserHistoryRecord struct {
+	TxId      string `json:"tx_id"`
+	Timestamp string `json:"timestamp,omitempty"` // RFC3339 (UTC), omitted if the peer has no time of the transaction
+	InfoHash  string `json:"info_hash"`
+	Deleted   bool   `json:"deleted"`   // the tombstone is written by deleteUser
+	IsDelete  bool   `json:"is_delete"` // the key is removed from the world state
+}
 
 /*
  * The Init method is called when the Smart Contract "fabusers" is instantiated by the blockchain network
  * Best practice is to have any Ledger initialization in separate function -- see initLedger()
+ *
+ * Init sets the access rules: the argument is AccessConfig as JSON, ex: args: ['init', '{"admin_msps": ["Org1MSP"], ...}'].
+ * Without the argument the default rules are set on instantiate, the stored rules are kept on upgrade
  */
 func (s *SmartContract) Init(APIstub shim.ChaincodeStubInterface) sc.Response {
-	return shim.Success(nil)
-}
+	_, args := APIstub.GetFunctionAndParameters()
 
+	configKey, err := APIstub.CreateCompositeKey(CONFIG_OBJECT_TYPE, []string{CONFIG_ACCESS})
+	if err != nil {
+		return shim.Error(err.Error())
+	}
 
+	config := defaultAccessConfig()
+	if len(args) > 0 && args[0] != "" {
+		config = AccessConfig{}
+		err = json.Unmarshal([]byte(args[0]), &config)
+		if err != nil {
+			return errorResponse(ERR_INVALID_ARGUMENT, "Incorrect access config: "+err.Error())
+		}
+		if len(config.AdminMSPs) == 0 {
+			return errorResponse(ERR_INVALID_ARGUMENT, "Access config has no admin_msps")
+		}
+	} else {
+		configAsBytes, err := APIstub.GetState(configKey)
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+		if configAsBytes != nil {
+			return shim.Success(nil)
+		}
+	}
+
+	configAsBytes, _ := json.Marshal(config)
+	err = APIstub.PutState(configKey, configAsBytes)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	fmt.Printf("- Init: access config %s\n", configAsBytes)
+
+	return shim.Success(nil)
+}
 
 /*
  * The Invoke method is called as a result of an application request to run the Smart Contract "fabusers"
@@ -62,113 +196,456 @@ func (s *SmartContract) Invoke(APIstub shim.ChaincodeStubInterface) sc.Response
 		return s.initLedger(APIstub)
 	} else if function == "addUser" {
 		return s.addUser(APIstub, args)
-	} else if function == "queryAllUsers" {
-		return s.queryAllUsers(APIstub)
+	} else if function == "queryUsersPage" {
+		return s.queryUsersPage(APIstub, args)
+	} else if function == "countUsers" {
+		return s.countUsers(APIstub)
 	} else if function == "changeUserInfoHash" {
 		return s.changeUserInfoHash(APIstub, args)
+	} else if function == "deleteUser" {
+		return s.deleteUser(APIstub, args)
+	} else if function == "getUserHistory" {
+		return s.getUserHistory(APIstub, args)
+	} else if function == "getAccessConfig" {
+		return s.getAccessConfig(APIstub)
 	}
 
-	return shim.Error("Invalid Smart Contract function name.")
+	return errorResponse(ERR_INVALID_ARGUMENT, "Invalid Smart Contract function name.")
 }
 
+/*
+ * errorResponse makes the error with the code (ERR_*)
+ */
+func errorResponse(code string, message string) sc.Response {
+	return shim.Error(code + ": " + message)
+}
 
+/*
+ * checkUsername validates the key of the user record
+ * (keys that start with 0x00 are reserved for composite keys)
+ */
+func checkUsername(username string) error {
+	if username == "" || username[0] == 0x00 || len(username) > MAX_USERNAME_LEN {
+		return fmt.Errorf("Incorrect username %q", username)
+	}
+	return nil
+}
 
+/*
+ * checkInfoHash validates the info hash (a lowercase hex string)
+ */
+func checkInfoHash(infoHash string) error {
+	if len(infoHash) < MIN_HASH_LEN || len(infoHash) > MAX_HASH_LEN || len(infoHash)%2 != 0 {
+		return fmt.Errorf("Incorrect length of info hash %d", len(infoHash))
+	}
+	if _, err := hex.DecodeString(infoHash); err != nil || infoHash != strings.ToLower(infoHash) {
+		return fmt.Errorf("Info hash %q is not a lowercase hex string", infoHash)
+	}
+	return nil
+}
+
+/*
+ * getAccessConfigRules reads the access rules (see Init)
+ */
+func getAccessConfigRules(APIstub shim.ChaincodeStubInterface) (*AccessConfig, error) {
+	configKey, err := APIstub.CreateCompositeKey(CONFIG_OBJECT_TYPE, []string{CONFIG_ACCESS})
+	if err != nil {
+		return nil, err
+	}
+	configAsBytes, err := APIstub.GetState(configKey)
+	if err != nil {
+		return nil, err
+	}
+	if configAsBytes == nil {
+		return nil, fmt.Errorf("Access config is not set, instantiate or upgrade the chaincode")
+	}
+
+	config := AccessConfig{}
+	err = json.Unmarshal(configAsBytes, &config)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to decode the access config: %s", err.Error())
+	}
+	return &config, nil
+}
+
+/*
+ * contains reports whether the list has the value
+ */
+func contains(list []string, value string) bool {
+	for _, item := range list {
+		if item == value {
+			return true
+		}
+	}
+	return false
+}
+
+/*
+ * checkAccess checks the client identity (the creator of the proposal) against the access rules:
+ * the admin is always allowed, the owner of the record (the enrollment ID is the username)
+ * only if ownerAllowed. The reason is returned if the identity is denied (empty if it's allowed)
+ */
+func checkAccess(APIstub shim.ChaincodeStubInterface, username string, ownerAllowed bool) (string, error) {
+	config, err := getAccessConfigRules(APIstub)
+	if err != nil {
+		return "", err
+	}
+
+	identity, err := cid.New(APIstub)
+	if err != nil {
+		return "", err
+	}
+	mspID, err := identity.GetMSPID()
+	if err != nil {
+		return "", err
+	}
+	cert, err := identity.GetX509Certificate()
+	if err != nil {
+		return "", err
+	}
+	// the CA issues certificates with the enrollment ID as the common name
+	enrollmentID := cert.Subject.CommonName
+
+	if contains(config.AdminMSPs, mspID) {
+		if contains(config.AdminIDs, enrollmentID) {
+			return "", nil
+		}
+		if config.AdminAttribute != "" {
+			value, found, err := identity.GetAttributeValue(config.AdminAttribute)
+			if err != nil {
+				return "", err
+			}
+			if found && value == config.AdminValue {
+				return "", nil
+			}
+		}
+	}
+	if ownerAllowed && contains(config.UserMSPs, mspID) && enrollmentID == username {
+		return "", nil
+	}
+
+	return fmt.Sprintf("Identity %s of %s can't change user %s", enrollmentID, mspID, username), nil
+}
+
+/*
+ * getUser reads the user record (nil if the user doesn't exist)
+ */
+func getUser(APIstub shim.ChaincodeStubInterface, username string) (*User, error) {
+	userAsBytes, err := APIstub.GetState(username)
+	if err != nil {
+		return nil, err
+	}
+	if userAsBytes == nil {
+		return nil, nil
+	}
+
+	user := User{}
+	err = json.Unmarshal(userAsBytes, &user)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to decode the record of %s: %s", username, err.Error())
+	}
+	return &user, nil
+}
+
+/*
+ * queryUser returns the user record (the tombstone of the deleted user too)
+ */
 func (s *SmartContract) queryUser(APIstub shim.ChaincodeStubInterface, args []string) sc.Response {
 
 	if len(args) != 1 {
-		return shim.Error("Incorrect number of arguments. Expecting 1")
+		return errorResponse(ERR_INVALID_ARGUMENT, "Incorrect number of arguments. Expecting 1")
+	}
+	if err := checkUsername(args[0]); err != nil {
+		return errorResponse(ERR_INVALID_ARGUMENT, err.Error())
 	}
 
-	userInfoAsBytes, _ := APIstub.GetState(args[0])
+	userInfoAsBytes, err := APIstub.GetState(args[0])
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	if userInfoAsBytes == nil {
+		return errorResponse(ERR_NOT_FOUND, "User "+args[0]+" does not exist")
+	}
 	return shim.Success(userInfoAsBytes)
 }
 
-
-
 func (s *SmartContract) initLedger(APIstub shim.ChaincodeStubInterface) sc.Response {
 	return shim.Success(nil)
 }
 
-
-
+/*
+ * addUser creates the user record, the existing record (the tombstone too)
+ * is never overwritten
+ */
 func (s *SmartContract) addUser(APIstub shim.ChaincodeStubInterface, args []string) sc.Response {
 	if len(args) != 2 {
-		return shim.Error("Incorrect number of arguments. Expecting 2")
+		return errorResponse(ERR_INVALID_ARGUMENT, "Incorrect number of arguments. Expecting 2")
+	}
+	if err := checkUsername(args[0]); err != nil {
+		return errorResponse(ERR_INVALID_ARGUMENT, err.Error())
+	}
+	if err := checkInfoHash(args[1]); err != nil {
+		return errorResponse(ERR_INVALID_ARGUMENT, err.Error())
+	}
+
+	denied, err := checkAccess(APIstub, args[0], true)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	if denied != "" {
+		return errorResponse(ERR_FORBIDDEN, denied)
+	}
+
+	existing, err := getUser(APIstub, args[0])
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	if existing != nil {
+		return errorResponse(ERR_ALREADY_EXISTS, "User "+args[0]+" already exists")
 	}
 
 	var user = User{InfoHash: args[1]}
 
 	userAsBytes, _ := json.Marshal(user)
-	APIstub.PutState(args[0], userAsBytes)
+	err = APIstub.PutState(args[0], userAsBytes)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
 
 	return shim.Success(nil)
 }
 
+/*
+ * queryUsersPage returns a page of user records in the order of keys:
+ * args are the page size (1..MAX_PAGE_SIZE) and the bookmark returned
+ * with the previous page (empty for the first page).
+ * Pagination is available only for queries (not for transactions)
+ */
+func (s *SmartContract) queryUsersPage(APIstub shim.ChaincodeStubInterface, args []string) sc.Response {
+
+	if len(args) != 2 {
+		return errorResponse(ERR_INVALID_ARGUMENT, "Incorrect number of arguments. Expecting 2")
+	}
+	pageSize, err := strconv.ParseInt(args[0], 10, 32)
+	if err != nil || pageSize < 1 || pageSize > MAX_PAGE_SIZE {
+		return errorResponse(ERR_INVALID_ARGUMENT, fmt.Sprintf("Page size has to be from 1 to %d", MAX_PAGE_SIZE))
+	}
 
+	resultsIterator, metadata, err := APIstub.GetStateByRangeWithPagination("", "", int32(pageSize), args[1])
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	defer resultsIterator.Close()
 
-func (s *SmartContract) queryAllUsers(APIstub shim.ChaincodeStubInterface) sc.Response {
+	records, err := readUserRecords(resultsIterator)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
 
-	startKey := "user1"
-	endKey := "user999"
+	page := UsersPage{Records: records, Fetched: metadata.FetchedRecordsCount, Bookmark: metadata.Bookmark}
+	pageAsBytes, _ := json.Marshal(page)
+	fmt.Printf("- queryUsersPage: %d records, bookmark %q\n", page.Fetched, page.Bookmark)
 
-	resultsIterator, err := APIstub.GetStateByRange(startKey, endKey)
+	return shim.Success(pageAsBytes)
+}
+
+/*
+ * countUsers returns the number of user records (tombstones are counted too),
+ * records are iterated without buffering them
+ */
+func (s *SmartContract) countUsers(APIstub shim.ChaincodeStubInterface) sc.Response {
+
+	resultsIterator, err := APIstub.GetStateByRange("", "")
 	if err != nil {
 		return shim.Error(err.Error())
 	}
 	defer resultsIterator.Close()
 
-	// buffer is a JSON array containing QueryResults
-	var buffer bytes.Buffer
-	buffer.WriteString("[")
-
-	bArrayMemberAlreadyWritten := false
+	count := UsersCount{}
 	for resultsIterator.HasNext() {
 		queryResponse, err := resultsIterator.Next()
 		if err != nil {
 			return shim.Error(err.Error())
 		}
-		// Add a comma before array members, suppress it for the first array member
-		if bArrayMemberAlreadyWritten == true {
-			buffer.WriteString(",")
+		user := User{}
+		json.Unmarshal(queryResponse.Value, &user)
+		count.Total++
+		if user.Deleted {
+			count.Deleted++
 		}
-		buffer.WriteString("{\"Key\":")
-		buffer.WriteString("\"")
-		buffer.WriteString(queryResponse.Key)
-		buffer.WriteString("\"")
-
-		buffer.WriteString(", \"Record\":")
-		// Record is a JSON object, so we write as-is
-		buffer.WriteString(string(queryResponse.Value))
-		buffer.WriteString("}")
-		bArrayMemberAlreadyWritten = true
 	}
-	buffer.WriteString("]")
-
-	fmt.Printf("- queryAllUsers:\n%s\n", buffer.String())
 
-	return shim.Success(buffer.Bytes())
+	countAsBytes, _ := json.Marshal(count)
+	return shim.Success(countAsBytes)
 }
 
+/*
+ * readUserRecords reads all records of the iterator
+ */
+func readUserRecords(resultsIterator shim.StateQueryIteratorInterface) ([]UserRecord, error) {
+	records := []UserRecord{}
+	for resultsIterator.HasNext() {
+		queryResponse, err := resultsIterator.Next()
+		if err != nil {
+			return nil, err
+		}
+		// Record is a JSON object, so we keep it as-is
+		records = append(records, UserRecord{Key: queryResponse.Key, Record: queryResponse.Value})
+	}
+	return records, nil
+}
 
-
+/*
+ * changeUserInfoHash changes the info hash of the existing user
+ * (the deleted user can't be changed)
+ */
 func (s *SmartContract) changeUserInfoHash(APIstub shim.ChaincodeStubInterface, args []string) sc.Response {
 
 	if len(args) != 2 {
-		return shim.Error("Incorrect number of arguments. Expecting 2")
+		return errorResponse(ERR_INVALID_ARGUMENT, "Incorrect number of arguments. Expecting 2")
+	}
+	if err := checkUsername(args[0]); err != nil {
+		return errorResponse(ERR_INVALID_ARGUMENT, err.Error())
+	}
+	if err := checkInfoHash(args[1]); err != nil {
+		return errorResponse(ERR_INVALID_ARGUMENT, err.Error())
 	}
 
-	userAsBytes, _ := APIstub.GetState(args[0])
-	user := User{}
+	denied, err := checkAccess(APIstub, args[0], true)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	if denied != "" {
+		return errorResponse(ERR_FORBIDDEN, denied)
+	}
+
+	user, err := getUser(APIstub, args[0])
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	if user == nil {
+		return errorResponse(ERR_NOT_FOUND, "User "+args[0]+" does not exist")
+	}
+	if user.Deleted {
+		return errorResponse(ERR_NOT_FOUND, "User "+args[0]+" is deleted")
+	}
 
-	json.Unmarshal(userAsBytes, &user)
 	user.InfoHash = args[1]
 
-	userAsBytes, _ = json.Marshal(user)
-	APIstub.PutState(args[0], userAsBytes)
+	userAsBytes, _ := json.Marshal(user)
+	err = APIstub.PutState(args[0], userAsBytes)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	return shim.Success(nil)
+}
+
+/*
+ * deleteUser replaces the user record by the tombstone (right to erasure):
+ * private data of the user are destroyed offchain, the ledger keeps only
+ * the last info hash (it's not personal data) and the deleted flag,
+ * so the username can't be taken again
+ */
+func (s *SmartContract) deleteUser(APIstub shim.ChaincodeStubInterface, args []string) sc.Response {
+
+	if len(args) != 1 {
+		return errorResponse(ERR_INVALID_ARGUMENT, "Incorrect number of arguments. Expecting 1")
+	}
+	if err := checkUsername(args[0]); err != nil {
+		return errorResponse(ERR_INVALID_ARGUMENT, err.Error())
+	}
+
+	// only the admin deletes users
+	denied, err := checkAccess(APIstub, args[0], false)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	if denied != "" {
+		return errorResponse(ERR_FORBIDDEN, denied)
+	}
+
+	user, err := getUser(APIstub, args[0])
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	if user == nil {
+		return errorResponse(ERR_NOT_FOUND, "User "+args[0]+" does not exist")
+	}
+	if user.Deleted {
+		// the tombstone is written already (the deletion is retried)
+		return shim.Success(nil)
+	}
+	user.Deleted = true
+
+	userAsBytes, _ := json.Marshal(user)
+	err = APIstub.PutState(args[0], userAsBytes)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
 
 	return shim.Success(nil)
 }
 
+/*
+ * getUserHistory returns all changes of the user record (the oldest first):
+ * every addUser, changeUserInfoHash and deleteUser transaction.
+ * The peer has to keep the history database (core.ledger.history.enableHistoryDatabase)
+ */
+func (s *SmartContract) getUserHistory(APIstub shim.ChaincodeStubInterface, args []string) sc.Response {
+
+	if len(args) != 1 {
+		return errorResponse(ERR_INVALID_ARGUMENT, "Incorrect number of arguments. Expecting 1")
+	}
+	if err := checkUsername(args[0]); err != nil {
+		return errorResponse(ERR_INVALID_ARGUMENT, err.Error())
+	}
+
+	resultsIterator, err := APIstub.GetHistoryForKey(args[0])
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	defer resultsIterator.Close()
+
+	history := []UserHistoryRecord{}
+	for resultsIterator.HasNext() {
+		modification, err := resultsIterator.Next()
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+
+		record := UserHistoryRecord{TxId: modification.TxId, IsDelete: modification.IsDelete}
+		if modification.Timestamp != nil {
+			record.Timestamp = time.Unix(modification.Timestamp.Seconds,
+				int64(modification.Timestamp.Nanos)).UTC().Format(time.RFC3339Nano)
+		}
+		if !modification.IsDelete {
+			user := User{}
+			json.Unmarshal(modification.Value, &user)
+			record.InfoHash = user.InfoHash
+			record.Deleted = user.Deleted
+		}
+		history = append(history, record)
+	}
+
+	historyAsBytes, _ := json.Marshal(history)
+	fmt.Printf("- getUserHistory:\n%s\n", historyAsBytes)
+
+	return shim.Success(historyAsBytes)
+}
+
+/*
+ * getAccessConfig returns the access rules (see Init)
+ */
+func (s *SmartContract) getAccessConfig(APIstub shim.ChaincodeStubInterface) sc.Response {
+	config, err := getAccessConfigRules(APIstub)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	configAsBytes, _ := json.Marshal(config)
+	return shim.Success(configAsBytes)
+}
 
 // The main function is only relevant in unit test mode. Only included here for completeness.
 func main() {
@@ -1,41 +1,299 @@
 /*
 This is a very simple package that implements
-admin entity for our system. But this package should be removed
-in the future and it has to be replaced by the Fabric's admin entity.
+admin accounts of our system (admins, auditors, support).
+
+Accounts are kept in the db (see AccountStore). The first admin account
+is created by the bootstrap flow (see Bootstrap()): either from the settings
+or by the one-time bootstrap token printed on the first run.
+Then admins manage accounts (create, disable, rotate passwords).
+An account may be linked to the Fabric's enrolled identity.
 */
 package admin
 
 import (
 	"../crypdata"
 	"../onchain"
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
 	"errors"
+	"io"
+	"sync"
+	"time"
+)
+
+// name of the main admin (the account created from the settings)
+const ADMIN_NAME = "admin"
+
+// minimal length of passwords of accounts
+const MIN_PASSWORD_LEN = 8
+
+// roles of accounts (see rbac package)
+const (
+	ROLE_ADMIN   = "admin"   // full access
+	ROLE_AUDITOR = "auditor" // reads public data, lists users, sees reports
+	ROLE_SUPPORT = "support" // reads public data, lists and updates users
 )
 
-// This is so simple admin entity struct
-// Ideally, we have to use admin entity struct in the Fabric
-type Admin struct {
-	Hashedpassword string
+var (
+	ErrNotFound         = errors.New("admin account is not found")
+	ErrExists           = errors.New("admin account already exists")
+	ErrWrongCredentials = errors.New("wrong admin name or password")
+	ErrDisabled         = errors.New("admin account is disabled")
+	ErrBadRole          = errors.New("unknown role")
+	ErrWeakPassword     = errors.New("password is too short")
+	ErrBadName          = errors.New("account name is empty")
+	ErrLastAdmin        = errors.New("the last active admin can't be disabled")
+	ErrBootstrapped     = errors.New("admin accounts are bootstrapped already")
+	ErrBadBootstrap     = errors.New("wrong bootstrap token")
+	ErrNoIdentity       = errors.New("the Fabric identity is not enrolled")
+)
+
+// Account is an admin entity (the db record)
+type Account struct {
+	Name           string `bson:"_id"`
+	Hashedpassword string `json:"-"`
+	Role           string
+
+	// Identity is the name of the Fabric enrolled identity of the account
+	Identity string `bson:",omitempty" json:",omitempty"`
+
+	// a disabled account can't log in, its sessions are refused
+	Disabled bool
+
+	Created         time.Time
+	PasswordChanged time.Time
 }
 
-var mainAdmin *Admin = nil
+// accounts is the storage of admin accounts
+var accounts AccountStore = nil
+
+// fabric is used to check identities of accounts
+var fabric onchain.Ledger = nil
 
-// Init() makes mainAdmin var and enroll admin entity of the Fabric
-func Init(adminPassw string) error {
-	if mainAdmin != nil {
-		return errors.New("admin already exists")
+// mu serializes changes of accounts (checks of the last admin and bootstrap)
+var mu sync.Mutex
+
+// bootstrapToken is the one-time token of the first run (empty - no bootstrap)
+var bootstrapToken string
+
+// Init() keeps the storage of accounts and enroll admin entity of the Fabric
+func Init(ledger onchain.Ledger, store AccountStore) error {
+	if accounts != nil {
+		return errors.New("admin package is initialized already")
 	}
-	mainAdmin = new(Admin)
-	mainAdmin.Hashedpassword = crypdata.Hash(adminPassw)
-	err := onchain.EnrollAdmin()
+
+	err := ledger.EnrollAdmin()
 	if err != nil {
-		mainAdmin = nil
 		return errors.New("Failed enroll admin")
 	}
+	accounts = store
+	fabric = ledger
 	return nil
 }
 
-// IsAdminPassword() checks if passw matches admin password
+// NeedsBootstrap() reports whether there are no accounts (the first run)
+func NeedsBootstrap() (bool, error) {
+	list, err := accounts.List()
+	if err != nil {
+		return false, err
+	}
+	return len(list) == 0, nil
+}
+
+// BootstrapToken() generates the one-time token which allows to create
+// the first admin account by Bootstrap()
+func BootstrapToken() (string, error) {
+	b := make([]byte, 24)
+	if _, err := io.ReadFull(rand.Reader, b); err != nil {
+		return "", err
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	bootstrapToken = base64.RawURLEncoding.EncodeToString(b)
+	return bootstrapToken, nil
+}
+
+// Bootstrap() creates the first admin account, it works only while
+// there are no accounts. token has to be the token of BootstrapToken()
+// (trusted is true for the account from the settings, the token isn't checked)
+func Bootstrap(token, name, passw string, trusted bool) (*Account, error) {
+	mu.Lock()
+	defer mu.Unlock()
+
+	if !trusted && (bootstrapToken == "" ||
+		subtle.ConstantTimeCompare([]byte(token), []byte(bootstrapToken)) != 1) {
+		return nil, ErrBadBootstrap
+	}
+
+	list, err := accounts.List()
+	if err != nil {
+		return nil, err
+	}
+	if len(list) > 0 {
+		return nil, ErrBootstrapped
+	}
+
+	account, err := create(name, passw, ROLE_ADMIN, "")
+	if err != nil {
+		return nil, err
+	}
+	bootstrapToken = ""
+	return account, nil
+}
+
+// Create() adds a new account.
+// identity (may be empty) is the name of the Fabric enrolled identity
+func Create(name, passw, role, identity string) (*Account, error) {
+	mu.Lock()
+	defer mu.Unlock()
+
+	return create(name, passw, role, identity)
+}
+
+func create(name, passw, role, identity string) (*Account, error) {
+	if name == "" {
+		return nil, ErrBadName
+	}
+	if !isRole(role) {
+		return nil, ErrBadRole
+	}
+	if identity != "" {
+		if _, err := fabric.Enrollment(&identity); err != nil {
+			return nil, ErrNoIdentity
+		}
+	}
+
+	hashedPassword, err := hashPassword(passw)
+	if err != nil {
+		return nil, err
+	}
+	now := time.Now().UTC()
+	account := &Account{
+		Name:            name,
+		Hashedpassword:  hashedPassword,
+		Role:            role,
+		Identity:        identity,
+		Created:         now,
+		PasswordChanged: now,
+	}
+	err = accounts.Insert(account)
+	if err != nil {
+		return nil, err
+	}
+	return account, nil
+}
+
+// SetDisabled() disables or enables the account
+func SetDisabled(name string, disabled bool) (*Account, error) {
+	mu.Lock()
+	defer mu.Unlock()
+
+	account, err := accounts.Find(name)
+	if err != nil {
+		return nil, err
+	}
+	if disabled && account.Role == ROLE_ADMIN && !account.Disabled {
+		active, err := activeAdmins()
+		if err != nil {
+			return nil, err
+		}
+		if active <= 1 {
+			return nil, ErrLastAdmin
+		}
+	}
+
+	account.Disabled = disabled
+	err = accounts.Replace(account)
+	if err != nil {
+		return nil, err
+	}
+	return account, nil
+}
+
+// SetPassword() rotates the password of the account
+func SetPassword(name, passw string) (*Account, error) {
+	mu.Lock()
+	defer mu.Unlock()
+
+	account, err := accounts.Find(name)
+	if err != nil {
+		return nil, err
+	}
+	account.Hashedpassword, err = hashPassword(passw)
+	if err != nil {
+		return nil, err
+	}
+	account.PasswordChanged = time.Now().UTC()
+	err = accounts.Replace(account)
+	if err != nil {
+		return nil, err
+	}
+	return account, nil
+}
+
+// Authenticate() checks the name and the password of the account
 // Here there may be a digital sign verification
-func IsAdminPassword(passw string) bool {
-	return crypdata.Hash(passw) == mainAdmin.Hashedpassword
+func Authenticate(name, passw string) (*Account, error) {
+	account, err := accounts.Find(name)
+	if err == ErrNotFound {
+		return nil, ErrWrongCredentials
+	}
+	if err != nil {
+		return nil, err
+	}
+	if ok, _ := crypdata.VerifyPassword(passw, account.Hashedpassword); !ok {
+		return nil, ErrWrongCredentials
+	}
+	if account.Disabled {
+		return nil, ErrDisabled
+	}
+	return account, nil
+}
+
+// Find() returns the account with this name
+func Find(name string) (*Account, error) {
+	return accounts.Find(name)
+}
+
+// List() returns all accounts
+func List() ([]Account, error) {
+	return accounts.List()
+}
+
+// Roles() returns all roles of accounts
+func Roles() []string {
+	return []string{ROLE_ADMIN, ROLE_AUDITOR, ROLE_SUPPORT}
+}
+
+func isRole(role string) bool {
+	for _, r := range Roles() {
+		if r == role {
+			return true
+		}
+	}
+	return false
+}
+
+func hashPassword(passw string) (string, error) {
+	if len(passw) < MIN_PASSWORD_LEN {
+		return "", ErrWeakPassword
+	}
+	return crypdata.HashPassword(passw)
+}
+
+// activeAdmins() counts enabled accounts with the admin role
+func activeAdmins() (int, error) {
+	list, err := accounts.List()
+	if err != nil {
+		return 0, err
+	}
+	active := 0
+	for _, account := range list {
+		if account.Role == ROLE_ADMIN && !account.Disabled {
+			active++
+		}
+	}
+	return active, nil
 }
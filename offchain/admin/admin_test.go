@@ -0,0 +1,181 @@
+package admin
+
+import (
+	"os"
+	"testing"
+
+	"../crypdata"
+	"../onchain"
+)
+
+const TEST_PASSWORD = "password"
+
+var testLedger = onchain.NewMemoryLedger()
+
+func TestMain(m *testing.M) {
+	// weak parameters of password hashes keep tests fast
+	err := crypdata.SetPasswordParams(crypdata.PasswordParams{Memory: 64, Time: 1, Threads: 1, SaltLen: 16, KeyLen: 32})
+	if err == nil {
+		err = Init(testLedger, NewMemoryAccounts())
+	}
+	if err != nil {
+		panic(err)
+	}
+	os.Exit(m.Run())
+}
+
+// reset() starts the test without accounts (the first run)
+func reset() {
+	mu.Lock()
+	defer mu.Unlock()
+
+	accounts = NewMemoryAccounts()
+	bootstrapToken = ""
+}
+
+func TestInit(t *testing.T) {
+	if err := Init(testLedger, NewMemoryAccounts()); err == nil {
+		t.Fatal("admin package is initialized twice")
+	}
+}
+
+func TestBootstrap(t *testing.T) {
+	reset()
+
+	if needs, err := NeedsBootstrap(); err != nil || !needs {
+		t.Fatalf("NeedsBootstrap() = %v, %v on the first run", needs, err)
+	}
+	// there is no token until it's generated
+	if _, err := Bootstrap("", ADMIN_NAME, TEST_PASSWORD, false); err != ErrBadBootstrap {
+		t.Fatalf("bootstrap without the token: %v", err)
+	}
+
+	token, err := BootstrapToken()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := Bootstrap("wrong", ADMIN_NAME, TEST_PASSWORD, false); err != ErrBadBootstrap {
+		t.Fatalf("bootstrap by the wrong token: %v", err)
+	}
+	// the token survives the refused account
+	if _, err := Bootstrap(token, ADMIN_NAME, "short", false); err != ErrWeakPassword {
+		t.Fatalf("bootstrap with the short password: %v", err)
+	}
+	account, err := Bootstrap(token, ADMIN_NAME, TEST_PASSWORD, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if account.Role != ROLE_ADMIN || account.Disabled {
+		t.Fatalf("bootstrapped account: %+v", account)
+	}
+	if _, err := Authenticate(ADMIN_NAME, TEST_PASSWORD); err != nil {
+		t.Fatal(err)
+	}
+
+	// the token is one-time
+	if _, err := Bootstrap(token, "intruder", TEST_PASSWORD, false); err != ErrBadBootstrap {
+		t.Fatalf("second bootstrap by the token: %v", err)
+	}
+	// accounts exist, so the new token and the settings don't bootstrap too
+	token, err = BootstrapToken()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := Bootstrap(token, "intruder", TEST_PASSWORD, false); err != ErrBootstrapped {
+		t.Fatalf("bootstrap by the new token: %v", err)
+	}
+	if _, err := Bootstrap("", "intruder", TEST_PASSWORD, true); err != ErrBootstrapped {
+		t.Fatalf("bootstrap from the settings: %v", err)
+	}
+	if needs, err := NeedsBootstrap(); err != nil || needs {
+		t.Fatalf("NeedsBootstrap() = %v, %v after the bootstrap", needs, err)
+	}
+}
+
+func TestLastAdmin(t *testing.T) {
+	reset()
+	if _, err := Bootstrap("", ADMIN_NAME, TEST_PASSWORD, true); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := SetDisabled(ADMIN_NAME, true); err != ErrLastAdmin {
+		t.Fatalf("disable the last admin: %v", err)
+	}
+
+	// disabled admins and other roles aren't counted
+	for _, role := range []string{ROLE_ADMIN, ROLE_AUDITOR, ROLE_SUPPORT} {
+		if _, err := Create("second"+role, TEST_PASSWORD, role, ""); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := SetDisabled(ADMIN_NAME, true); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := SetDisabled("second"+ROLE_ADMIN, true); err != ErrLastAdmin {
+		t.Fatalf("disable the last enabled admin: %v", err)
+	}
+	if _, err := SetDisabled("second"+ROLE_AUDITOR, true); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := Authenticate(ADMIN_NAME, TEST_PASSWORD); err != ErrDisabled {
+		t.Fatalf("authenticate the disabled admin: %v", err)
+	}
+
+	// the enabled admin may be disabled again
+	if _, err := SetDisabled(ADMIN_NAME, false); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := SetDisabled("second"+ROLE_ADMIN, true); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := SetDisabled("missing", true); err != ErrNotFound {
+		t.Fatalf("disable the missing account: %v", err)
+	}
+}
+
+func TestAccounts(t *testing.T) {
+	reset()
+
+	identity := "fabric-auditor"
+	if err := testLedger.RegisterUser(&identity); err != nil {
+		t.Fatal(err)
+	}
+	for _, test := range []struct {
+		name, role, identity string
+		err                  error
+	}{
+		{"auditor", ROLE_AUDITOR, identity, nil},
+		{"auditor", ROLE_AUDITOR, "", ErrExists},
+		{"", ROLE_AUDITOR, "", ErrBadName},
+		{"god", "god", "", ErrBadRole},
+		{"fabric", ROLE_SUPPORT, "nobody", ErrNoIdentity},
+	} {
+		if _, err := Create(test.name, TEST_PASSWORD, test.role, test.identity); err != test.err {
+			t.Errorf("create %q: %v, want %v", test.name, err, test.err)
+		}
+	}
+
+	if _, err := Authenticate("auditor", "wrongpass"); err != ErrWrongCredentials {
+		t.Fatalf("authenticate by the wrong password: %v", err)
+	}
+	if _, err := Authenticate("missing", TEST_PASSWORD); err != ErrWrongCredentials {
+		t.Fatalf("authenticate the missing account: %v", err)
+	}
+
+	// the rotated password replaces the old one
+	if _, err := SetPassword("auditor", "short"); err != ErrWeakPassword {
+		t.Fatalf("set the short password: %v", err)
+	}
+	if _, err := SetPassword("auditor", "newpassword"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := Authenticate("auditor", TEST_PASSWORD); err != ErrWrongCredentials {
+		t.Fatalf("authenticate by the old password: %v", err)
+	}
+	account, err := Authenticate("auditor", "newpassword")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if account.Identity != identity || account.Role != ROLE_AUDITOR {
+		t.Fatalf("account: %+v", account)
+	}
+}
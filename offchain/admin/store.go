@@ -0,0 +1,136 @@
+package admin
+
+import (
+	"sort"
+	"sync"
+
+	"gopkg.in/mgo.v2"
+)
+
+// AccountStore is a storage of admin accounts (by name)
+type AccountStore interface {
+	Find(name string) (*Account, error)
+	Insert(account *Account) error
+	Replace(account *Account) error
+	List() ([]Account, error)
+}
+
+// MongoAccounts keeps accounts in the mongodb collection
+type MongoAccounts struct {
+	session    *mgo.Session
+	database   string
+	collection string
+}
+
+// NewMongoAccounts() uses the existing session,
+// every operation works with a copy of it
+func NewMongoAccounts(session *mgo.Session, database, collection string) *MongoAccounts {
+	return &MongoAccounts{
+		session:    session,
+		database:   database,
+		collection: collection,
+	}
+}
+
+func (s *MongoAccounts) with(f func(c *mgo.Collection) error) error {
+	session := s.session.Copy()
+	defer session.Close()
+
+	err := f(session.DB(s.database).C(s.collection))
+	if err == mgo.ErrNotFound {
+		return ErrNotFound
+	}
+	if mgo.IsDup(err) {
+		return ErrExists
+	}
+	return err
+}
+
+func (s *MongoAccounts) Find(name string) (*Account, error) {
+	var account Account
+	err := s.with(func(c *mgo.Collection) error {
+		return c.FindId(name).One(&account)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &account, nil
+}
+
+func (s *MongoAccounts) Insert(account *Account) error {
+	return s.with(func(c *mgo.Collection) error {
+		return c.Insert(account)
+	})
+}
+
+func (s *MongoAccounts) Replace(account *Account) error {
+	return s.with(func(c *mgo.Collection) error {
+		return c.UpdateId(account.Name, account)
+	})
+}
+
+func (s *MongoAccounts) List() ([]Account, error) {
+	var list []Account
+	err := s.with(func(c *mgo.Collection) error {
+		return c.Find(nil).Sort("_id").All(&list)
+	})
+	return list, err
+}
+
+// MemoryAccounts keeps accounts in the process memory
+// NOTE: it's ONLY for tests and local development
+type MemoryAccounts struct {
+	mu       sync.RWMutex
+	accounts map[string]Account
+}
+
+func NewMemoryAccounts() *MemoryAccounts {
+	return &MemoryAccounts{accounts: make(map[string]Account)}
+}
+
+func (s *MemoryAccounts) Find(name string) (*Account, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	account, ok := s.accounts[name]
+	if !ok {
+		return nil, ErrNotFound
+	}
+	return &account, nil
+}
+
+func (s *MemoryAccounts) Insert(account *Account) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, ok := s.accounts[account.Name]; ok {
+		return ErrExists
+	}
+	s.accounts[account.Name] = *account
+	return nil
+}
+
+func (s *MemoryAccounts) Replace(account *Account) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, ok := s.accounts[account.Name]; !ok {
+		return ErrNotFound
+	}
+	s.accounts[account.Name] = *account
+	return nil
+}
+
+func (s *MemoryAccounts) List() ([]Account, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	list := make([]Account, 0, len(s.accounts))
+	for _, account := range s.accounts {
+		list = append(list, account)
+	}
+	sort.Slice(list, func(i, k int) bool {
+		return list[i].Name < list[k].Name
+	})
+	return list, nil
+}
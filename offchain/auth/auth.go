@@ -0,0 +1,394 @@
+/*
+This package authenticates requests by tokens instead of passwords.
+
+The password is verified once (login), then the client gets:
+
+	access token  - signed (HMAC-SHA256) and expiring token that is sent
+	                in the header "Authorization: Bearer <token>"
+	refresh token - opaque token that gives a new pair of tokens (it's rotated
+	                on every refresh, so it can be used once)
+
+Both tokens belong to a session kept by the service, logout revokes
+the session and all its tokens.
+
+The session may keep data that are unlocked by the password on login
+(the user key sealed by the password, see crypdata.UnsealUserKey()). The data
+are sealed by the session key which is known only by the token holder:
+the access token carries it and the refresh token wraps it.
+*/
+package auth
+
+import (
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// kinds of principals
+const (
+	PRINCIPAL_USER  = "user"
+	PRINCIPAL_ADMIN = "admin"
+)
+
+const (
+	DEFAULT_ACCESS_TTL  = 15 * time.Minute
+	DEFAULT_REFRESH_TTL = 24 * time.Hour
+
+	// size of secrets (hmac key, session keys, refresh secrets)
+	SECRET_SIZE = 32
+)
+
+var (
+	ErrNoToken      = errors.New("Authorization header is required")
+	ErrBadToken     = errors.New("bad token")
+	ErrTokenExpired = errors.New("token is expired")
+	ErrRevoked      = errors.New("session is revoked")
+)
+
+// Principal is the authenticated caller
+type Principal struct {
+	Kind      string // PRINCIPAL_USER or PRINCIPAL_ADMIN
+	Name      string // username or admin name
+	SessionID string
+	Expires   time.Time // expiration of the access token
+
+	// key is the session key (it opens data of the session)
+	key []byte
+}
+
+// Tokens is a response of login and refresh
+type Tokens struct {
+	AccessToken  string `json:"access_token"`
+	RefreshToken string `json:"refresh_token"`
+	TokenType    string `json:"token_type"`
+	ExpiresIn    int    `json:"expires_in"` // seconds
+}
+
+type session struct {
+	kind    string
+	name    string
+	expires time.Time // expiration of the refresh token
+
+	refreshHash []byte // sha256 of the refresh secret
+	wrappedKey  []byte // the session key sealed by the refresh secret
+	data        []byte // data sealed by the session key
+}
+
+// Authority issues tokens and keeps sessions (in the process memory,
+// so sessions are lost when the service stops)
+type Authority struct {
+	secret []byte // hmac key of access tokens
+
+	AccessTTL  time.Duration
+	RefreshTTL time.Duration
+
+	mu       sync.Mutex
+	sessions map[string]*session
+}
+
+// New() creates the authority with a new random signing key
+func New() (*Authority, error) {
+	secret, err := randomBytes(SECRET_SIZE)
+	if err != nil {
+		return nil, err
+	}
+	return &Authority{
+		secret:     secret,
+		AccessTTL:  DEFAULT_ACCESS_TTL,
+		RefreshTTL: DEFAULT_REFRESH_TTL,
+		sessions:   make(map[string]*session),
+	}, nil
+}
+
+// Login() starts the session of the principal verified by the caller.
+// data (may be nil) are kept in the session, see Open()
+func (a *Authority) Login(kind, name string, data []byte) (*Tokens, error) {
+	sessionID, err := randomString()
+	if err != nil {
+		return nil, err
+	}
+	key, err := randomBytes(SECRET_SIZE)
+	if err != nil {
+		return nil, err
+	}
+
+	s := &session{kind: kind, name: name}
+	if data != nil {
+		s.data, err = seal(key, data)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	a.removeExpired()
+	a.sessions[sessionID] = s
+	return a.issue(sessionID, s, key)
+}
+
+// Refresh() exchanges the refresh token for a new pair of tokens
+func (a *Authority) Refresh(refreshToken string) (*Tokens, error) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	sessionID, s, refreshSecret, err := a.lookupRefresh(refreshToken)
+	if err != nil {
+		return nil, err
+	}
+	key, err := open(refreshSecret, s.wrappedKey)
+	if err != nil {
+		return nil, ErrBadToken
+	}
+	return a.issue(sessionID, s, key)
+}
+
+// Logout() revokes the session of the refresh token
+func (a *Authority) Logout(refreshToken string) error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	sessionID, _, _, err := a.lookupRefresh(refreshToken)
+	if err != nil {
+		return err
+	}
+	delete(a.sessions, sessionID)
+	return nil
+}
+
+// Revoke() revokes the session of the principal
+func (a *Authority) Revoke(principal *Principal) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	delete(a.sessions, principal.SessionID)
+}
+
+// RevokeAll() revokes all sessions of the principal with this kind and name
+// (e.g. when the password is changed)
+func (a *Authority) RevokeAll(kind, name string) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	for sessionID, s := range a.sessions {
+		if s.kind == kind && s.name == name {
+			delete(a.sessions, sessionID)
+		}
+	}
+}
+
+// Authenticate() checks the access token of the request
+func (a *Authority) Authenticate(r *http.Request) (*Principal, error) {
+	header := r.Header.Get("Authorization")
+	if header == "" {
+		return nil, ErrNoToken
+	}
+	const prefix = "Bearer "
+	if !strings.HasPrefix(header, prefix) {
+		return nil, ErrBadToken
+	}
+
+	claims, err := a.verify(strings.TrimPrefix(header, prefix))
+	if err != nil {
+		return nil, err
+	}
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	s, ok := a.sessions[claims.SessionID]
+	if !ok || time.Now().After(s.expires) {
+		return nil, ErrRevoked
+	}
+	return &Principal{
+		Kind:      s.kind,
+		Name:      s.name,
+		SessionID: claims.SessionID,
+		Expires:   time.Unix(claims.Expires, 0),
+		key:       claims.Key,
+	}, nil
+}
+
+// Open() returns data kept in the session of the principal (nil if there are no data)
+func (a *Authority) Open(principal *Principal) ([]byte, error) {
+	a.mu.Lock()
+	s, ok := a.sessions[principal.SessionID]
+	a.mu.Unlock()
+
+	if !ok {
+		return nil, ErrRevoked
+	}
+	if s.data == nil {
+		return nil, nil
+	}
+	return open(principal.key, s.data)
+}
+
+// issue() makes the access token and rotates the refresh token of the session
+func (a *Authority) issue(sessionID string, s *session, key []byte) (*Tokens, error) {
+	refreshSecret, err := randomBytes(SECRET_SIZE)
+	if err != nil {
+		return nil, err
+	}
+	wrappedKey, err := seal(refreshSecret, key)
+	if err != nil {
+		return nil, err
+	}
+	refreshHash := sha256.Sum256(refreshSecret)
+
+	now := time.Now()
+	s.refreshHash = refreshHash[:]
+	s.wrappedKey = wrappedKey
+	s.expires = now.Add(a.RefreshTTL)
+
+	accessToken, err := a.sign(&claims{
+		SessionID: sessionID,
+		Expires:   now.Add(a.AccessTTL).Unix(),
+		Key:       key,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return &Tokens{
+		AccessToken:  accessToken,
+		RefreshToken: sessionID + "." + base64.RawURLEncoding.EncodeToString(refreshSecret),
+		TokenType:    "Bearer",
+		ExpiresIn:    int(a.AccessTTL / time.Second),
+	}, nil
+}
+
+// lookupRefresh() finds the session of the refresh token (a.mu is locked)
+func (a *Authority) lookupRefresh(refreshToken string) (string, *session, []byte, error) {
+	parts := strings.SplitN(refreshToken, ".", 2)
+	if len(parts) != 2 {
+		return "", nil, nil, ErrBadToken
+	}
+	refreshSecret, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		return "", nil, nil, ErrBadToken
+	}
+
+	s, ok := a.sessions[parts[0]]
+	if !ok {
+		return "", nil, nil, ErrRevoked
+	}
+	refreshHash := sha256.Sum256(refreshSecret)
+	if subtle.ConstantTimeCompare(refreshHash[:], s.refreshHash) != 1 {
+		return "", nil, nil, ErrBadToken
+	}
+	if time.Now().After(s.expires) {
+		delete(a.sessions, parts[0])
+		return "", nil, nil, ErrTokenExpired
+	}
+	return parts[0], s, refreshSecret, nil
+}
+
+// removeExpired() forgets sessions with expired refresh tokens (a.mu is locked)
+func (a *Authority) removeExpired() {
+	now := time.Now()
+	for id, s := range a.sessions {
+		if now.After(s.expires) {
+			delete(a.sessions, id)
+		}
+	}
+}
+
+type contextKey struct{}
+
+// Middleware() puts the principal of the request (if there is a valid
+// access token) into the request context, see FromRequest().
+// Requests with a bad token are refused
+func (a *Authority) Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		principal, err := a.Authenticate(r)
+		if err == ErrNoToken {
+			next.ServeHTTP(w, r)
+			return
+		}
+		if err != nil {
+			w.Header().Set("WWW-Authenticate", `Bearer error="invalid_token"`)
+			w.Header().Set("Content-Type", "application/json; charset=utf-8")
+			w.WriteHeader(http.StatusUnauthorized)
+			fmt.Fprintf(w, "{message: %q}", err.Error())
+			return
+		}
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), contextKey{}, principal)))
+	})
+}
+
+// FromRequest() returns the principal of the request (nil for anonymous requests)
+func FromRequest(r *http.Request) *Principal {
+	principal, _ := r.Context().Value(contextKey{}).(*Principal)
+	return principal
+}
+
+// IsUser() reports whether the principal is the user with this username
+func (p *Principal) IsUser(username string) bool {
+	return p != nil && p.Kind == PRINCIPAL_USER && p.Name == username
+}
+
+// IsAdmin() reports whether the principal is an admin
+func (p *Principal) IsAdmin() bool {
+	return p != nil && p.Kind == PRINCIPAL_ADMIN
+}
+
+func randomBytes(size int) ([]byte, error) {
+	b := make([]byte, size)
+	if _, err := io.ReadFull(rand.Reader, b); err != nil {
+		return nil, err
+	}
+	return b, nil
+}
+
+func randomString() (string, error) {
+	b, err := randomBytes(16)
+	if err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+// seal() encrypts data by aes-gcm (nonce + ciphertext)
+func seal(key, data []byte) ([]byte, error) {
+	gcm, err := newGCM(key)
+	if err != nil {
+		return nil, err
+	}
+	nonce, err := randomBytes(gcm.NonceSize())
+	if err != nil {
+		return nil, err
+	}
+	return gcm.Seal(nonce, nonce, data, nil), nil
+}
+
+func open(key, sealed []byte) ([]byte, error) {
+	gcm, err := newGCM(key)
+	if err != nil {
+		return nil, err
+	}
+	if len(sealed) < gcm.NonceSize() {
+		return nil, errors.New("sealed data is too short")
+	}
+	return gcm.Open(nil, sealed[:gcm.NonceSize()], sealed[gcm.NonceSize():], nil)
+}
+
+func newGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
@@ -0,0 +1,217 @@
+package auth
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func newTestAuthority(t *testing.T) *Authority {
+	a, err := New()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return a
+}
+
+// request() makes the request with the access token (if it isn't empty)
+func request(accessToken string) *http.Request {
+	r := httptest.NewRequest("GET", "/users/ondar07", nil)
+	if accessToken != "" {
+		r.Header.Set("Authorization", "Bearer "+accessToken)
+	}
+	return r
+}
+
+func TestLogin(t *testing.T) {
+	a := newTestAuthority(t)
+
+	tokens, err := a.Login(PRINCIPAL_USER, "ondar07", []byte("user key"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if tokens.TokenType != "Bearer" || tokens.ExpiresIn != int(DEFAULT_ACCESS_TTL/time.Second) {
+		t.Fatalf("Login() = %+v", tokens)
+	}
+
+	principal, err := a.Authenticate(request(tokens.AccessToken))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !principal.IsUser("ondar07") || principal.IsUser("alice") || principal.IsAdmin() {
+		t.Fatalf("Authenticate() = %+v, want the user ondar07", principal)
+	}
+	data, err := a.Open(principal)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(data) != "user key" {
+		t.Fatalf("Open() = %q, want data of the session", data)
+	}
+}
+
+func TestAuthenticateBadToken(t *testing.T) {
+	a := newTestAuthority(t)
+	tokens, err := a.Login(PRINCIPAL_ADMIN, "root", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := a.Authenticate(request("")); err != ErrNoToken {
+		t.Fatalf("Authenticate() without token: %v, want ErrNoToken", err)
+	}
+	r := request("")
+	r.Header.Set("Authorization", "Basic cm9vdDpzZWNyZXQ=")
+	if _, err := a.Authenticate(r); err != ErrBadToken {
+		t.Fatalf("Authenticate() with basic auth: %v, want ErrBadToken", err)
+	}
+
+	// the signature doesn't match the changed claims
+	payload := strings.Split(tokens.AccessToken, ".")[0]
+	forged := strings.Replace(tokens.AccessToken, payload, payload+"x", 1)
+	if _, err := a.Authenticate(request(forged)); err != ErrBadToken {
+		t.Fatalf("Authenticate() of forged token: %v, want ErrBadToken", err)
+	}
+
+	// tokens of other authority (e.g. of the previous launch) are refused
+	other := newTestAuthority(t)
+	if _, err := other.Authenticate(request(tokens.AccessToken)); err != ErrBadToken {
+		t.Fatalf("Authenticate() by other authority: %v, want ErrBadToken", err)
+	}
+}
+
+func TestExpiry(t *testing.T) {
+	a := newTestAuthority(t)
+	a.AccessTTL = -time.Second
+
+	tokens, err := a.Login(PRINCIPAL_USER, "ondar07", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := a.Authenticate(request(tokens.AccessToken)); err != ErrTokenExpired {
+		t.Fatalf("Authenticate() of expired token: %v, want ErrTokenExpired", err)
+	}
+
+	// the refresh token gives the new access token
+	a.AccessTTL = time.Minute
+	tokens, err = a.Refresh(tokens.RefreshToken)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := a.Authenticate(request(tokens.AccessToken)); err != nil {
+		t.Fatal(err)
+	}
+
+	// the expired refresh token ends the session
+	a.RefreshTTL = -time.Second
+	tokens, err = a.Refresh(tokens.RefreshToken)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := a.Authenticate(request(tokens.AccessToken)); err != ErrRevoked {
+		t.Fatalf("Authenticate() after the session expired: %v, want ErrRevoked", err)
+	}
+	if _, err := a.Refresh(tokens.RefreshToken); err != ErrTokenExpired {
+		t.Fatalf("Refresh() of expired token: %v, want ErrTokenExpired", err)
+	}
+}
+
+func TestRefresh(t *testing.T) {
+	a := newTestAuthority(t)
+
+	tokens, err := a.Login(PRINCIPAL_USER, "ondar07", []byte("user key"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	refreshed, err := a.Refresh(tokens.RefreshToken)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the refresh token is rotated, so it can be used once
+	if _, err := a.Refresh(tokens.RefreshToken); err != ErrBadToken {
+		t.Fatalf("Refresh() by used token: %v, want ErrBadToken", err)
+	}
+	if _, err := a.Refresh("garbage"); err != ErrBadToken {
+		t.Fatalf("Refresh(\"garbage\"): %v, want ErrBadToken", err)
+	}
+
+	// the session keeps its data
+	principal, err := a.Authenticate(request(refreshed.AccessToken))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if data, err := a.Open(principal); err != nil || string(data) != "user key" {
+		t.Fatalf("Open() after Refresh() = %q, %v", data, err)
+	}
+}
+
+func TestLogout(t *testing.T) {
+	a := newTestAuthority(t)
+
+	tokens, err := a.Login(PRINCIPAL_USER, "ondar07", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	other, err := a.Login(PRINCIPAL_USER, "ondar07", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := a.Logout("garbage"); err != ErrBadToken {
+		t.Fatalf("Logout(\"garbage\"): %v, want ErrBadToken", err)
+	}
+	if err := a.Logout(tokens.RefreshToken); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := a.Authenticate(request(tokens.AccessToken)); err != ErrRevoked {
+		t.Fatalf("Authenticate() after Logout(): %v, want ErrRevoked", err)
+	}
+	if _, err := a.Refresh(tokens.RefreshToken); err != ErrRevoked {
+		t.Fatalf("Refresh() after Logout(): %v, want ErrRevoked", err)
+	}
+
+	// other sessions of the user are alive until RevokeAll()
+	if _, err := a.Authenticate(request(other.AccessToken)); err != nil {
+		t.Fatal(err)
+	}
+	a.RevokeAll(PRINCIPAL_USER, "ondar07")
+	if _, err := a.Authenticate(request(other.AccessToken)); err != ErrRevoked {
+		t.Fatalf("Authenticate() after RevokeAll(): %v, want ErrRevoked", err)
+	}
+}
+
+func TestMiddleware(t *testing.T) {
+	a := newTestAuthority(t)
+	tokens, err := a.Login(PRINCIPAL_ADMIN, "root", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var principal *Principal
+	handler := a.Middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		principal = FromRequest(r)
+	}))
+
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, request(tokens.AccessToken))
+	if w.Code != http.StatusOK || !principal.IsAdmin() || principal.Name != "root" {
+		t.Fatalf("request with token: %d, principal %+v", w.Code, principal)
+	}
+
+	// anonymous requests pass without the principal
+	principal = nil
+	w = httptest.NewRecorder()
+	handler.ServeHTTP(w, request(""))
+	if w.Code != http.StatusOK || principal != nil {
+		t.Fatalf("anonymous request: %d, principal %+v", w.Code, principal)
+	}
+
+	w = httptest.NewRecorder()
+	handler.ServeHTTP(w, request("bad.token"))
+	if w.Code != http.StatusUnauthorized || w.Header().Get("WWW-Authenticate") == "" {
+		t.Fatalf("request with bad token: %d, want 401 with WWW-Authenticate", w.Code)
+	}
+}
@@ -0,0 +1,62 @@
+package auth
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"strings"
+	"time"
+)
+
+/*
+Access token format:
+	base64url(JSON claims) "." base64url(HMAC-SHA256 of the first part)
+*/
+
+type claims struct {
+	SessionID string `json:"sid"`
+	Expires   int64  `json:"exp"` // unix time
+	Key       []byte `json:"key"` // the session key
+}
+
+func (a *Authority) sign(c *claims) (string, error) {
+	payload, err := json.Marshal(c)
+	if err != nil {
+		return "", err
+	}
+	encoded := base64.RawURLEncoding.EncodeToString(payload)
+	return encoded + "." + base64.RawURLEncoding.EncodeToString(a.mac(encoded)), nil
+}
+
+// verify() checks the signature and the expiration of the access token
+func (a *Authority) verify(token string) (*claims, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 2 {
+		return nil, ErrBadToken
+	}
+	signature, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil || !hmac.Equal(signature, a.mac(parts[0])) {
+		return nil, ErrBadToken
+	}
+
+	payload, err := base64.RawURLEncoding.DecodeString(parts[0])
+	if err != nil {
+		return nil, ErrBadToken
+	}
+	var c claims
+	err = json.Unmarshal(payload, &c)
+	if err != nil {
+		return nil, ErrBadToken
+	}
+	if time.Now().Unix() >= c.Expires {
+		return nil, ErrTokenExpired
+	}
+	return &c, nil
+}
+
+func (a *Authority) mac(data string) []byte {
+	h := hmac.New(sha256.New, a.secret)
+	h.Write([]byte(data))
+	return h.Sum(nil)
+}
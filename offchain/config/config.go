@@ -0,0 +1,325 @@
+/*
+This package describes settings of the offchain service.
+
+Settings are loaded from the YAML (or JSON) file, then they are overridden
+by environment variables (FABUSERS_<SECTION>_<NAME>, see envOverrides)
+and validated. Missing settings take default values (see Default()).
+*/
+package config
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v2"
+
+	"../auth"
+	"../crypdata"
+	"../onchain"
+	"../store"
+)
+
+const DEFAULT_PATH = "fabusers.yaml"
+
+// the admin password of the first version, the service warns if it is used
+const INSECURE_ADMIN_PASSWORD = "AdminSuperPassword"
+
+type Config struct {
+	Store  StoreConfig  `yaml:"store"`
+	Mongo  MongoConfig  `yaml:"mongo"`
+	HTTP   HTTPConfig   `yaml:"http"`
+	Ledger LedgerConfig `yaml:"ledger"`
+	Crypto CryptoConfig `yaml:"crypto"`
+	Admin  AdminConfig  `yaml:"admin"`
+	Auth   AuthConfig   `yaml:"auth"`
+
+	Reconcile ReconcileConfig `yaml:"reconcile"`
+	Integrity IntegrityConfig `yaml:"integrity"`
+}
+
+// StoreConfig selects the offchain db (see store package)
+type StoreConfig struct {
+	Backend string `yaml:"backend"`
+}
+
+// MongoConfig describes the mongodb offchain db
+type MongoConfig struct {
+	URL             string `yaml:"url"`
+	Database        string `yaml:"database"`
+	UsersCollection string `yaml:"users_collection"`
+
+	// journal of unfinished operations (see saga package)
+	OperationsCollection string `yaml:"operations_collection"`
+
+	// admin accounts (see admin package)
+	AdminsCollection string `yaml:"admins_collection"`
+
+	// all versions of records (see store.VersionStore)
+	VersionsCollection string `yaml:"versions_collection"`
+
+	// data keys of users (see store.KeyStore)
+	KeysCollection string `yaml:"keys_collection"`
+}
+
+type HTTPConfig struct {
+	// listen address of the service
+	Addr string `yaml:"addr"`
+}
+
+// LedgerConfig selects the ledger backend (see onchain.New())
+type LedgerConfig struct {
+	Backend string `yaml:"backend"`
+
+	// backend specific options (scripts_dir, connection_profile, etc.)
+	Options map[string]string `yaml:"options"`
+}
+
+type CryptoConfig struct {
+	// PEM file with the key of private data
+	Keystore string `yaml:"keystore"`
+
+	// cipher of new private data
+	Cipher string `yaml:"cipher"`
+
+	// encrypt private data to user keys sealed by user passwords, otherwise
+	// by data keys wrapped by the keystore key (it decrypts every user then)
+	UserKeys bool `yaml:"user_keys"`
+}
+
+// AdminConfig is used to create the main admin account on the first run
+// (if the password is empty, the one-time bootstrap token is printed instead)
+type AdminConfig struct {
+	Password string `yaml:"password"`
+}
+
+// AuthConfig describes tokens (see auth package)
+type AuthConfig struct {
+	// lifetime of access tokens
+	AccessTTL time.Duration `yaml:"access_ttl"`
+
+	// lifetime of refresh tokens (and sessions)
+	RefreshTTL time.Duration `yaml:"refresh_ttl"`
+}
+
+// ReconcileConfig describes the background reconciliation (see reconcile package)
+type ReconcileConfig struct {
+	// interval of reconciliations (0 - don't reconcile in the background)
+	Interval time.Duration `yaml:"interval"`
+
+	// repair safe cases
+	Repair bool `yaml:"repair"`
+}
+
+// IntegrityConfig describes what to do with tampered records
+type IntegrityConfig struct {
+	// refuse to return tampered records (otherwise they are returned
+	// still ciphered with the "tampered" integrity status)
+	Refuse bool `yaml:"refuse"`
+}
+
+// Default() returns settings of the service that works with local
+// mongodb and basic-network
+func Default() *Config {
+	return &Config{
+		Store: StoreConfig{
+			Backend: store.MONGO_BACKEND,
+		},
+		Mongo: MongoConfig{
+			URL:                  "localhost",
+			Database:             "fabusers",
+			UsersCollection:      "users",
+			OperationsCollection: "operations",
+			AdminsCollection:     "admins",
+			VersionsCollection:   "versions",
+			KeysCollection:       "datakeys",
+		},
+		HTTP: HTTPConfig{
+			Addr: "localhost:8080",
+		},
+		Ledger: LedgerConfig{
+			// backends have default options
+			Backend: onchain.GOSDK_BACKEND,
+		},
+		Crypto: CryptoConfig{
+			Keystore: crypdata.DEFAULT_KEYSTORE,
+			Cipher:   crypdata.DEFAULT_CIPHER,
+			UserKeys: true,
+		},
+		Auth: AuthConfig{
+			AccessTTL:  auth.DEFAULT_ACCESS_TTL,
+			RefreshTTL: auth.DEFAULT_REFRESH_TTL,
+		},
+		Reconcile: ReconcileConfig{
+			Interval: time.Hour,
+		},
+		Integrity: IntegrityConfig{
+			Refuse: true,
+		},
+	}
+}
+
+// Load() reads the settings file (it's optional if path is DEFAULT_PATH),
+// applies environment overrides and validates the result
+func Load(path string) (*Config, error) {
+	cfg := Default()
+
+	data, err := ioutil.ReadFile(path)
+	if err != nil && !(os.IsNotExist(err) && path == DEFAULT_PATH) {
+		return nil, fmt.Errorf("can't read config %s: %v", path, err)
+	}
+	if err == nil {
+		// YAML is a superset of JSON, so JSON files are parsed too
+		err = yaml.UnmarshalStrict(data, cfg)
+		if err != nil {
+			return nil, fmt.Errorf("can't parse config %s: %v", path, err)
+		}
+	}
+
+	err = cfg.applyEnv()
+	if err != nil {
+		return nil, err
+	}
+
+	err = cfg.Validate()
+	if err != nil {
+		return nil, err
+	}
+	return cfg, nil
+}
+
+// envOverrides maps environment variables to settings
+func (cfg *Config) envOverrides() map[string]interface{} {
+	if cfg.Ledger.Options == nil {
+		cfg.Ledger.Options = make(map[string]string)
+	}
+	return map[string]interface{}{
+		"FABUSERS_STORE_BACKEND":               &cfg.Store.Backend,
+		"FABUSERS_MONGO_URL":                   &cfg.Mongo.URL,
+		"FABUSERS_MONGO_DATABASE":              &cfg.Mongo.Database,
+		"FABUSERS_MONGO_USERS_COLLECTION":      &cfg.Mongo.UsersCollection,
+		"FABUSERS_MONGO_OPERATIONS_COLLECTION": &cfg.Mongo.OperationsCollection,
+		"FABUSERS_MONGO_ADMINS_COLLECTION":     &cfg.Mongo.AdminsCollection,
+		"FABUSERS_MONGO_VERSIONS_COLLECTION":   &cfg.Mongo.VersionsCollection,
+		"FABUSERS_MONGO_KEYS_COLLECTION":       &cfg.Mongo.KeysCollection,
+		"FABUSERS_HTTP_ADDR":                   &cfg.HTTP.Addr,
+		"FABUSERS_LEDGER_BACKEND":              &cfg.Ledger.Backend,
+		"FABUSERS_CRYPTO_KEYSTORE":             &cfg.Crypto.Keystore,
+		"FABUSERS_CRYPTO_CIPHER":               &cfg.Crypto.Cipher,
+		"FABUSERS_CRYPTO_USER_KEYS":            &cfg.Crypto.UserKeys,
+		"FABUSERS_ADMIN_PASSWORD":              &cfg.Admin.Password,
+		"FABUSERS_AUTH_ACCESS_TTL":             &cfg.Auth.AccessTTL,
+		"FABUSERS_AUTH_REFRESH_TTL":            &cfg.Auth.RefreshTTL,
+		"FABUSERS_RECONCILE_INTERVAL":          &cfg.Reconcile.Interval,
+		"FABUSERS_RECONCILE_REPAIR":            &cfg.Reconcile.Repair,
+		"FABUSERS_INTEGRITY_REFUSE":            &cfg.Integrity.Refuse,
+	}
+}
+
+// applyEnv() overrides settings by environment variables.
+// FABUSERS_LEDGER_OPTION_<NAME> sets the ledger backend option <name>
+func (cfg *Config) applyEnv() error {
+	for name, setting := range cfg.envOverrides() {
+		value, ok := os.LookupEnv(name)
+		if !ok {
+			continue
+		}
+		switch setting := setting.(type) {
+		case *string:
+			*setting = value
+		case *bool:
+			b, err := strconv.ParseBool(value)
+			if err != nil {
+				return fmt.Errorf("%s: %v", name, err)
+			}
+			*setting = b
+		case *time.Duration:
+			d, err := time.ParseDuration(value)
+			if err != nil {
+				return fmt.Errorf("%s: %v", name, err)
+			}
+			*setting = d
+		}
+	}
+
+	const optionPrefix = "FABUSERS_LEDGER_OPTION_"
+	for _, env := range os.Environ() {
+		pair := strings.SplitN(env, "=", 2)
+		if len(pair) == 2 && strings.HasPrefix(pair[0], optionPrefix) {
+			option := strings.ToLower(strings.TrimPrefix(pair[0], optionPrefix))
+			cfg.Ledger.Options[option] = pair[1]
+		}
+	}
+	return nil
+}
+
+// Validate() checks that all settings are specified and known
+func (cfg *Config) Validate() error {
+	var problems []string
+	required := map[string]string{
+		"store.backend":   cfg.Store.Backend,
+		"http.addr":       cfg.HTTP.Addr,
+		"ledger.backend":  cfg.Ledger.Backend,
+		"crypto.keystore": cfg.Crypto.Keystore,
+		"crypto.cipher":   cfg.Crypto.Cipher,
+	}
+	if cfg.Store.Backend == store.MONGO_BACKEND {
+		required["mongo.url"] = cfg.Mongo.URL
+		required["mongo.database"] = cfg.Mongo.Database
+		required["mongo.users_collection"] = cfg.Mongo.UsersCollection
+		required["mongo.operations_collection"] = cfg.Mongo.OperationsCollection
+		required["mongo.admins_collection"] = cfg.Mongo.AdminsCollection
+		required["mongo.versions_collection"] = cfg.Mongo.VersionsCollection
+		required["mongo.keys_collection"] = cfg.Mongo.KeysCollection
+	}
+	for name, value := range required {
+		if value == "" {
+			problems = append(problems, name+" is not specified")
+		}
+	}
+
+	if cfg.Store.Backend != "" && !contains(store.Backends(), cfg.Store.Backend) {
+		problems = append(problems, fmt.Sprintf("store.backend: unknown backend %q (known: %v)",
+			cfg.Store.Backend, store.Backends()))
+	}
+	if cfg.Ledger.Backend != "" && !contains(onchain.Backends(), cfg.Ledger.Backend) {
+		problems = append(problems, fmt.Sprintf("ledger.backend: unknown backend %q (known: %v)",
+			cfg.Ledger.Backend, onchain.Backends()))
+	}
+	if cfg.Crypto.Cipher != "" && !contains(crypdata.Ciphers(), cfg.Crypto.Cipher) {
+		problems = append(problems, fmt.Sprintf("crypto.cipher: unknown cipher %q (known: %v)",
+			cfg.Crypto.Cipher, crypdata.Ciphers()))
+	}
+
+	if cfg.Auth.AccessTTL <= 0 || cfg.Auth.RefreshTTL <= 0 {
+		problems = append(problems, "auth.access_ttl and auth.refresh_ttl have to be positive")
+	}
+	if cfg.Reconcile.Interval < 0 {
+		problems = append(problems, "reconcile.interval is negative")
+	}
+
+	if len(problems) > 0 {
+		sort.Strings(problems)
+		return errors.New("bad config: " + strings.Join(problems, "; "))
+	}
+
+	if cfg.Admin.Password == INSECURE_ADMIN_PASSWORD {
+		log.Println("WARNING: the default admin password is used, change admin.password")
+	}
+	return nil
+}
+
+func contains(list []string, s string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,180 @@
+package config
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"../onchain"
+	"../store"
+)
+
+// writeConfig() writes the settings file to the temporary dir
+func writeConfig(t *testing.T, name, data string) string {
+	path := filepath.Join(t.TempDir(), name)
+	if err := ioutil.WriteFile(path, []byte(data), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestLoad(t *testing.T) {
+	path := writeConfig(t, "fabusers.yaml", `
+store:
+  backend: memory
+http:
+  addr: ":9090"
+ledger:
+  backend: memory
+crypto:
+  user_keys: false
+auth:
+  access_ttl: 5m
+`)
+	cfg, err := Load(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfg.Store.Backend != store.MEMORY_BACKEND || cfg.HTTP.Addr != ":9090" || cfg.Ledger.Backend != onchain.MEMORY_BACKEND ||
+		cfg.Crypto.UserKeys || cfg.Auth.AccessTTL != 5*time.Minute {
+		t.Fatalf("settings of the file: %+v", cfg)
+	}
+
+	// missing settings take default values
+	def := Default()
+	if cfg.Crypto.Cipher != def.Crypto.Cipher || cfg.Auth.RefreshTTL != def.Auth.RefreshTTL || cfg.Mongo != def.Mongo {
+		t.Fatalf("default settings: %+v", cfg)
+	}
+
+	// JSON files are parsed too
+	path = writeConfig(t, "fabusers.json", `{"http": {"addr": ":9091"}}`)
+	if cfg, err = Load(path); err != nil || cfg.HTTP.Addr != ":9091" {
+		t.Fatalf("JSON config: %+v, %v", cfg, err)
+	}
+}
+
+func TestLoadShipped(t *testing.T) {
+	cfg, err := Load(filepath.Join("..", DEFAULT_PATH))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the shipped file describes defaults (and options of ledger backends)
+	want := Default()
+	want.Ledger.Options = cfg.Ledger.Options
+	if !reflect.DeepEqual(cfg, want) {
+		t.Fatalf("shipped settings:\n%+v\nwant defaults:\n%+v", cfg, want)
+	}
+}
+
+func TestLoadMissing(t *testing.T) {
+	// the default file is optional
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chdir(t.TempDir()); err != nil {
+		t.Fatal(err)
+	}
+	defer os.Chdir(wd)
+
+	cfg, err := Load(DEFAULT_PATH)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(cfg.HTTP, Default().HTTP) {
+		t.Fatalf("settings without the file: %+v", cfg)
+	}
+
+	// other files aren't
+	if _, err := Load("missing.yaml"); err == nil {
+		t.Fatal("missing config is loaded")
+	}
+}
+
+func TestLoadStrict(t *testing.T) {
+	for _, data := range []string{
+		"mongo:\n  users_colection: people\n",
+		"cryptography:\n  cipher: aes-gcm\n",
+		"auth:\n  access_ttl: forever\n",
+		"http: [localhost]\n",
+	} {
+		if _, err := Load(writeConfig(t, "fabusers.yaml", data)); err == nil {
+			t.Errorf("config %q is loaded", data)
+		}
+	}
+}
+
+func TestEnv(t *testing.T) {
+	path := writeConfig(t, "fabusers.yaml", "http:\n  addr: \":9090\"\n")
+
+	t.Setenv("FABUSERS_HTTP_ADDR", ":7070")
+	t.Setenv("FABUSERS_CRYPTO_USER_KEYS", "false")
+	t.Setenv("FABUSERS_AUTH_REFRESH_TTL", "2h")
+	t.Setenv("FABUSERS_LEDGER_OPTION_SCRIPTS_DIR", "/opt/fabusers")
+	cfg, err := Load(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// environment variables override the file
+	if cfg.HTTP.Addr != ":7070" || cfg.Crypto.UserKeys || cfg.Auth.RefreshTTL != 2*time.Hour ||
+		cfg.Ledger.Options["scripts_dir"] != "/opt/fabusers" {
+		t.Fatalf("settings: %+v", cfg)
+	}
+
+	for _, test := range []struct {
+		name, value string
+		problem     string
+	}{
+		{"FABUSERS_CRYPTO_USER_KEYS", "maybe", "FABUSERS_CRYPTO_USER_KEYS"},
+		{"FABUSERS_RECONCILE_INTERVAL", "hourly", "FABUSERS_RECONCILE_INTERVAL"},
+		{"FABUSERS_STORE_BACKEND", "postgres", "store.backend: unknown backend"},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			t.Setenv(test.name, test.value)
+			_, err := Load(path)
+			if err == nil || !strings.Contains(err.Error(), test.problem) {
+				t.Fatalf("%s=%s: %v", test.name, test.value, err)
+			}
+		})
+	}
+}
+
+func TestValidate(t *testing.T) {
+	if err := Default().Validate(); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, test := range []struct {
+		change  func(cfg *Config)
+		problem string
+	}{
+		{func(cfg *Config) { cfg.HTTP.Addr = "" }, "http.addr is not specified"},
+		{func(cfg *Config) { cfg.Mongo.VersionsCollection = "" }, "mongo.versions_collection is not specified"},
+		{func(cfg *Config) { cfg.Store.Backend = "postgres" }, "store.backend: unknown backend"},
+		{func(cfg *Config) { cfg.Ledger.Backend = "ethereum" }, "ledger.backend: unknown backend"},
+		{func(cfg *Config) { cfg.Crypto.Cipher = "rot13" }, "crypto.cipher: unknown cipher"},
+		{func(cfg *Config) { cfg.Auth.AccessTTL = 0 }, "auth.access_ttl and auth.refresh_ttl have to be positive"},
+		{func(cfg *Config) { cfg.Reconcile.Interval = -time.Second }, "reconcile.interval is negative"},
+	} {
+		cfg := Default()
+		test.change(cfg)
+		err := cfg.Validate()
+		if err == nil || !strings.Contains(err.Error(), test.problem) {
+			t.Errorf("%q: %v", test.problem, err)
+		}
+	}
+
+	// mongo settings aren't required by other stores
+	cfg := Default()
+	cfg.Store.Backend = store.MEMORY_BACKEND
+	cfg.Mongo = MongoConfig{}
+	if err := cfg.Validate(); err != nil {
+		t.Fatal(err)
+	}
+}
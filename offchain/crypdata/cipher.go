@@ -0,0 +1,118 @@
+package crypdata
+
+import (
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"sort"
+)
+
+// Cipher is an encryption strategy
+type Cipher interface {
+	Encrypt(data []byte) ([]byte, error)
+	Decrypt(ciphertext []byte) ([]byte, error)
+}
+
+// CipherFactory creates a cipher which uses the rsa key
+// (directly or to wrap data keys)
+type CipherFactory func(key *rsa.PrivateKey) Cipher
+
+// Hasher is a hash strategy
+type Hasher interface {
+	Hash(data string) string
+}
+
+// names of built-in ciphers
+const (
+	AES_GCM           = "aes-gcm"
+	RSA_OAEP          = "rsa-oaep"
+	CHACHA20_POLY1305 = "chacha20-poly1305"
+
+	DEFAULT_CIPHER = AES_GCM
+)
+
+// names of built-in hashers
+const (
+	SHA256 = "sha256"
+)
+
+type cipherEntry struct {
+	id      byte
+	name    string
+	factory CipherFactory
+}
+
+// registered ciphers (cipher id -> cipher)
+var ciphers = make(map[byte]cipherEntry)
+
+// registered hashers (name -> hasher)
+var hashers = make(map[string]Hasher)
+
+func init() {
+	// id 1 is the envelope format of the previous version,
+	// id 4 is reserved for per-user keys (see userkey.go),
+	// id 5 is reserved for data keys of users (see datakey.go),
+	// ids must never be changed (they are saved in ciphertexts)
+	RegisterCipher(1, AES_GCM, newAESGCMCipher)
+	RegisterCipher(2, RSA_OAEP, newRSACipher)
+	RegisterCipher(3, CHACHA20_POLY1305, newChaChaCipher)
+
+	RegisterHasher(SHA256, sha256Hasher{})
+}
+
+// RegisterCipher() makes the cipher available by the name,
+// id is written as the first byte of every ciphertext of this cipher
+func RegisterCipher(id byte, name string, factory CipherFactory) {
+	if factory == nil {
+		panic("crypdata: RegisterCipher factory is nil")
+	}
+	if id == USER_ECIES_ID || id == USER_DATA_KEY_ID {
+		panic(fmt.Sprintf("crypdata: cipher id %d is reserved", id))
+	}
+	if _, dup := ciphers[id]; dup {
+		panic(fmt.Sprintf("crypdata: RegisterCipher called twice for cipher id %d", id))
+	}
+	if _, dup := cipherByName(name); dup {
+		panic("crypdata: RegisterCipher called twice for cipher " + name)
+	}
+	ciphers[id] = cipherEntry{id: id, name: name, factory: factory}
+}
+
+// RegisterHasher() makes the hasher available by the name
+func RegisterHasher(name string, hasher Hasher) {
+	if hasher == nil {
+		panic("crypdata: RegisterHasher hasher is nil")
+	}
+	if _, dup := hashers[name]; dup {
+		panic("crypdata: RegisterHasher called twice for hasher " + name)
+	}
+	hashers[name] = hasher
+}
+
+// Ciphers() returns sorted names of all registered ciphers
+func Ciphers() []string {
+	var names []string
+	for _, entry := range ciphers {
+		names = append(names, entry.name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func cipherByName(name string) (cipherEntry, bool) {
+	for _, entry := range ciphers {
+		if entry.name == name {
+			return entry, true
+		}
+	}
+	return cipherEntry{}, false
+}
+
+// sha256Hasher calculates sha256 hash (hex string)
+type sha256Hasher struct{}
+
+func (sha256Hasher) Hash(data string) string {
+	hashedBytes := sha256.Sum256([]byte(data))
+	return hex.EncodeToString(hashedBytes[:])
+}
@@ -1,75 +1,128 @@
 /*
 This package is used to encrypt and decrypt private data.
-Also, it provides hash (sha256) procedure for passwords.
+Also, it provides hash procedures (sha256 for data, argon2id for passwords).
+
+Encryption and hash strategies are chosen by name (see Cipher, Hasher and
+SetCipher(), SetHasher()). Every ciphertext starts with the id of the cipher
+which produced it, so records encrypted by different ciphers can coexist.
+
+The rsa key is kept in the keystore (PEM file) on disk,
+so data saved by previous launches of the service can be decrypted.
 */
 package crypdata
 
 import (
-	"crypto/rand"
-	"crypto/rsa"
-	"crypto/sha256"
-	"encoding/hex"
 	"errors"
 )
 
 // At the first stage, we can use the single pair
 // of private and public keys to encrypt and decrypt private data
 // Idealy, we should use users public and private keys in the Fabric
-var privKey *rsa.PrivateKey = nil
+var privKey *Key = nil
+
+// cipher used to encrypt new data
+var currentCipher = DEFAULT_CIPHER
+
+// hasher used by Hash()
+var currentHasher Hasher = sha256Hasher{}
 
-func Init() error {
-	// Generate RSA Keys
-	privkey, err := rsa.GenerateKey(rand.Reader, 2048)
+// Init() loads the rsa key from the keystore file.
+// If the keystore doesn't exist, a new key is generated and saved there
+func Init(keystorePath string) error {
+	key, err := LoadKey(keystorePath)
 	if err != nil {
-		return errors.New("can't generate rsa keys")
+		return err
 	}
-	privKey = privkey
+	privKey = key
 	return nil
 }
 
-// Encrypt() encrypts data and returns ciphertext
-func Encrypt(data []byte) ([]byte, error) {
+// CurrentKey() returns the key loaded by Init()
+func CurrentKey() *Key {
+	return privKey
+}
 
-	if privKey == nil {
-		return nil, errors.New("No rsa keys, init crypdata package")
+// SetCipher() selects the cipher (by name) for new data.
+// Data encrypted by other ciphers can be decrypted still
+func SetCipher(name string) error {
+	if _, ok := cipherByName(name); !ok {
+		return errors.New("unknown cipher: " + name)
 	}
-	label := []byte("")
+	currentCipher = name
+	return nil
+}
 
-	// crypto/rand.Reader is a good source of entropy for randomizing the
-	// encryption function.
-	rng := rand.Reader
+// SetHasher() selects the hash strategy (by name).
+// NOTE: userhashes saved in the ledger are computed by the hasher,
+// so it shouldn't be changed for existing data
+func SetHasher(name string) error {
+	hasher, ok := hashers[name]
+	if !ok {
+		return errors.New("unknown hasher: " + name)
+	}
+	currentHasher = hasher
+	return nil
+}
 
-	ciphertext, err := rsa.EncryptOAEP(sha256.New(), rng, &privKey.PublicKey, data, label)
+// CheckKey() makes sure that the key is able to decrypt the ciphertext
+// (e.g. a ciphertext saved by the previous launch of the service)
+func CheckKey(ciphertext []byte) error {
+	_, err := Decrypt(ciphertext)
 	if err != nil {
-		return nil, errors.New("Encryption error")
-	} else {
-		return ciphertext, nil
+		return errors.New("rsa key from the keystore doesn't match saved data")
 	}
+	return nil
 }
 
-// Decrypt() decrypts ciphertext
-func Decrypt(ciphertext []byte) ([]byte, error) {
-
+// Encrypt() encrypts data by the current cipher and the key from the keystore
+func Encrypt(data []byte) ([]byte, error) {
 	if privKey == nil {
 		return nil, errors.New("No rsa keys, init crypdata package")
 	}
+	return privKey.Encrypt(data)
+}
 
-	label := []byte("")
-	// crypto/rand.Reader is a good source of entropy for randomizing the
-	// encryption function.
-	rng := rand.Reader
-	//
-	plainText, err := rsa.DecryptOAEP(sha256.New(), rng, privKey, ciphertext, label)
+// Decrypt() decrypts ciphertext by the key from the keystore
+func Decrypt(ciphertext []byte) ([]byte, error) {
+	if privKey == nil {
+		return nil, errors.New("No rsa keys, init crypdata package")
+	}
+	return privKey.Decrypt(ciphertext)
+}
 
+// Encrypt() encrypts data by the current cipher and returns ciphertext
+// (the first byte of ciphertext is the cipher id)
+func (k *Key) Encrypt(data []byte) ([]byte, error) {
+	entry, _ := cipherByName(currentCipher)
+	ciphertext, err := entry.factory(k.rsa).Encrypt(data)
 	if err != nil {
-		return nil, errors.New("Decryption error")
-	} else {
-		return plainText, nil
+		return nil, err
+	}
+	return append([]byte{entry.id}, ciphertext...), nil
+}
+
+// Decrypt() decrypts ciphertext by the cipher which encrypted it.
+// Ciphertexts of the first version (data encrypted by rsa directly,
+// without cipher id) are supported too: ciphertexts of the key always
+// differ from them in length.
+// NOTE: data encrypted to user keys isn't the key's ciphertext, the caller
+// chooses the key by the record (see userinfo.DecryptPrivdata())
+func (k *Key) Decrypt(ciphertext []byte) ([]byte, error) {
+	if len(ciphertext) == k.rsa.Size() {
+		return rsaDecrypt(k.rsa, ciphertext)
+	}
+	if len(ciphertext) == 0 {
+		return nil, errors.New("Decryption error: empty ciphertext")
+	}
+
+	entry, ok := ciphers[ciphertext[0]]
+	if !ok {
+		return nil, errors.New("Decryption error: unknown cipher id")
 	}
+	return entry.factory(k.rsa).Decrypt(ciphertext[1:])
 }
 
-// Hash() calculates sha256 hash of data
+// Hash() calculates hash of data (sha256 by default)
 func Hash(data string) string {
-	hashedBytes := sha256.Sum256([]byte(data))
-	return hex.EncodeToString(hashedBytes[:])
+	return currentHasher.Hash(data)
 }
@@ -0,0 +1,124 @@
+package crypdata
+
+import (
+	"bytes"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// newTestKey() makes the key in the temporary keystore
+func newTestKey(t *testing.T) *Key {
+	key, err := LoadKey(filepath.Join(t.TempDir(), "crypdata.pem"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return key
+}
+
+// withCipher() runs f with the cipher selected for new data
+func withCipher(t *testing.T, name string, f func()) {
+	previous := currentCipher
+	if err := SetCipher(name); err != nil {
+		t.Fatal(err)
+	}
+	defer func() { currentCipher = previous }()
+	f()
+}
+
+func TestCiphers(t *testing.T) {
+	key := newTestKey(t)
+	otherKey := newTestKey(t)
+
+	for _, name := range Ciphers() {
+		withCipher(t, name, func() {
+			// rsa-oaep is limited by the size of the key, the envelope ciphers aren't
+			data := []byte("passport: 1234 567890")
+			if name != RSA_OAEP {
+				data = bytes.Repeat(data, 1000)
+			}
+
+			ciphertext, err := key.Encrypt(data)
+			if err != nil {
+				t.Fatalf("%s: %v", name, err)
+			}
+			entry, _ := cipherByName(name)
+			if ciphertext[0] != entry.id {
+				t.Fatalf("%s: ciphertext starts with %d, want the cipher id %d", name, ciphertext[0], entry.id)
+			}
+
+			plaintext, err := key.Decrypt(ciphertext)
+			if err != nil {
+				t.Fatalf("%s: %v", name, err)
+			}
+			if !bytes.Equal(plaintext, data) {
+				t.Fatalf("%s: decrypted data differs", name)
+			}
+
+			if _, err := otherKey.Decrypt(ciphertext); err == nil {
+				t.Fatalf("%s: ciphertext is decrypted by other key", name)
+			}
+			tampered := append([]byte{}, ciphertext...)
+			tampered[len(tampered)-1] ^= 1
+			if _, err := key.Decrypt(tampered); err == nil {
+				t.Fatalf("%s: tampered ciphertext is decrypted", name)
+			}
+		})
+	}
+}
+
+func TestDecryptFirstVersion(t *testing.T) {
+	key := newTestKey(t)
+
+	// the first version encrypted data by rsa directly (without cipher id)
+	ciphertext, err := rsaEncrypt(&key.rsa.PublicKey, []byte("[1234 567890]"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	plaintext, err := key.Decrypt(ciphertext)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(plaintext) != "[1234 567890]" {
+		t.Fatalf("Decrypt() = %q", plaintext)
+	}
+
+	for _, ciphertext := range [][]byte{nil, {99, 1, 2, 3}, {1, 0}} {
+		if _, err := key.Decrypt(ciphertext); err == nil {
+			t.Errorf("Decrypt(%v) doesn't fail", ciphertext)
+		}
+	}
+}
+
+func TestKeystore(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "keystore", "crypdata.pem")
+	key, err := LoadKey(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ciphertext, err := key.Encrypt([]byte("data"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the next launch loads the same key
+	loaded, err := LoadKey(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if plaintext, err := loaded.Decrypt(ciphertext); err != nil || string(plaintext) != "data" {
+		t.Fatalf("the key from the keystore can't decrypt saved data: %v", err)
+	}
+}
+
+func TestSetCipher(t *testing.T) {
+	if err := SetCipher("des"); err == nil || !strings.Contains(err.Error(), "unknown cipher") {
+		t.Fatalf("SetCipher(\"des\"): %v", err)
+	}
+	if err := SetHasher("md5"); err == nil {
+		t.Fatal("SetHasher(\"md5\") doesn't fail")
+	}
+	if Hash("data") != Hash("data") || len(Hash("data")) != 64 {
+		t.Fatalf("Hash() = %s, want sha256 hex string", Hash("data"))
+	}
+}
@@ -0,0 +1,74 @@
+package crypdata
+
+import (
+	"crypto/rand"
+	"errors"
+	"io"
+)
+
+/*
+Data keys of users: private data of all records of the user is encrypted
+by the data key of the user (AES-256-GCM), the data key is kept wrapped
+by the key of the service apart from records (see store.KeyStore).
+The data key is destroyed when the user is erased, so records and versions
+of the user left in backups of the offchain db can't be decrypted anymore
+(crypto-shredding).
+
+Ciphertext format (cipher "user-data-key"):
+    [1 byte]   cipher id (5)
+    [12 bytes] gcm nonce
+    [...]      gcm ciphertext + tag (the cipher id byte is additional data)
+*/
+
+const USER_DATA_KEY = "user-data-key"
+
+// cipher id of data key ciphertexts (it's reserved in the ciphers registry)
+const USER_DATA_KEY_ID byte = 5
+
+// ErrDataKeyRequired is returned when data encrypted by the data key
+// of the user is decrypted without it
+var ErrDataKeyRequired = errors.New("data is encrypted by the data key of the user")
+
+// NewDataKey() makes the random data key of the user
+func NewDataKey() ([]byte, error) {
+	dataKey := make([]byte, DATA_KEY_SIZE)
+	if _, err := io.ReadFull(rand.Reader, dataKey); err != nil {
+		return nil, errors.New("can't generate data key")
+	}
+	return dataKey, nil
+}
+
+// EncryptByDataKey() encrypts data by the data key of the user
+func EncryptByDataKey(dataKey []byte, data []byte) ([]byte, error) {
+	gcm, err := newGCM(dataKey)
+	if err != nil {
+		return nil, err
+	}
+	nonce := make([]byte, gcm.NonceSize())
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return nil, errors.New("can't generate nonce")
+	}
+
+	header := []byte{USER_DATA_KEY_ID}
+	out := append(header, nonce...)
+	return gcm.Seal(out, nonce, data, header), nil
+}
+
+// DecryptByDataKey() decrypts ciphertext made by EncryptByDataKey()
+func DecryptByDataKey(dataKey []byte, ciphertext []byte) ([]byte, error) {
+	gcm, err := newGCM(dataKey)
+	if err != nil {
+		return nil, err
+	}
+	if len(ciphertext) < 1+gcm.NonceSize() || ciphertext[0] != USER_DATA_KEY_ID {
+		return nil, errors.New("Decryption error: bad data key ciphertext")
+	}
+	header := ciphertext[:1]
+	nonce, sealed := ciphertext[1:1+gcm.NonceSize()], ciphertext[1+gcm.NonceSize():]
+
+	plaintext, err := gcm.Open(nil, nonce, sealed, header)
+	if err != nil {
+		return nil, errors.New("Decryption error")
+	}
+	return plaintext, nil
+}
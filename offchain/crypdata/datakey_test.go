@@ -0,0 +1,55 @@
+package crypdata
+
+import (
+	"testing"
+)
+
+func TestDataKey(t *testing.T) {
+	dataKey, err := NewDataKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	otherDataKey, err := NewDataKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ciphertext, err := EncryptByDataKey(dataKey, []byte("passport: 1234 567890"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ciphertext[0] != USER_DATA_KEY_ID {
+		t.Fatalf("ciphertext starts with %d, want %d", ciphertext[0], USER_DATA_KEY_ID)
+	}
+	plaintext, err := DecryptByDataKey(dataKey, ciphertext)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(plaintext) != "passport: 1234 567890" {
+		t.Fatalf("DecryptByDataKey() = %q", plaintext)
+	}
+
+	// without the data key (it's destroyed on erasure) data can't be decrypted
+	if _, err := DecryptByDataKey(otherDataKey, ciphertext); err == nil {
+		t.Fatal("ciphertext is decrypted by other data key")
+	}
+	if _, err := newTestKey(t).Decrypt(ciphertext); err == nil {
+		t.Fatal("ciphertext is decrypted by the key of the service")
+	}
+	if _, err := DecryptByDataKey(dataKey, ciphertext[:5]); err == nil {
+		t.Fatal("short ciphertext is decrypted")
+	}
+}
+
+func TestReservedCipherIds(t *testing.T) {
+	for _, id := range []byte{USER_ECIES_ID, USER_DATA_KEY_ID} {
+		func() {
+			defer func() {
+				if recover() == nil {
+					t.Errorf("RegisterCipher() accepts the reserved id %d", id)
+				}
+			}()
+			RegisterCipher(id, "reserved", newRSACipher)
+		}()
+	}
+}
@@ -0,0 +1,117 @@
+package crypdata
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/binary"
+	"errors"
+	"io"
+
+	"golang.org/x/crypto/chacha20poly1305"
+)
+
+/*
+Envelope encryption: private data is encrypted by a random data key
+which is generated for every record (AES-256-GCM or ChaCha20-Poly1305),
+the data key is encrypted (wrapped) by the rsa key.
+So the size of private data is not limited by rsa.
+
+Ciphertext format (after the cipher id byte):
+    [2 bytes]  length of the wrapped data key (big endian)
+    [N bytes]  wrapped data key (rsa-oaep)
+    [M bytes]  nonce
+    [...]      aead ciphertext + tag (the cipher id byte is additional data)
+*/
+
+const DATA_KEY_SIZE = 32
+
+// envelopeCipher encrypts data by a data key and wraps the key by rsa key
+type envelopeCipher struct {
+	key *rsa.PrivateKey
+
+	// additional data of aead (the cipher id)
+	header []byte
+
+	newAEAD func(dataKey []byte) (cipher.AEAD, error)
+}
+
+func newAESGCMCipher(key *rsa.PrivateKey) Cipher {
+	return &envelopeCipher{key: key, header: []byte{1}, newAEAD: newGCM}
+}
+
+func newChaChaCipher(key *rsa.PrivateKey) Cipher {
+	return &envelopeCipher{key: key, header: []byte{3}, newAEAD: chacha20poly1305.New}
+}
+
+// Encrypt() encrypts data by a new data key and wraps the key
+func (c *envelopeCipher) Encrypt(data []byte) ([]byte, error) {
+	dataKey := make([]byte, DATA_KEY_SIZE)
+	if _, err := io.ReadFull(rand.Reader, dataKey); err != nil {
+		return nil, errors.New("can't generate data key")
+	}
+
+	wrappedKey, err := rsaEncrypt(&c.key.PublicKey, dataKey)
+	if err != nil {
+		return nil, err
+	}
+
+	aead, err := c.newAEAD(dataKey)
+	if err != nil {
+		return nil, err
+	}
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return nil, errors.New("can't generate nonce")
+	}
+
+	out := make([]byte, 0, 2+len(wrappedKey)+len(nonce)+len(data)+aead.Overhead())
+	out = binary.BigEndian.AppendUint16(out, uint16(len(wrappedKey)))
+	out = append(out, wrappedKey...)
+	out = append(out, nonce...)
+	out = aead.Seal(out, nonce, data, c.header)
+	return out, nil
+}
+
+// Decrypt() unwraps the data key and decrypts data
+func (c *envelopeCipher) Decrypt(ciphertext []byte) ([]byte, error) {
+	if len(ciphertext) < 2 {
+		return nil, errors.New("Decryption error: ciphertext is too short")
+	}
+
+	keyLen := int(binary.BigEndian.Uint16(ciphertext[:2]))
+	rest := ciphertext[2:]
+	if len(rest) < keyLen {
+		return nil, errors.New("Decryption error: ciphertext is too short")
+	}
+	wrappedKey, rest := rest[:keyLen], rest[keyLen:]
+
+	dataKey, err := rsaDecrypt(c.key, wrappedKey)
+	if err != nil {
+		return nil, err
+	}
+
+	aead, err := c.newAEAD(dataKey)
+	if err != nil {
+		return nil, err
+	}
+	if len(rest) < aead.NonceSize() {
+		return nil, errors.New("Decryption error: ciphertext is too short")
+	}
+	nonce, sealed := rest[:aead.NonceSize()], rest[aead.NonceSize():]
+
+	plaintext, err := aead.Open(nil, nonce, sealed, c.header)
+	if err != nil {
+		return nil, errors.New("Decryption error")
+	}
+	return plaintext, nil
+}
+
+func newGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
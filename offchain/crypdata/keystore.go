@@ -0,0 +1,105 @@
+package crypdata
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+)
+
+const DEFAULT_KEYSTORE = "keystore/crypdata.pem"
+
+const RSA_KEY_BITS = 2048
+
+// Key is the rsa key which protects private data
+type Key struct {
+	rsa *rsa.PrivateKey
+}
+
+// LoadKey() reads the rsa key from the keystore (PEM file),
+// the key is generated and saved on the first run
+func LoadKey(keystorePath string) (*Key, error) {
+	rsaKey, err := loadKey(keystorePath)
+	if err != nil {
+		return nil, err
+	}
+	return &Key{rsa: rsaKey}, nil
+}
+
+func loadKey(keystorePath string) (*rsa.PrivateKey, error) {
+	pemBytes, err := ioutil.ReadFile(keystorePath)
+	if os.IsNotExist(err) {
+		return createKey(keystorePath)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("can't read keystore %s: %v", keystorePath, err)
+	}
+
+	info, err := os.Stat(keystorePath)
+	if err == nil && info.Mode().Perm()&0077 != 0 {
+		log.Printf("WARNING: keystore %s is accessible by other users (%v)", keystorePath, info.Mode().Perm())
+	}
+
+	return parseKey(pemBytes)
+}
+
+// createKey() generates a new rsa key and saves it to the keystore.
+// Only the owner of the service process can read the keystore
+func createKey(keystorePath string) (*rsa.PrivateKey, error) {
+	key, err := rsa.GenerateKey(rand.Reader, RSA_KEY_BITS)
+	if err != nil {
+		return nil, errors.New("can't generate rsa keys")
+	}
+
+	err = os.MkdirAll(filepath.Dir(keystorePath), 0700)
+	if err != nil {
+		return nil, fmt.Errorf("can't create keystore directory: %v", err)
+	}
+
+	// O_EXCL: never overwrite the existing key
+	f, err := os.OpenFile(keystorePath, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return nil, fmt.Errorf("can't create keystore %s: %v", keystorePath, err)
+	}
+	defer f.Close()
+
+	block := &pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(key)}
+	err = pem.Encode(f, block)
+	if err != nil {
+		os.Remove(keystorePath)
+		return nil, fmt.Errorf("can't write keystore %s: %v", keystorePath, err)
+	}
+
+	log.Printf("New rsa key is saved to keystore %s", keystorePath)
+	return key, nil
+}
+
+// parseKey() decodes PKCS#1 or PKCS#8 rsa private key
+func parseKey(pemBytes []byte) (*rsa.PrivateKey, error) {
+	block, _ := pem.Decode(pemBytes)
+	if block == nil {
+		return nil, errors.New("keystore doesn't contain PEM data")
+	}
+
+	switch block.Type {
+	case "RSA PRIVATE KEY":
+		return x509.ParsePKCS1PrivateKey(block.Bytes)
+	case "PRIVATE KEY":
+		key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+		if err != nil {
+			return nil, err
+		}
+		rsaKey, ok := key.(*rsa.PrivateKey)
+		if !ok {
+			return nil, errors.New("keystore key is not rsa key")
+		}
+		return rsaKey, nil
+	}
+	return nil, errors.New("unknown keystore PEM block: " + block.Type)
+}
@@ -0,0 +1,158 @@
+package crypdata
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+
+	"golang.org/x/crypto/argon2"
+)
+
+/*
+Passwords are hashed by argon2id with a random salt.
+The hash is saved with its parameters (PHC string format):
+    $argon2id$v=19$m=65536,t=3,p=4$<salt>$<hash>
+
+Passwords of the first version are hashed by sha256 (hex string, see Hash()),
+they are still accepted, but VerifyPassword() reports that they need rehash.
+*/
+
+// PasswordParams are tunable parameters of argon2id
+type PasswordParams struct {
+	Memory  uint32 // KiB
+	Time    uint32 // number of passes
+	Threads uint8
+	SaltLen uint32
+	KeyLen  uint32
+}
+
+// DefaultPasswordParams are recommended by RFC 9106 (second choice)
+var DefaultPasswordParams = PasswordParams{
+	Memory:  64 * 1024,
+	Time:    3,
+	Threads: 4,
+	SaltLen: 16,
+	KeyLen:  32,
+}
+
+// limits of argon2id parameters, saved hashes out of them are refused
+// (an empty key matches any password, a huge m exhausts memory)
+const (
+	MIN_PASSWORD_SALT_LEN = 8
+	MAX_PASSWORD_SALT_LEN = 64
+	MIN_PASSWORD_KEY_LEN  = 16
+	MAX_PASSWORD_KEY_LEN  = 64
+	MAX_PASSWORD_MEMORY   = 1024 * 1024 // KiB (1 GiB)
+	MAX_PASSWORD_TIME     = 16
+	MAX_PASSWORD_THREADS  = 16
+)
+
+var passwordParams = DefaultPasswordParams
+
+// SetPasswordParams() changes parameters of new password hashes.
+// Existing hashes with other parameters need rehash (see VerifyPassword())
+func SetPasswordParams(params PasswordParams) error {
+	if err := checkPasswordParams(params); err != nil {
+		return err
+	}
+	passwordParams = params
+	return nil
+}
+
+// checkPasswordParams() checks that parameters are within the limits
+func checkPasswordParams(p PasswordParams) error {
+	if p.Memory < 8*uint32(p.Threads) || p.Time < 1 || p.Threads < 1 ||
+		p.SaltLen < MIN_PASSWORD_SALT_LEN || p.KeyLen < MIN_PASSWORD_KEY_LEN {
+		return errors.New("weak password hash parameters")
+	}
+	if p.Memory > MAX_PASSWORD_MEMORY || p.Time > MAX_PASSWORD_TIME || p.Threads > MAX_PASSWORD_THREADS ||
+		p.SaltLen > MAX_PASSWORD_SALT_LEN || p.KeyLen > MAX_PASSWORD_KEY_LEN {
+		return errors.New("password hash parameters are too large")
+	}
+	return nil
+}
+
+// HashPassword() returns salted argon2id hash of the password (with parameters)
+func HashPassword(password string) (string, error) {
+	p := passwordParams
+
+	salt := make([]byte, p.SaltLen)
+	if _, err := io.ReadFull(rand.Reader, salt); err != nil {
+		return "", errors.New("can't generate salt")
+	}
+	key := argon2.IDKey([]byte(password), salt, p.Time, p.Memory, p.Threads, p.KeyLen)
+
+	return fmt.Sprintf("$argon2id$v=%d$m=%d,t=%d,p=%d$%s$%s",
+		argon2.Version, p.Memory, p.Time, p.Threads,
+		base64.RawStdEncoding.EncodeToString(salt),
+		base64.RawStdEncoding.EncodeToString(key)), nil
+}
+
+// VerifyPassword() checks the password against the saved hash (constant time).
+// needsRehash is true if the password is correct, but the hash is made by
+// sha256 (the first version) or by other argon2id parameters
+func VerifyPassword(password string, hashedPassword string) (ok bool, needsRehash bool) {
+	if !strings.HasPrefix(hashedPassword, "$argon2id$") {
+		ok = subtle.ConstantTimeCompare([]byte(Hash(password)), []byte(hashedPassword)) == 1
+		return ok, ok
+	}
+
+	p, salt, key, err := decodePasswordHash(hashedPassword)
+	if err != nil {
+		return false, false
+	}
+	otherKey := argon2.IDKey([]byte(password), salt, p.Time, p.Memory, p.Threads, p.KeyLen)
+	ok = subtle.ConstantTimeCompare(key, otherKey) == 1
+
+	current := passwordParams
+	needsRehash = ok && (p.Memory != current.Memory || p.Time != current.Time ||
+		p.Threads != current.Threads || p.KeyLen != current.KeyLen || p.SaltLen != current.SaltLen)
+	return ok, needsRehash
+}
+
+// decodePasswordHash() parses $argon2id$v=19$m=...,t=...,p=...$salt$hash,
+// parameters have to be within the limits (see checkPasswordParams())
+func decodePasswordHash(hashedPassword string) (PasswordParams, []byte, []byte, error) {
+	p, salt, key, err := decodeArgon2(hashedPassword)
+	if err == nil {
+		err = checkPasswordParams(p)
+	}
+	if err != nil {
+		return p, nil, nil, err
+	}
+	return p, salt, key, nil
+}
+
+// decodeArgon2() parses the PHC string of argon2id, KeyLen is the length of the last part
+func decodeArgon2(hashedPassword string) (PasswordParams, []byte, []byte, error) {
+	var p PasswordParams
+
+	parts := strings.Split(hashedPassword, "$")
+	if len(parts) != 6 {
+		return p, nil, nil, errors.New("bad password hash format")
+	}
+
+	var version int
+	if _, err := fmt.Sscanf(parts[2], "v=%d", &version); err != nil || version != argon2.Version {
+		return p, nil, nil, errors.New("unsupported argon2 version")
+	}
+	if _, err := fmt.Sscanf(parts[3], "m=%d,t=%d,p=%d", &p.Memory, &p.Time, &p.Threads); err != nil {
+		return p, nil, nil, errors.New("bad argon2 parameters")
+	}
+
+	salt, err := base64.RawStdEncoding.DecodeString(parts[4])
+	if err != nil {
+		return p, nil, nil, errors.New("bad password salt")
+	}
+	key, err := base64.RawStdEncoding.DecodeString(parts[5])
+	if err != nil {
+		return p, nil, nil, errors.New("bad password hash")
+	}
+	p.SaltLen = uint32(len(salt))
+	p.KeyLen = uint32(len(key))
+	return p, salt, key, nil
+}
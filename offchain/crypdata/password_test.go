@@ -0,0 +1,111 @@
+package crypdata
+
+import (
+	"strings"
+	"testing"
+)
+
+// testPasswordParams are weak parameters to keep tests fast
+var testPasswordParams = PasswordParams{Memory: 64, Time: 1, Threads: 1, SaltLen: 16, KeyLen: 32}
+
+// withPasswordParams() runs f with the parameters of new password hashes
+func withPasswordParams(t *testing.T, params PasswordParams, f func()) {
+	previous := passwordParams
+	if err := SetPasswordParams(params); err != nil {
+		t.Fatal(err)
+	}
+	defer func() { passwordParams = previous }()
+	f()
+}
+
+func TestHashPassword(t *testing.T) {
+	withPasswordParams(t, testPasswordParams, func() {
+		hashed, err := HashPassword("secret")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !strings.HasPrefix(hashed, "$argon2id$v=19$m=64,t=1,p=1$") {
+			t.Fatalf("HashPassword() = %s", hashed)
+		}
+		// the salt is random
+		if other, _ := HashPassword("secret"); other == hashed {
+			t.Fatal("hashes of the same password are equal")
+		}
+
+		if ok, needsRehash := VerifyPassword("secret", hashed); !ok || needsRehash {
+			t.Fatalf("VerifyPassword() = %v, %v, want true, false", ok, needsRehash)
+		}
+		if ok, _ := VerifyPassword("wrong", hashed); ok {
+			t.Fatal("wrong password is accepted")
+		}
+		if ok, _ := VerifyPassword("secret", "$argon2id$v=19$bad"); ok {
+			t.Fatal("password is accepted by the bad hash")
+		}
+	})
+}
+
+func TestPasswordRehash(t *testing.T) {
+	// passwords of the first version are hashed by sha256
+	if ok, needsRehash := VerifyPassword("secret", Hash("secret")); !ok || !needsRehash {
+		t.Fatalf("VerifyPassword() of sha256 hash = %v, %v, want true, true", ok, needsRehash)
+	}
+	if ok, needsRehash := VerifyPassword("wrong", Hash("secret")); ok || needsRehash {
+		t.Fatalf("VerifyPassword() of wrong password = %v, %v, want false, false", ok, needsRehash)
+	}
+
+	var hashed string
+	withPasswordParams(t, testPasswordParams, func() {
+		hashed, _ = HashPassword("secret")
+	})
+	stronger := testPasswordParams
+	stronger.Time = 2
+	withPasswordParams(t, stronger, func() {
+		if ok, needsRehash := VerifyPassword("secret", hashed); !ok || !needsRehash {
+			t.Fatalf("VerifyPassword() of old parameters = %v, %v, want true, true", ok, needsRehash)
+		}
+	})
+}
+
+func TestForgedPasswordHash(t *testing.T) {
+	salt := "c2FsdHNhbHRzYWx0c2FsdA"                     // 16 bytes
+	key := "a2V5a2V5a2V5a2V5a2V5a2V5a2V5a2V5a2V5a2V5a2U" // 32 bytes
+	for _, hashed := range []string{
+		// an empty key matches any password
+		"$argon2id$v=19$m=64,t=1,p=1$$",
+		"$argon2id$v=19$m=64,t=1,p=1$" + salt + "$",
+		"$argon2id$v=19$m=64,t=1,p=1$$" + key,
+		"$argon2id$v=19$m=64,t=1,p=1$c2FsdA$" + key,
+		// huge parameters exhaust memory and time of the service
+		"$argon2id$v=19$m=4294967295,t=1,p=1$" + salt + "$" + key,
+		"$argon2id$v=19$m=64,t=100000,p=1$" + salt + "$" + key,
+		"$argon2id$v=19$m=4096,t=1,p=255$" + salt + "$" + key,
+		"$argon2id$v=19$m=64,t=0,p=1$" + salt + "$" + key,
+	} {
+		if _, _, _, err := decodePasswordHash(hashed); err == nil {
+			t.Errorf("decodePasswordHash(%q) accepts the hash", hashed)
+		}
+		if ok, _ := VerifyPassword("anything", hashed); ok {
+			t.Errorf("VerifyPassword() accepts the password by %q", hashed)
+		}
+	}
+}
+
+func TestSetPasswordParams(t *testing.T) {
+	weak := testPasswordParams
+	weak.SaltLen = 4
+	if err := SetPasswordParams(weak); err == nil {
+		t.Fatal("SetPasswordParams() accepts the short salt")
+	}
+	if passwordParams == weak {
+		t.Fatal("weak parameters are set")
+	}
+
+	huge := testPasswordParams
+	huge.Memory = MAX_PASSWORD_MEMORY + 1
+	if err := SetPasswordParams(huge); err == nil {
+		t.Fatal("SetPasswordParams() accepts the memory over the limit")
+	}
+	if err := SetPasswordParams(DefaultPasswordParams); err != nil {
+		t.Fatalf("SetPasswordParams() refuses the default parameters: %v", err)
+	}
+}
@@ -0,0 +1,58 @@
+package crypdata
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"errors"
+)
+
+// rsaCipher encrypts data by rsa key directly
+// NOTE: data size is limited by key size (~190 bytes for 2048-bit key)
+type rsaCipher struct {
+	key *rsa.PrivateKey
+}
+
+func newRSACipher(key *rsa.PrivateKey) Cipher {
+	return rsaCipher{key: key}
+}
+
+func (c rsaCipher) Encrypt(data []byte) ([]byte, error) {
+	return rsaEncrypt(&c.key.PublicKey, data)
+}
+
+func (c rsaCipher) Decrypt(ciphertext []byte) ([]byte, error) {
+	return rsaDecrypt(c.key, ciphertext)
+}
+
+// rsaEncrypt() encrypts data by rsa public key (rsa-oaep, sha256)
+func rsaEncrypt(key *rsa.PublicKey, data []byte) ([]byte, error) {
+	label := []byte("")
+
+	// crypto/rand.Reader is a good source of entropy for randomizing the
+	// encryption function.
+	rng := rand.Reader
+
+	ciphertext, err := rsa.EncryptOAEP(sha256.New(), rng, key, data, label)
+	if err != nil {
+		return nil, errors.New("Encryption error")
+	} else {
+		return ciphertext, nil
+	}
+}
+
+// rsaDecrypt() decrypts ciphertext by rsa private key
+func rsaDecrypt(key *rsa.PrivateKey, ciphertext []byte) ([]byte, error) {
+	label := []byte("")
+	// crypto/rand.Reader is a good source of entropy for randomizing the
+	// encryption function.
+	rng := rand.Reader
+	//
+	plainText, err := rsa.DecryptOAEP(sha256.New(), rng, key, ciphertext, label)
+
+	if err != nil {
+		return nil, errors.New("Decryption error")
+	} else {
+		return plainText, nil
+	}
+}
@@ -0,0 +1,277 @@
+package crypdata
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/ecdh"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/hkdf"
+)
+
+/*
+Per-user keys: private data of the user is encrypted to the public key
+of the user key (random ecdsa P-256 key made for the record, see NewUserKey()),
+so the rsa key of the service can't decrypt it.
+
+Ciphertext format (cipher "user-ecies"):
+    [1 byte]   cipher id (4)
+    [65 bytes] ephemeral public key (uncompressed P-256 point)
+    [12 bytes] gcm nonce
+    [...]      gcm ciphertext + tag
+The aes key is HKDF-SHA256 of ECDH(ephemeral key, user key).
+
+The user key is kept by the service only sealed by a key derived from
+the user's password (argon2id), see SealUserKey(), there is no other copy
+of it. So the private data can be decrypted only after the user's password
+is given (on login).
+
+Records of the previous version were encrypted to the Fabric enrollment
+of the user, and its key is kept unsealed by the wallet of the ledger
+backend (see IsEnrollmentKey()), such records are re-encrypted on login.
+*/
+
+const USER_ECIES = "user-ecies"
+
+// cipher id of per-user ciphertexts (it's reserved in the ciphers registry)
+const USER_ECIES_ID byte = 4
+
+// ErrUserKeyRequired is returned when the service key is used to decrypt
+// data encrypted to the user key
+var ErrUserKeyRequired = errors.New("data is encrypted by the user key, the user password is required")
+
+var eciesInfo = []byte("fabusers user-ecies")
+
+// IsUserCiphertext() reports whether ciphertext is encrypted to a user key
+func IsUserCiphertext(ciphertext []byte) bool {
+	return len(ciphertext) > 0 && ciphertext[0] == USER_ECIES_ID
+}
+
+// NewUserKey() makes the random user key (PKCS#8 PEM)
+func NewUserKey() ([]byte, error) {
+	privateKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, errors.New("can't generate user key")
+	}
+	der, err := x509.MarshalPKCS8PrivateKey(privateKey)
+	if err != nil {
+		return nil, err
+	}
+	return pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der}), nil
+}
+
+// EncryptForUser() encrypts data to the public key of the user key
+// (made by NewUserKey() or unsealed by UnsealUserKey())
+func EncryptForUser(keyPEM []byte, data []byte) ([]byte, error) {
+	privateKey, err := parseUserKey(keyPEM)
+	if err != nil {
+		return nil, err
+	}
+	publicKey := privateKey.PublicKey()
+
+	ephemeral, err := ecdh.P256().GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, errors.New("can't generate ephemeral key")
+	}
+	shared, err := ephemeral.ECDH(publicKey)
+	if err != nil {
+		return nil, err
+	}
+	ephemeralBytes := ephemeral.PublicKey().Bytes()
+
+	gcm, err := eciesGCM(shared, ephemeralBytes)
+	if err != nil {
+		return nil, err
+	}
+	nonce := make([]byte, gcm.NonceSize())
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return nil, errors.New("can't generate nonce")
+	}
+
+	header := []byte{USER_ECIES_ID}
+	out := append(header, ephemeralBytes...)
+	out = append(out, nonce...)
+	return gcm.Seal(out, nonce, data, header), nil
+}
+
+// DecryptForUser() decrypts ciphertext made by EncryptForUser()
+// by the user key (unsealed by UnsealUserKey())
+func DecryptForUser(keyPEM []byte, ciphertext []byte) ([]byte, error) {
+	privateKey, err := parseUserKey(keyPEM)
+	if err != nil {
+		return nil, err
+	}
+
+	pointLen := len(privateKey.PublicKey().Bytes())
+	if !IsUserCiphertext(ciphertext) || len(ciphertext) < 1+pointLen {
+		return nil, errors.New("Decryption error: bad user ciphertext")
+	}
+	header := ciphertext[:1]
+	ephemeralBytes := ciphertext[1 : 1+pointLen]
+	rest := ciphertext[1+pointLen:]
+
+	ephemeral, err := ecdh.P256().NewPublicKey(ephemeralBytes)
+	if err != nil {
+		return nil, errors.New("Decryption error: bad ephemeral key")
+	}
+	shared, err := privateKey.ECDH(ephemeral)
+	if err != nil {
+		return nil, err
+	}
+
+	gcm, err := eciesGCM(shared, ephemeralBytes)
+	if err != nil {
+		return nil, err
+	}
+	if len(rest) < gcm.NonceSize() {
+		return nil, errors.New("Decryption error: ciphertext is too short")
+	}
+	nonce, sealed := rest[:gcm.NonceSize()], rest[gcm.NonceSize():]
+
+	plaintext, err := gcm.Open(nil, nonce, sealed, header)
+	if err != nil {
+		return nil, errors.New("Decryption error")
+	}
+	return plaintext, nil
+}
+
+// SealUserKey() encrypts the user key (PEM) by the key
+// derived from the password. The result has the format of password hashes:
+//
+//	$argon2id$v=19$m=...,t=...,p=...$<salt>$<nonce + gcm ciphertext>
+func SealUserKey(keyPEM []byte, password string) (string, error) {
+	p := passwordParams
+
+	salt := make([]byte, p.SaltLen)
+	if _, err := io.ReadFull(rand.Reader, salt); err != nil {
+		return "", errors.New("can't generate salt")
+	}
+	kek := argon2.IDKey([]byte(password), salt, p.Time, p.Memory, p.Threads, DATA_KEY_SIZE)
+
+	gcm, err := newGCM(kek)
+	if err != nil {
+		return "", err
+	}
+	nonce := make([]byte, gcm.NonceSize())
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return "", errors.New("can't generate nonce")
+	}
+	sealed := gcm.Seal(nonce, nonce, keyPEM, salt)
+
+	return fmt.Sprintf("$argon2id$v=%d$m=%d,t=%d,p=%d$%s$%s",
+		argon2.Version, p.Memory, p.Time, p.Threads,
+		base64.RawStdEncoding.EncodeToString(salt),
+		base64.RawStdEncoding.EncodeToString(sealed)), nil
+}
+
+// UnsealUserKey() decrypts the user key sealed by SealUserKey()
+func UnsealUserKey(sealedKey string, password string) ([]byte, error) {
+	// the last part is the sealed key, the password gives the key of DATA_KEY_SIZE
+	p, salt, sealed, err := decodeArgon2(sealedKey)
+	if err == nil {
+		p.KeyLen = DATA_KEY_SIZE
+		err = checkPasswordParams(p)
+	}
+	if err != nil {
+		return nil, err
+	}
+	kek := argon2.IDKey([]byte(password), salt, p.Time, p.Memory, p.Threads, DATA_KEY_SIZE)
+
+	gcm, err := newGCM(kek)
+	if err != nil {
+		return nil, err
+	}
+	if len(sealed) < gcm.NonceSize() {
+		return nil, errors.New("bad sealed user key")
+	}
+	nonce, ciphertext := sealed[:gcm.NonceSize()], sealed[gcm.NonceSize():]
+
+	keyPEM, err := gcm.Open(nil, nonce, ciphertext, salt)
+	if err != nil {
+		return nil, errors.New("wrong password for the user key")
+	}
+	return keyPEM, nil
+}
+
+func eciesGCM(shared []byte, ephemeralBytes []byte) (cipher.AEAD, error) {
+	key := make([]byte, DATA_KEY_SIZE)
+	kdf := hkdf.New(sha256.New, shared, ephemeralBytes, eciesInfo)
+	if _, err := io.ReadFull(kdf, key); err != nil {
+		return nil, err
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// IsEnrollmentKey() reports whether the user key is the private key
+// of the enrollment certificate (the user key of the previous version)
+func IsEnrollmentKey(certPEM []byte, keyPEM []byte) bool {
+	publicKey, err := enrollmentPublicKey(certPEM)
+	if err != nil {
+		return false
+	}
+	privateKey, err := parseUserKey(keyPEM)
+	if err != nil {
+		return false
+	}
+	return privateKey.PublicKey().Equal(publicKey)
+}
+
+// enrollmentPublicKey() extracts P-256 public key from the enrollment certificate
+func enrollmentPublicKey(certPEM []byte) (*ecdh.PublicKey, error) {
+	block, _ := pem.Decode(certPEM)
+	if block == nil || block.Type != "CERTIFICATE" {
+		return nil, errors.New("enrollment certificate is not PEM certificate")
+	}
+	cert, err := x509.ParseCertificate(block.Bytes)
+	if err != nil {
+		return nil, err
+	}
+	publicKey, ok := cert.PublicKey.(*ecdsa.PublicKey)
+	if !ok {
+		return nil, errors.New("enrollment key is not ecdsa key")
+	}
+	return publicKey.ECDH()
+}
+
+// parseUserKey() parses the user key (PKCS#8 or SEC 1 of the enrollment key)
+func parseUserKey(keyPEM []byte) (*ecdh.PrivateKey, error) {
+	block, _ := pem.Decode(keyPEM)
+	if block == nil {
+		return nil, errors.New("user key is not PEM data")
+	}
+
+	var privateKey *ecdsa.PrivateKey
+	switch block.Type {
+	case "EC PRIVATE KEY":
+		key, err := x509.ParseECPrivateKey(block.Bytes)
+		if err != nil {
+			return nil, err
+		}
+		privateKey = key
+	default:
+		key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+		if err != nil {
+			return nil, err
+		}
+		ecKey, ok := key.(*ecdsa.PrivateKey)
+		if !ok {
+			return nil, errors.New("user key is not ecdsa key")
+		}
+		privateKey = ecKey
+	}
+	return privateKey.ECDH()
+}
@@ -0,0 +1,120 @@
+package crypdata
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestUserKey(t *testing.T) {
+	keyPEM, err := NewUserKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	otherKeyPEM, err := NewUserKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ciphertext, err := EncryptForUser(keyPEM, []byte("passport: 1234 567890"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !IsUserCiphertext(ciphertext) {
+		t.Fatal("IsUserCiphertext() = false for the user ciphertext")
+	}
+	plaintext, err := DecryptForUser(keyPEM, ciphertext)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(plaintext) != "passport: 1234 567890" {
+		t.Fatalf("DecryptForUser() = %q", plaintext)
+	}
+
+	if _, err := DecryptForUser(otherKeyPEM, ciphertext); err == nil {
+		t.Fatal("ciphertext is decrypted by other user key")
+	}
+	tampered := append([]byte{}, ciphertext...)
+	tampered[len(tampered)-1] ^= 1
+	if _, err := DecryptForUser(keyPEM, tampered); err == nil {
+		t.Fatal("tampered ciphertext is decrypted")
+	}
+
+	// the key of the service doesn't decrypt data of users
+	if _, err := newTestKey(t).Decrypt(ciphertext); err == nil {
+		t.Fatal("the user ciphertext is decrypted by the key of the service")
+	}
+}
+
+func TestSealUserKey(t *testing.T) {
+	keyPEM, err := NewUserKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	withPasswordParams(t, testPasswordParams, func() {
+		sealed, err := SealUserKey(keyPEM, "secret")
+		if err != nil {
+			t.Fatal(err)
+		}
+		unsealed, err := UnsealUserKey(sealed, "secret")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(unsealed) != string(keyPEM) {
+			t.Fatal("unsealed user key differs")
+		}
+
+		if _, err := UnsealUserKey(sealed, "wrong"); err == nil {
+			t.Fatal("user key is unsealed by wrong password")
+		}
+		if _, err := UnsealUserKey("$argon2id$v=19$bad", "secret"); err == nil {
+			t.Fatal("bad sealed key is unsealed")
+		}
+		huge := strings.Replace(sealed, "m=64,", "m=4294967295,", 1)
+		if _, err := UnsealUserKey(huge, "secret"); err == nil {
+			t.Fatal("sealed key with the huge memory parameter is unsealed")
+		}
+	})
+}
+
+func TestIsEnrollmentKey(t *testing.T) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "ondar07"},
+		NotBefore:    time.Now(),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	certDER, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	certPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: certDER})
+	keyPEM := pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: keyDER})
+
+	if !IsEnrollmentKey(certPEM, keyPEM) {
+		t.Fatal("IsEnrollmentKey() = false for the key of the certificate")
+	}
+	userKeyPEM, err := NewUserKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if IsEnrollmentKey(certPEM, userKeyPEM) {
+		t.Fatal("IsEnrollmentKey() = true for the random user key")
+	}
+}
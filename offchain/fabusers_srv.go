@@ -10,6 +10,12 @@
            go get gopkg.in/mgo.v2/bson
     3) goji
           go get goji.io
+    4) fabric go sdk (gosdk ledger backend)
+          go get github.com/hyperledger/fabric-sdk-go
+    5) golang.org/x/crypto (chacha20-poly1305 cipher, argon2id)
+          go get golang.org/x/crypto
+    6) yaml (settings file)
+          go get gopkg.in/yaml.v2
 */
 
 package main
@@ -17,295 +23,1629 @@ package main
 import (
 	"encoding/hex"
 	"encoding/json"
+	"expvar"
+	"flag"
 	"fmt"
+	"io"
 	"log"
 	"net/http"
+	"net/url"
+	"os"
+	"strconv"
 
 	"goji.io"
 	"goji.io/pat"
-	"gopkg.in/mgo.v2"
-	"gopkg.in/mgo.v2/bson"
 
 	"./admin"
+	"./auth"
+	"./config"
 	"./crypdata"
 	"./onchain"
+	"./rbac"
+	"./reconcile"
+	"./rotation"
+	"./saga"
+	"./store"
+	"./userinfo"
 )
 
-const (
-	DB_URL                = "localhost"
-	DB_NAME               = "fabusers"
-	USERS_COLLECTION_NAME = "users"
-)
+// settings of the service (see config package)
+var cfg = config.Default()
+
+// integrityFailures counts tampered records found on reads (see /debug/vars)
+var integrityFailures = expvar.NewInt("integrity_failures")
+
+// historyResponse is the history of the ledger record of the user
+type historyResponse struct {
+	Username string
+	Changes  int // number of transactions that changed the record
+	History  []onchain.HistoryRecord
+}
+
+// ledgerUsersResponse is a page of records of the ledger
+type ledgerUsersResponse struct {
+	Users   []onchain.UserRecord
+	Fetched int
+
+	// Bookmark and Next (the URL of the next page) are empty for the last page
+	Bookmark string `json:",omitempty"`
+	Next     string `json:",omitempty"`
+}
+
+// userResponse is a record with the result of its integrity check
+type userResponse struct {
+	*userinfo.CipheredUserInfo
+
+	// Privdata is the decrypted JSON document or the ciphertext (hex string)
+	Privdata interface{}
+
+	Integrity string
+
+	// AsOf is the change of the ledger record the version belongs to (?at)
+	AsOf *onchain.HistoryRecord `json:",omitempty"`
+}
+
+// diffResponse lists fields that differ between two versions of the record
+type diffResponse struct {
+	Username string
+	From     *onchain.HistoryRecord
+	To       *onchain.HistoryRecord
+	Changes  []userinfo.FieldChange
+}
+
+func ErrorWithJSON(w http.ResponseWriter, message string, code int) {
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.WriteHeader(code)
+	fmt.Fprintf(w, "{message: %q}", message)
+}
+
+func ResponseWithJSON(w http.ResponseWriter, json []byte, code int) {
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.WriteHeader(code)
+	w.Write(json)
+}
+
+// the service loop function
+func main() {
+	configPath := flag.String("config", config.DEFAULT_PATH,
+		"settings file (YAML or JSON), FABUSERS_* environment variables override it")
+	rotateKey := flag.String("rotate-key", "",
+		"re-encrypt all records by the key from this keystore (created if absent) and exit")
+	rotationProgress := flag.String("rotation-progress", "keystore/rotation.json",
+		"progress file of the key rotation (to resume the interrupted rotation)")
+	dryRun := flag.Bool("dry-run", false, "only report what the key rotation would do")
+	reconcileOnly := flag.Bool("reconcile", false,
+		"compare the ledger and the offchain db, print the report and exit")
+	repair := flag.Bool("repair", false, "repair safe discrepancies found by -reconcile")
+	migrate := flag.Bool("migrate-privdata", false,
+		"convert private data of the previous versions to JSON documents encrypted by data keys and exit")
+	flag.Parse()
+
+	var err error
+	cfg, err = config.Load(*configPath)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	users, err := openStore()
+	if err != nil {
+		panic(err)
+	}
+	if closer, ok := users.(io.Closer); ok {
+		defer closer.Close()
+	}
+	versions := newVersions(users)
+	keys := newKeys(users)
+
+	// init crypdata package
+	err = crypdata.Init(cfg.Crypto.Keystore)
+	if err != nil {
+		panic(err)
+	}
+	err = crypdata.SetCipher(cfg.Crypto.Cipher)
+	if err != nil {
+		panic(err)
+	}
+
+	// connect to the onchain part
+	ledger, err := onchain.New(cfg.Ledger.Backend, cfg.Ledger.Options)
+	if err != nil {
+		panic(err)
+	}
+	if closer, ok := ledger.(io.Closer); ok {
+		defer closer.Close()
+	}
+
+	// key rotation mode: re-encrypt records and exit
+	if *rotateKey != "" {
+		rotateKeys(users, versions, keys, ledger, *rotateKey, rotation.Options{
+			DryRun:       *dryRun,
+			ProgressPath: *rotationProgress,
+		})
+		return
+	}
+	checkKeystore(users, keys)
+
+	// init admin entity
+	err = admin.Init(ledger, newAccounts(users))
+	if err != nil {
+		panic(err)
+	}
+
+	sagas := saga.New(users, versions, keys, ledger, newJournal(users))
+	reconciler := reconcile.New(users, sagas)
+
+	// reconciliation mode: print the report and exit
+	if *reconcileOnly {
+		reconcileOnce(reconciler, *repair)
+		return
+	}
+
+	// migration mode: convert private data and exit
+	if *migrate {
+		migratePrivdata(users, sagas)
+		return
+	}
+
+	// the first run: create the first admin account
+	bootstrapAdmin()
+
+	// tokens of authenticated users and admins
+	authority, err := auth.New()
+	if err != nil {
+		panic(err)
+	}
+	authority.AccessTTL = cfg.Auth.AccessTTL
+	authority.RefreshTTL = cfg.Auth.RefreshTTL
+
+	// finish operations interrupted by the crash and watch for failed ones
+	err = sagas.Recover()
+	if err != nil {
+		panic(err)
+	}
+	go sagas.RecoverLoop(saga.DEFAULT_RECOVERY_INTERVAL)
+
+	if cfg.Reconcile.Interval > 0 {
+		go reconciler.Loop(cfg.Reconcile.Interval, cfg.Reconcile.Repair)
+	}
+
+	mux := newMux(users, versions, keys, ledger, sagas, reconciler, authority)
+	log.Fatal(http.ListenAndServe(cfg.HTTP.Addr, mux))
+}
+
+// newMux() makes routes of the service API
+func newMux(users store.UserStore, versions store.VersionStore, keys store.KeyStore, ledger onchain.Ledger,
+	sagas *saga.Coordinator, reconciler *reconcile.Reconciler, authority *auth.Authority) *goji.Mux {
+	// every route requires an operation of the policy (see rbac package),
+	// routes without an operation are public
+	guard := rbac.New()
+
+	mux := goji.NewMux()
+	mux.Use(authority.Middleware)
+	mux.Use(guard.Middleware)
+	mux.HandleFunc(pat.Post("/login"), Login(users, ledger, sagas, authority))
+	mux.HandleFunc(pat.Post("/admin/login"), AdminLogin(authority))
+	mux.HandleFunc(pat.Post("/token/refresh"), RefreshToken(authority))
+	mux.HandleFunc(pat.Post("/logout"), Logout(authority))
+	mux.HandleFunc(guard.Protect(pat.Get("/users"), rbac.OP_LIST), allUsers(users)) // ONLY for DEBUG!
+	mux.HandleFunc(pat.Post("/users"), AddUser(sagas))
+	mux.HandleFunc(guard.Protect(pat.Get("/users/:username"), rbac.OP_READ_PUBLIC), UserByUsername(users, versions, keys, ledger, authority))
+	mux.HandleFunc(guard.Protect(pat.Get("/userhashes/:userhash"), rbac.OP_READ_PUBLIC), userByUserhash(users, keys, authority)) // ONLY for DEBUG!
+	mux.Handle(guard.Protect(pat.Get("/debug/vars"), rbac.OP_AUDIT), expvar.Handler())
+	mux.HandleFunc(guard.Protect(pat.Put("/users/:username"), rbac.OP_UPDATE), UpdateUser(users, ledger, sagas))
+	mux.HandleFunc(guard.Protect(pat.Get("/users/:username/history"), rbac.OP_AUDIT), UserHistory(ledger))
+	mux.HandleFunc(guard.Protect(pat.Get("/users/:username/diff"), rbac.OP_DIFF), VersionsDiff(users, versions, keys, ledger, authority))
+	mux.HandleFunc(guard.Protect(pat.Delete("/users/:username"), rbac.OP_DELETE), DeleteUser(ledger, sagas, authority))
+	mux.HandleFunc(guard.Protect(pat.Put("/users/:username/profile"), rbac.OP_SELF_SERVICE), UpdateProfile(users, ledger, sagas))
+	mux.HandleFunc(guard.Protect(pat.Put("/users/:username/password"), rbac.OP_SELF_SERVICE), ChangePassword(users, ledger, sagas, authority))
+	mux.HandleFunc(guard.Protect(pat.Get("/admin/ledger/users"), rbac.OP_LIST), LedgerUsers(ledger))
+	mux.HandleFunc(guard.Protect(pat.Get("/admin/ledger/users/count"), rbac.OP_LIST), LedgerUsersCount(ledger))
+	mux.HandleFunc(guard.Protect(pat.Get("/admin/reconciliation"), rbac.OP_AUDIT), lastReconciliation(reconciler))
+	mux.HandleFunc(guard.Protect(pat.Post("/admin/reconciliation"), rbac.OP_AUDIT), Reconcile(reconciler))
+	mux.HandleFunc(pat.Post("/admin/bootstrap"), BootstrapAdmin())
+	mux.HandleFunc(guard.Protect(pat.Get("/admin/accounts"), rbac.OP_MANAGE), adminAccounts())
+	mux.HandleFunc(guard.Protect(pat.Post("/admin/accounts"), rbac.OP_MANAGE), CreateAccount())
+	mux.HandleFunc(guard.Protect(pat.Post("/admin/accounts/:name/disable"), rbac.OP_MANAGE), DisableAccount(authority, true))
+	mux.HandleFunc(guard.Protect(pat.Post("/admin/accounts/:name/enable"), rbac.OP_MANAGE), DisableAccount(authority, false))
+	mux.HandleFunc(pat.Put("/admin/accounts/:name/password"), RotatePassword(authority))
+
+	return mux
+}
+
+// openStore() connects to the offchain db selected by store.backend
+func openStore() (store.UserStore, error) {
+	if cfg.Store.Backend == store.MEMORY_BACKEND {
+		return store.NewMemoryStore(), nil
+	}
+	return store.DialMongo(cfg.Mongo.URL, cfg.Mongo.Database, cfg.Mongo.UsersCollection)
+}
+
+// newVersions() returns the storage of versions of records in the same db as records
+func newVersions(users store.UserStore) store.VersionStore {
+	if mongoStore, ok := users.(*store.MongoStore); ok {
+		versions, err := store.NewMongoVersions(mongoStore.Session(), cfg.Mongo.Database, cfg.Mongo.VersionsCollection)
+		if err != nil {
+			panic(err)
+		}
+		return versions
+	}
+	return store.NewMemoryStore()
+}
+
+// newKeys() returns the storage of data keys of users in the same db as records
+func newKeys(users store.UserStore) store.KeyStore {
+	if mongoStore, ok := users.(*store.MongoStore); ok {
+		return store.NewMongoKeys(mongoStore.Session(), cfg.Mongo.Database, cfg.Mongo.KeysCollection)
+	}
+	return store.NewMemoryKeys()
+}
+
+// newAccounts() returns the storage of admin accounts in the same db as records
+func newAccounts(users store.UserStore) admin.AccountStore {
+	if mongoStore, ok := users.(*store.MongoStore); ok {
+		return admin.NewMongoAccounts(mongoStore.Session(), cfg.Mongo.Database, cfg.Mongo.AdminsCollection)
+	}
+	return admin.NewMemoryAccounts()
+}
+
+// bootstrapAdmin() creates the first admin account if there are no accounts:
+// from admin.password of the settings or, if it isn't set, by the one-time
+// token (see BootstrapAdmin())
+func bootstrapAdmin() {
+	needed, err := admin.NeedsBootstrap()
+	if err != nil {
+		panic(err)
+	}
+	if !needed {
+		return
+	}
+
+	if cfg.Admin.Password != "" {
+		_, err = admin.Bootstrap("", admin.ADMIN_NAME, cfg.Admin.Password, true)
+		if err != nil {
+			panic(err)
+		}
+		log.Printf("The admin account %q is created from the settings", admin.ADMIN_NAME)
+		return
+	}
+
+	token, err := admin.BootstrapToken()
+	if err != nil {
+		panic(err)
+	}
+	log.Println("There are no admin accounts, create the first one by POST /admin/bootstrap with the token: ", token)
+}
+
+// newJournal() returns the journal of operations in the same db as records
+func newJournal(users store.UserStore) saga.Journal {
+	if mongoStore, ok := users.(*store.MongoStore); ok {
+		return saga.NewMongoJournal(mongoStore.Session(), cfg.Mongo.Database, cfg.Mongo.OperationsCollection)
+	}
+	return saga.NewMemoryJournal()
+}
+
+// checkKeystore() makes sure that the key from the keystore
+// is able to decrypt data keys and private data saved in the offchain db
+func checkKeystore(users store.UserStore, keys store.KeyStore) {
+	dataKeys, err := keys.List()
+	if err != nil {
+		panic(err)
+	}
+	if len(dataKeys) > 0 {
+		wrapped, err := hex.DecodeString(dataKeys[0].Wrapped)
+		if err == nil {
+			err = crypdata.CheckKey(wrapped)
+		}
+		if err != nil {
+			panic(fmt.Sprintf("%v (data key of %s)", err, dataKeys[0].Username))
+		}
+		return
+	}
+
+	records, err := users.List()
+	if err != nil {
+		panic(err)
+	}
+
+	for _, user := range records {
+		// only records of the previous version are encrypted by the service key
+		if user.Userkey != "" || user.Keyformat != userinfo.KEYFORMAT_SERVICE {
+			continue
+		}
+
+		ciphertext, err := hex.DecodeString(user.Privdata)
+		if err == nil {
+			err = crypdata.CheckKey(ciphertext)
+		}
+		if err != nil {
+			panic(fmt.Sprintf("%v (userhash %s)", err, user.Userhash))
+		}
+		return
+	}
+	// there is no saved data yet
+}
+
+// rotateKeys() re-encrypts private data of all records by the new key
+// and prints the report.
+// After that the service has to be launched with the new keystore
+func rotateKeys(users store.UserStore, versions store.VersionStore, keys store.KeyStore, ledger onchain.Ledger, newKeystore string, options rotation.Options) {
+	var newKey *crypdata.Key
+	_, err := os.Stat(newKeystore)
+	if !options.DryRun || err == nil {
+		newKey, err = crypdata.LoadKey(newKeystore)
+		if err != nil {
+			panic(err)
+		}
+	}
+
+	report, err := rotation.Rotate(users, versions, keys, ledger, crypdata.CurrentKey(), newKey, options)
+	if report != nil {
+		reportJSON, _ := json.MarshalIndent(report, "", "  ")
+		fmt.Println(string(reportJSON))
+	}
+	if err != nil {
+		log.Fatal("Key rotation error: ", err)
+	}
+	if len(report.Failed) > 0 {
+		log.Fatal("Key rotation is not completed, launch it again")
+	}
+	if !options.DryRun {
+		log.Println("Key rotation is completed, set crypto.keystore to ", newKeystore)
+	}
+}
+
+// reconcileOnce() compares the ledger and the offchain db and prints the report
+func reconcileOnce(reconciler *reconcile.Reconciler, repair bool) {
+	report, err := reconciler.Run(repair)
+	if err != nil {
+		log.Fatal("Reconciliation error: ", err)
+	}
+	reportJSON, _ := json.MarshalIndent(report, "", "  ")
+	fmt.Println(string(reportJSON))
+}
+
+// allUsers() receives all records (users info) in the offchain database
+// NOTE: this function is ONLY for DEBUGGING purposes
+func allUsers(users store.UserStore) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		records, err := users.List()
+		if err != nil {
+			ErrorWithJSON(w, "Database error", http.StatusInternalServerError)
+			log.Println("Failed get all users: ", err)
+			return
+		}
+
+		respBody, err := json.MarshalIndent(records, "", "  ")
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		ResponseWithJSON(w, respBody, http.StatusOK)
+	}
+}
+
+// checkIntegrity() compares fields of the record with the ledger userhash of username.
+// The tampered record is refused (false is returned) if integrity.refuse is set,
+// the record of other user is always refused
+func checkIntegrity(w http.ResponseWriter, user *userinfo.CipheredUserInfo, username, ledgerUserhash string) (string, bool) {
+	integrity := userinfo.CheckIntegrity(user, username, ledgerUserhash)
+	if integrity == userinfo.INTEGRITY_VERIFIED {
+		return integrity, true
+	}
+
+	integrityFailures.Add(1)
+	log.Println("Integrity check failed: record of ", user.Username,
+		" doesn't match userhash ", ledgerUserhash, " of ", username)
+	if cfg.Integrity.Refuse || user.Username != username {
+		ErrorWithJSON(w, "Record doesn't match the ledger", http.StatusConflict)
+		return integrity, false
+	}
+	return integrity, true
+}
+
+// ledgerError() responds with the status of the ledger error: errors of
+// the chaincode caused by the request (see onchain.CODE_*) are sent as is,
+// other errors are logged and message is sent
+func ledgerError(w http.ResponseWriter, err error, message string) {
+	status := onchain.HTTPStatus(err)
+	switch {
+	case err == onchain.ErrUserNotFound:
+		message = "User is not found"
+	case err == onchain.ErrUserDeleted:
+		message = "User is deleted"
+	case status != http.StatusInternalServerError:
+		message = err.Error()
+	default:
+		log.Println(message, ": ", err)
+	}
+	ErrorWithJSON(w, message, status)
+}
+
+// createCipheredUserinfo() builds the offchain db record, private data
+// is encrypted to userKey (the unsealed key of the previous record), to
+// the new user key if crypto.user_keys is set or by the data key of the user
+func createCipheredUserinfo(keys store.KeyStore, user *userinfo.UserInfo, cipheredUserInfo *userinfo.CipheredUserInfo, userKey []byte) error {
+	var dataKey []byte
+	var err error
+	switch {
+	case userKey != nil:
+	case cfg.Crypto.UserKeys:
+		userKey, err = crypdata.NewUserKey()
+	default:
+		dataKey, err = userDataKey(keys, user.Username, true)
+	}
+	if err != nil {
+		return err
+	}
+	return userinfo.CreateCipheredUserinfo(user, cipheredUserInfo, userKey, dataKey)
+}
+
+// userDataKey() unwraps the data key of the user by the key of the service.
+// If the user has no data key, the new one is saved if create is set
+// (the key left by the aborted creation is reused)
+func userDataKey(keys store.KeyStore, username string, create bool) ([]byte, error) {
+	key, err := keys.Find(username)
+	if err == store.ErrNotFound && create {
+		var dataKey, wrapped []byte
+		dataKey, err = crypdata.NewDataKey()
+		if err == nil {
+			wrapped, err = crypdata.Encrypt(dataKey)
+		}
+		if err != nil {
+			return nil, err
+		}
+		err = keys.Insert(&store.DataKey{Username: username, Wrapped: hex.EncodeToString(wrapped)})
+		if err == nil {
+			return dataKey, nil
+		}
+		if err == store.ErrDuplicate {
+			key, err = keys.Find(username)
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	wrapped, err := hex.DecodeString(key.Wrapped)
+	if err != nil {
+		return nil, err
+	}
+	return crypdata.Decrypt(wrapped)
+}
+
+// rehashPassword() replaces the outdated password hash (e.g. sha256 hash
+// of the first version) of the user by the new one.
+// Userhash is changed, so the ledger and the offchain db are updated
+func rehashPassword(sagas *saga.Coordinator, user *userinfo.CipheredUserInfo, password string) error {
+	hashedPassword, err := crypdata.HashPassword(password)
+	if err != nil {
+		return err
+	}
+
+	rehashed := *user
+	rehashed.Hashedpassword = hashedPassword
+	userinfo.SetUserhash(&rehashed)
+
+	_, err = sagas.Update(user, &rehashed)
+	if err != nil {
+		return err
+	}
+
+	*user = rehashed
+	return nil
+}
+
+// migrateUserPrivdata() converts private data of the previous versions
+// to the JSON document encrypted by the data key of the user (records
+// encrypted to the user key are kept encrypted to it, they can be migrated
+// only when the user key is unsealed on login of the user)
+func migrateUserPrivdata(sagas *saga.Coordinator, user *userinfo.CipheredUserInfo, userKey []byte) error {
+	plaintext, err := userinfo.DecryptPrivdata(user, userKey)
+	if err != nil {
+		return err
+	}
+
+	var encrypt func(data []byte) ([]byte, error)
+	keyformat := user.Keyformat
+	if user.Userkey != "" {
+		encrypt = func(data []byte) ([]byte, error) {
+			return crypdata.EncryptForUser(userKey, data)
+		}
+	} else {
+		dataKey, err := userDataKey(sagas.Keys(), user.Username, true)
+		if err != nil {
+			return err
+		}
+		encrypt = func(data []byte) ([]byte, error) {
+			return crypdata.EncryptByDataKey(dataKey, data)
+		}
+		keyformat = userinfo.KEYFORMAT_DATA_KEY
+	}
+	migrated, err := userinfo.MigratePrivdata(user, plaintext, encrypt, keyformat)
+	if err != nil {
+		return err
+	}
+
+	_, err = sagas.Update(user, migrated)
+	if err != nil {
+		return err
+	}
+
+	*user = *migrated
+	return nil
+}
+
+// rekeyUserPrivdata() re-encrypts private data of the previous version
+// (encrypted to the enrollment key of the user) to the new user key sealed
+// by the password. The user key of the record is returned
+func rekeyUserPrivdata(sagas *saga.Coordinator, user *userinfo.CipheredUserInfo, userKey []byte, password string) ([]byte, error) {
+	enrollment, err := sagas.Ledger().Enrollment(&user.Username)
+	if err != nil || !crypdata.IsEnrollmentKey(enrollment.Certificate, userKey) {
+		// the user key isn't kept by the wallet
+		return userKey, nil
+	}
+
+	plaintext, err := userinfo.DecryptPrivdata(user, userKey)
+	if err != nil {
+		return nil, err
+	}
+	newKey, err := crypdata.NewUserKey()
+	if err != nil {
+		return nil, err
+	}
+	ciphertext, err := crypdata.EncryptForUser(newKey, plaintext)
+	if err != nil {
+		return nil, err
+	}
+
+	rekeyed := *user
+	rekeyed.Privdata = hex.EncodeToString(ciphertext)
+	rekeyed.Userkey, err = crypdata.SealUserKey(newKey, password)
+	if err != nil {
+		return nil, err
+	}
+	userinfo.SetUserhash(&rekeyed)
+
+	_, err = sagas.Update(user, &rekeyed)
+	if err != nil {
+		return nil, err
+	}
+
+	*user = rekeyed
+	return newKey, nil
+}
+
+// migratePrivdata() converts private data of the previous versions to JSON
+// documents encrypted by data keys and prints the report. Records encrypted
+// to user keys are skipped, they are migrated on login of the user (see Login())
+func migratePrivdata(users store.UserStore, sagas *saga.Coordinator) {
+	records, err := users.List()
+	if err != nil {
+		panic(err)
+	}
+
+	migrated, skipped, failed := 0, 0, 0
+	for i := range records {
+		user := &records[i]
+		if !userinfo.NeedsMigration(user) {
+			continue
+		}
+
+		// a tampered record can't be written to the ledger
+		userhash, err := sagas.Ledger().GetUserhash(&user.Username)
+		if err == nil && userinfo.CheckIntegrity(user, user.Username, userhash) != userinfo.INTEGRITY_VERIFIED {
+			err = fmt.Errorf("record doesn't match the ledger")
+		}
+		if err == nil {
+			err = migrateUserPrivdata(sagas, user, nil)
+		}
+		if err == crypdata.ErrUserKeyRequired {
+			skipped++
+			continue
+		}
+		if err != nil {
+			failed++
+			log.Println("Failed migrate private data of ", user.Username, ": ", err)
+			continue
+		}
+		migrated++
+	}
+
+	fmt.Printf("Private data: %d records migrated, %d skipped (encrypted to user keys, migrated on login), %d failed\n",
+		migrated, skipped, failed)
+}
+
+// decryptPrivdata() decrypts private data of the record to the JSON document.
+// The user key (if the data are encrypted to it) is taken from the session
+// of the user, admin can't decrypt such data (nil is returned)
+func decryptPrivdata(keys store.KeyStore, authority *auth.Authority, principal *auth.Principal, user *userinfo.CipheredUserInfo) (json.RawMessage, error) {
+	var key []byte
+	var err error
+	switch {
+	case user.Userkey != "":
+		if principal.IsUser(user.Username) {
+			key, err = authority.Open(principal)
+		}
+	case user.Keyformat == userinfo.KEYFORMAT_DATA_KEY:
+		key, err = userDataKey(keys, user.Username, false)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	plaintext, err := userinfo.DecryptPrivdata(user, key)
+	if err == crypdata.ErrUserKeyRequired {
+		log.Println("Private data of ", user.Username, " is encrypted by the user key")
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return userinfo.DecodePrivdata(user, plaintext)
+}
+
+// credentials is a body of login requests
+type credentials struct {
+	Username string `json:"username"`
+	Password string `json:"password"`
+}
+
+// tokenResponse() sends tokens issued by login or refresh
+func tokenResponse(w http.ResponseWriter, tokens *auth.Tokens) {
+	respBody, err := json.MarshalIndent(tokens, "", "  ")
+	if err != nil {
+		log.Fatal(err)
+	}
+	w.Header().Set("Cache-Control", "no-store")
+	ResponseWithJSON(w, respBody, http.StatusOK)
+}
+
+// Login() verifies the password of the user and issues tokens.
+// The user key (if private data are encrypted to it) is unsealed
+// by the password and kept in the session
+func Login(users store.UserStore, ledger onchain.Ledger, sagas *saga.Coordinator, authority *auth.Authority) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		// 1. Decode credentials
+		var creds credentials
+		err := json.NewDecoder(r.Body).Decode(&creds)
+		if err != nil || creds.Username == "" {
+			ErrorWithJSON(w, "Incorrect body", http.StatusBadRequest)
+			return
+		}
+
+		// 2. Find the record of the user (the ledger userhash -> the offchain db)
+		userhash, err := ledger.GetUserhash(&creds.Username)
+		var user *userinfo.CipheredUserInfo
+		if err == nil {
+			user, err = users.FindByUserhash(userhash)
+		}
+		if err == onchain.ErrUserNotFound || err == onchain.ErrUserDeleted || err == store.ErrNotFound {
+			ErrorWithJSON(w, "Wrong username or password", http.StatusUnauthorized)
+			return
+		}
+		if err != nil {
+			ErrorWithJSON(w, "Database error", http.StatusInternalServerError)
+			log.Println("Failed find user: ", err)
+			return
+		}
+
+		// 3. The password hash of the tampered record can't be trusted
+		integrity, ok := checkIntegrity(w, user, creds.Username, userhash)
+		if !ok {
+			return
+		}
+		if integrity != userinfo.INTEGRITY_VERIFIED {
+			ErrorWithJSON(w, "Record doesn't match the ledger", http.StatusConflict)
+			return
+		}
+
+		// 4. Verify the password
+		isUser, needsRehash := crypdata.VerifyPassword(creds.Password, user.Hashedpassword)
+		if !isUser {
+			ErrorWithJSON(w, "Wrong username or password", http.StatusUnauthorized)
+			log.Println("Wrong password of ", creds.Username)
+			return
+		}
+		if needsRehash {
+			// outdated password hash is replaced on successful login
+			err = rehashPassword(sagas, user, creds.Password)
+			if err != nil {
+				log.Println("Failed rehash password: ", err)
+			}
+		}
+
+		// 5. Unseal the user key and start the session
+		var userKey []byte
+		if user.Userkey != "" {
+			userKey, err = crypdata.UnsealUserKey(user.Userkey, creds.Password)
+			if err != nil {
+				ErrorWithJSON(w, "Decrypt error", http.StatusInternalServerError)
+				log.Println("Failed unseal user key: ", err)
+				return
+			}
+		}
+		if userinfo.NeedsMigration(user) {
+			// private data of the previous versions is converted
+			err = migrateUserPrivdata(sagas, user, userKey)
+			if err != nil {
+				log.Println("Failed migrate private data: ", err)
+			}
+		}
+		if userKey != nil {
+			// the enrollment key has an unsealed copy in the wallet
+			userKey, err = rekeyUserPrivdata(sagas, user, userKey, creds.Password)
+			if err != nil {
+				ErrorWithJSON(w, "Decrypt error", http.StatusInternalServerError)
+				log.Println("Failed re-encrypt private data: ", err)
+				return
+			}
+		}
+		tokens, err := authority.Login(auth.PRINCIPAL_USER, user.Username, userKey)
+		if err != nil {
+			ErrorWithJSON(w, "Login error", http.StatusInternalServerError)
+			log.Println("Failed login: ", err)
+			return
+		}
+
+		tokenResponse(w, tokens)
+	}
+}
+
+// AdminLogin() verifies the password of the admin account and issues tokens
+func AdminLogin(authority *auth.Authority) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var creds credentials
+		err := json.NewDecoder(r.Body).Decode(&creds)
+		if err != nil {
+			ErrorWithJSON(w, "Incorrect body", http.StatusBadRequest)
+			return
+		}
+
+		account, err := admin.Authenticate(creds.Username, creds.Password)
+		if err == admin.ErrWrongCredentials {
+			ErrorWithJSON(w, "Wrong admin name or password", http.StatusUnauthorized)
+			log.Println("Admin password is wrong")
+			return
+		}
+		if err == admin.ErrDisabled {
+			ErrorWithJSON(w, "Admin account is disabled", http.StatusUnauthorized)
+			return
+		}
+		if err != nil {
+			ErrorWithJSON(w, "Database error", http.StatusInternalServerError)
+			log.Println("Failed find admin: ", err)
+			return
+		}
+
+		tokens, err := authority.Login(auth.PRINCIPAL_ADMIN, account.Name, nil)
+		if err != nil {
+			ErrorWithJSON(w, "Login error", http.StatusInternalServerError)
+			log.Println("Failed login: ", err)
+			return
+		}
+
+		tokenResponse(w, tokens)
+	}
+}
+
+// RefreshToken() exchanges the refresh token for new tokens
+func RefreshToken(authority *auth.Authority) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var body struct {
+			RefreshToken string `json:"refresh_token"`
+		}
+		err := json.NewDecoder(r.Body).Decode(&body)
+		if err != nil || body.RefreshToken == "" {
+			ErrorWithJSON(w, "Incorrect body", http.StatusBadRequest)
+			return
+		}
+
+		tokens, err := authority.Refresh(body.RefreshToken)
+		if err != nil {
+			ErrorWithJSON(w, err.Error(), http.StatusUnauthorized)
+			return
+		}
+
+		tokenResponse(w, tokens)
+	}
+}
+
+// Logout() revokes the session of the caller (all its tokens).
+// The session can be given by the refresh token in the body
+// (e.g. when the access token has expired)
+func Logout(authority *auth.Authority) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var body struct {
+			RefreshToken string `json:"refresh_token"`
+		}
+		err := json.NewDecoder(r.Body).Decode(&body)
+		if err != nil && err != io.EOF {
+			ErrorWithJSON(w, "Incorrect body", http.StatusBadRequest)
+			return
+		}
+		if body.RefreshToken != "" {
+			err = authority.Logout(body.RefreshToken)
+			if err != nil {
+				ErrorWithJSON(w, err.Error(), http.StatusUnauthorized)
+				return
+			}
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+
+		principal := auth.FromRequest(r)
+		if principal == nil {
+			ErrorWithJSON(w, "Authorization is required", http.StatusUnauthorized)
+			return
+		}
+
+		authority.Revoke(principal)
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+// AddUser() takes new user info (as JSON object in the request),
+// builds ciphered user info and saves this record to the offchain db
+// and its userhash to the ledger (see saga package)
+func AddUser(sagas *saga.Coordinator) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		// 1. Decode input json object
+		var user userinfo.UserInfo
+		decoder := json.NewDecoder(r.Body)
+		err := decoder.Decode(&user)
+		if err != nil {
+			ErrorWithJSON(w, "Incorrect body", http.StatusBadRequest)
+			return
+		}
+		if user.Password == "" {
+			ErrorWithJSON(w, "Password is required", http.StatusBadRequest)
+			return
+		}
+
+		// 2. Register the new user in the onchain part (create ca-cert),
+		//    build ciphered user info, store it in the offchain db
+		//    and add record (username + userhash) into onchain ledger
+		_, err = sagas.Create(user.Username, func(cipheredUserInfo *userinfo.CipheredUserInfo) error {
+			return createCipheredUserinfo(sagas.Keys(), &user, cipheredUserInfo, nil)
+		})
+		if err == saga.ErrUserExists {
+			ErrorWithJSON(w, "User already exists", http.StatusConflict)
+			return
+		}
+		if err == saga.ErrInProgress {
+			ErrorWithJSON(w, "User is being changed, try again later", http.StatusConflict)
+			return
+		}
+		if err != nil {
+			ledgerError(w, err, "Failed add user")
+			return
+		}
+
+		log.Println("Add a new user successfully")
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Location", r.URL.Path+"/"+user.Username)
+		w.WriteHeader(http.StatusCreated)
+	}
+}
+
+// UserByUsername() finds offchain database record with the specified userhash
+// and decrypt its private data (if the role of the caller allows it)
+func UserByUsername(users store.UserStore, versions store.VersionStore, keys store.KeyStore, ledger onchain.Ledger, authority *auth.Authority) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var err error
+
+		// 1. Extract username and the caller (see Login() and rbac package)
+		username := pat.Param(r, "username")
+		principal := auth.FromRequest(r)
+
+		// 1a. ?at (a transaction id, a userhash or a time) asks for
+		//     the version that was current at that point
+		at := r.URL.Query().Get("at")
+		if at != "" {
+			point, err := historyPoint(ledger, username, at)
+			if err != nil {
+				historyError(w, err)
+				return
+			}
+			versionResponse(w, r, users, versions, keys, authority, username, point)
+			return
+		}
+
+		// 2. Get userhash from onchain part (see onchain package)
+		userhash, err := ledger.GetUserhash(&username)
+		if err != nil {
+			ledgerError(w, err, "Failed find user")
+			return
+		}
+
+		// 3. Find the offchain db record with this userhash
+		user, err := users.FindByUserhash(userhash)
+		if err == store.ErrNotFound {
+			ErrorWithJSON(w, "User is not found", http.StatusNotFound)
+			return
+		}
+		if err != nil {
+			ErrorWithJSON(w, "can't find userhash", http.StatusInternalServerError)
+			log.Println("Failed find user: ", err)
+			return
+		}
+
+		// 4. Recompute userhash of the record, it has to match the ledger
+		integrity, ok := checkIntegrity(w, user, username, userhash)
+		if !ok {
+			return
+		}
+
+		// 5. If the caller is this user or admin,
+		//    then service should decrypt private data.
+		//    The user has access to his private data!
+		//    (the password hash of the tampered record can't be trusted)
+		var privdata interface{} = user.Privdata
+		if integrity == userinfo.INTEGRITY_VERIFIED && rbac.Allowed(r, username, rbac.OP_READ_PRIVATE) {
+			document, err := decryptPrivdata(keys, authority, principal, user)
+			if err != nil {
+				ErrorWithJSON(w, "Decrypt error", http.StatusInternalServerError)
+				log.Println("Failed find user: ", err)
+				return
+			}
+			if document != nil {
+				privdata = document
+			}
+		}
+
+		respBody, err := json.MarshalIndent(userResponse{CipheredUserInfo: user, Privdata: privdata, Integrity: integrity}, "", "  ")
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		ResponseWithJSON(w, respBody, http.StatusOK)
+	}
+}
+
+// versionResponse() responds with the version of the record of the ledger
+// change (see UserByUsername())
+func versionResponse(w http.ResponseWriter, r *http.Request, users store.UserStore, versions store.VersionStore, keys store.KeyStore,
+	authority *auth.Authority, username string, point *onchain.HistoryRecord) {
+	// 1. Find the version with the userhash of the change
+	user, err := findVersion(users, versions, point.InfoHash)
+	if err == store.ErrNotFound {
+		ErrorWithJSON(w, "Version is not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		ErrorWithJSON(w, "can't find userhash", http.StatusInternalServerError)
+		log.Println("Failed find version: ", err)
+		return
+	}
+
+	// 2. Recompute userhash of the version, it has to match the ledger
+	integrity, ok := checkIntegrity(w, user, username, point.InfoHash)
+	if !ok {
+		return
+	}
+
+	// 3. Decrypt private data if the role of the caller allows it
+	var privdata interface{} = user.Privdata
+	if integrity == userinfo.INTEGRITY_VERIFIED && rbac.Allowed(r, user.Username, rbac.OP_READ_PRIVATE) {
+		document, err := decryptPrivdata(keys, authority, auth.FromRequest(r), user)
+		if err != nil {
+			ErrorWithJSON(w, "Decrypt error", http.StatusInternalServerError)
+			log.Println("Failed find version: ", err)
+			return
+		}
+		if document != nil {
+			privdata = document
+		}
+	}
+
+	respBody, err := json.MarshalIndent(userResponse{
+		CipheredUserInfo: user,
+		Privdata:         privdata,
+		Integrity:        integrity,
+		AsOf:             point,
+	}, "", "  ")
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	ResponseWithJSON(w, respBody, http.StatusOK)
+}
+
+// VersionsDiff() compares two versions of the record of the user.
+// ?from and ?to are points of the ledger history (a transaction id,
+// a userhash or a time, see onchain.HistoryAt()), the current version by default
+func VersionsDiff(users store.UserStore, versions store.VersionStore, keys store.KeyStore, ledger onchain.Ledger, authority *auth.Authority) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		// 1. Extract username and points
+		username := pat.Param(r, "username")
+		from := r.URL.Query().Get("from")
+		if from == "" {
+			ErrorWithJSON(w, "from is required", http.StatusBadRequest)
+			return
+		}
+
+		// 2. Find changes of the ledger record at both points
+		fromPoint, err := historyPoint(ledger, username, from)
+		if err != nil {
+			historyError(w, err)
+			return
+		}
+		toPoint, err := historyPoint(ledger, username, r.URL.Query().Get("to"))
+		if err != nil {
+			historyError(w, err)
+			return
+		}
+
+		// 3. Find both versions, they have to match their userhashes.
+		//    Private data are compared decrypted (records encrypted to user keys
+		//    or by a rotated key are compared by ciphertexts)
+		var records [2]*userinfo.CipheredUserInfo
+		var documents [2]json.RawMessage
+		for i, point := range []*onchain.HistoryRecord{fromPoint, toPoint} {
+			records[i], err = findVersion(users, versions, point.InfoHash)
+			if err == store.ErrNotFound {
+				ErrorWithJSON(w, "Version is not found", http.StatusNotFound)
+				return
+			}
+			if err != nil {
+				ErrorWithJSON(w, "can't find userhash", http.StatusInternalServerError)
+				log.Println("Failed find version: ", err)
+				return
+			}
+
+			integrity, ok := checkIntegrity(w, records[i], username, point.InfoHash)
+			if !ok {
+				return
+			}
+			if integrity != userinfo.INTEGRITY_VERIFIED {
+				continue
+			}
+			documents[i], err = decryptPrivdata(keys, authority, auth.FromRequest(r), records[i])
+			if err != nil {
+				log.Println("Can't decrypt private data of the version ", point.InfoHash, ": ", err)
+			}
+		}
+
+		respBody, err := json.MarshalIndent(diffResponse{
+			Username: username,
+			From:     fromPoint,
+			To:       toPoint,
+			Changes:  userinfo.Diff(records[0], records[1], documents[0], documents[1]),
+		}, "", "  ")
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		ResponseWithJSON(w, respBody, http.StatusOK)
+	}
+}
+
+// historyPoint() finds the change of the ledger record of the user
+// that was current at the point (see onchain.HistoryAt()),
+// the last change if the point is empty
+func historyPoint(ledger onchain.Ledger, username, at string) (*onchain.HistoryRecord, error) {
+	history, err := ledger.GetUserHistory(&username)
+	if err != nil {
+		return nil, err
+	}
+	if len(history) == 0 {
+		return nil, onchain.ErrUserNotFound
+	}
+
+	// versions of the deleted user are erased
+	last := &history[len(history)-1]
+	if last.Deleted || last.IsDelete {
+		return nil, onchain.ErrUserDeleted
+	}
+	if at == "" {
+		return last, nil
+	}
+	return onchain.HistoryAt(history, at)
+}
+
+// historyError() responds with the status of the historyPoint() error
+func historyError(w http.ResponseWriter, err error) {
+	switch err {
+	case onchain.ErrBadPoint:
+		ErrorWithJSON(w, err.Error(), http.StatusBadRequest)
+	case onchain.ErrUserNotFound:
+		ErrorWithJSON(w, "User is not found", http.StatusNotFound)
+	case onchain.ErrNoVersion:
+		ErrorWithJSON(w, "There is no record at this point", http.StatusNotFound)
+	case onchain.ErrUserDeleted:
+		ErrorWithJSON(w, "User is deleted", http.StatusGone)
+	default:
+		ledgerError(w, err, "Failed get history")
+	}
+}
+
+// findVersion() finds the version of the record with this userhash
+// (records saved before versioning are only among current records)
+func findVersion(users store.UserStore, versions store.VersionStore, userhash string) (*userinfo.CipheredUserInfo, error) {
+	user, err := versions.FindByUserhash(userhash)
+	if err == store.ErrNotFound {
+		return users.FindByUserhash(userhash)
+	}
+	return user, err
+}
+
+// userByUserhash() finds offchain database record with the specified userhash
+// and decrypt its private data
+// NOTE: this function is ONLY for DEBUGGING purposes
+func userByUserhash(users store.UserStore, keys store.KeyStore, authority *auth.Authority) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		// 1. Extract userhash and the caller
+		userhash := pat.Param(r, "userhash")
+		principal := auth.FromRequest(r)
+
+		// 2. Find user with the specified userhash
+		user, err := users.FindByUserhash(userhash)
+		if err == store.ErrNotFound {
+			ErrorWithJSON(w, "User is not found", http.StatusNotFound)
+			return
+		}
+		if err != nil {
+			ErrorWithJSON(w, "Database error", http.StatusInternalServerError)
+			log.Println("Failed find user: ", err)
+			return
+		}
+
+		// 3. Recompute userhash of the record
+		integrity, ok := checkIntegrity(w, user, user.Username, userhash)
+		if !ok {
+			return
+		}
+
+		// 4. If the role of the caller allows it,
+		//    then service should decrypt private data
+		var privdata interface{} = user.Privdata
+		if integrity == userinfo.INTEGRITY_VERIFIED && rbac.Allowed(r, user.Username, rbac.OP_READ_PRIVATE) {
+			document, err := decryptPrivdata(keys, authority, principal, user)
+			if err != nil {
+				ErrorWithJSON(w, "Decrypt error", http.StatusInternalServerError)
+				log.Println("Failed find user: ", err)
+				return
+			}
+			if document != nil {
+				privdata = document
+			}
+		}
+
+		respBody, err := json.MarshalIndent(userResponse{CipheredUserInfo: user, Privdata: privdata, Integrity: integrity}, "", "  ")
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		ResponseWithJSON(w, respBody, http.StatusOK)
+	}
+}
+
+// UpdateUser() finds offchain database record with the specified userhash
+// and decrypt its private data
+func UpdateUser(users store.UserStore, ledger onchain.Ledger, sagas *saga.Coordinator) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var err error
+
+		// 1. Extract username (the role of the caller is checked by rbac)
+		username := pat.Param(r, "username")
+
+		// 2. Find this user's userhash in onchain part (Hyperledger Fabric)
+		userhash, err := ledger.GetUserhash(&username)
+		if err != nil {
+			ledgerError(w, err, "Failed find user")
+			return
+		}
+
+		// 3. Find the offchain db record with this userhash
+		cryptoUser, err := users.FindByUserhash(userhash)
+		if err == store.ErrNotFound {
+			ErrorWithJSON(w, "User is not found", http.StatusNotFound)
+			return
+		}
+		if err != nil {
+			ErrorWithJSON(w, "Database error", http.StatusInternalServerError)
+			log.Println("Failed find user: ", err)
+			return
+		}
+
+		// 4. The record has to match the ledger
+		if _, ok := checkIntegrity(w, cryptoUser, username, userhash); !ok {
+			return
+		}
+
+		// 5. Take new user data (as json object),
+		// the username is taken from the URL
+		var user userinfo.UserInfo
+		decoder := json.NewDecoder(r.Body)
+		err = decoder.Decode(&user)
 
-func ErrorWithJSON(w http.ResponseWriter, message string, code int) {
-	w.Header().Set("Content-Type", "application/json; charset=utf-8")
-	w.WriteHeader(code)
-	fmt.Fprintf(w, "{message: %q}", message)
-}
+		if err != nil {
+			ErrorWithJSON(w, "Incorrect body", http.StatusBadRequest)
+			return
+		}
+		if user.Username != "" && user.Username != username {
+			ErrorWithJSON(w, "Username can't be changed", http.StatusBadRequest)
+			return
+		}
+		user.Username = username
 
-func ResponseWithJSON(w http.ResponseWriter, json []byte, code int) {
-	w.Header().Set("Content-Type", "application/json; charset=utf-8")
-	w.WriteHeader(code)
-	w.Write(json)
+		// the new password is hashed and seals the new user key, so it's required
+		if user.Password == "" {
+			ErrorWithJSON(w, "Password is required", http.StatusBadRequest)
+			return
+		}
+
+		// 6. Create new crypto data (the admin doesn't know the password,
+		// so the new user key is made)
+		var newCryptoUser userinfo.CipheredUserInfo
+		err = createCipheredUserinfo(sagas.Keys(), &user, &newCryptoUser, nil)
+		if err != nil {
+			ErrorWithJSON(w, "Database error", http.StatusInternalServerError)
+			log.Println("Failed create crypto user: ", err)
+			return
+		}
+
+		// 7. Update the ledger and the offchain db
+		_, err = sagas.Update(cryptoUser, &newCryptoUser)
+		if err == saga.ErrInProgress {
+			ErrorWithJSON(w, "User is being changed, try again later", http.StatusConflict)
+			return
+		}
+		if err != nil {
+			ledgerError(w, err, "Update user error")
+			return
+		}
+
+		log.Println("Update user successfully")
+
+		w.WriteHeader(http.StatusNoContent)
+	}
 }
 
-// The service handles incoming requests that consist of JSON objects
-// These JSON objects have to match to this struct
-type UserInfo struct {
-	Username string `json:"username"`
-	Email    string `json:"email"`
-	Password string `json:"password"`
+// DeleteUser() erases the user (right to erasure): the CA identity is revoked,
+// the data key of the user is destroyed (private data encrypted by it can't be
+// decrypted anymore), the offchain record is removed and the ledger gets the tombstone.
+// Sessions of the user are revoked
+func DeleteUser(ledger onchain.Ledger, sagas *saga.Coordinator, authority *auth.Authority) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		// 1. Extract username (the role of the caller is checked by rbac)
+		username := pat.Param(r, "username")
+
+		// 2. Find this user's userhash in onchain part
+		userhash, err := ledger.GetUserhash(&username)
+		if err != nil {
+			ledgerError(w, err, "Failed find user")
+			return
+		}
+
+		// 3. Destroy the keys, the record and write the tombstone
+		op, err := sagas.Delete(username, userhash)
+		if err == saga.ErrInProgress {
+			ErrorWithJSON(w, "User is being changed, try again later", http.StatusConflict)
+			return
+		}
+		if err != nil && op == nil {
+			ErrorWithJSON(w, "Database error", http.StatusInternalServerError)
+			log.Println("Failed delete user: ", err)
+			return
+		}
+		authority.RevokeAll(auth.PRINCIPAL_USER, username)
+		if err != nil {
+			// the deletion is in the journal, it's continued in the background
+			ErrorWithJSON(w, "Deletion is started, it will be finished later", http.StatusAccepted)
+			log.Println("Deletion of ", username, " isn't finished: ", err)
+			return
+		}
 
-	Privdata []string `json:"priv_data"`
+		log.Println("User ", username, " is deleted by ", auth.FromRequest(r).Name)
+		w.WriteHeader(http.StatusNoContent)
+	}
 }
 
-// offchain db record corresponds to this struct
-// db index field is Userhash field
-type CipheredUserInfo struct {
-	// Userhash is a hash value of all user info (Username + Email + Hashedpassword + Privdata)
-	Userhash string
+// profileRequest is a body of self-service requests of the user
+type profileRequest struct {
+	CurrentPassword string `json:"current_password"`
+
+	// the new profile (see UpdateProfile()), missing fields aren't changed
+	Email    *string         `json:"email"`
+	Privdata json.RawMessage `json:"priv_data"`
 
-	Username       string
-	Email          string
-	Hashedpassword string
-	Privdata       string
+	// the new password (see ChangePassword())
+	NewPassword string `json:"new_password"`
 }
 
-// the service loop function
-func main() {
-	session, err := mgo.Dial(DB_URL)
+// ownRecord() finds the record of the user and verifies the current password
+// (self-service changes need it even with a valid token)
+func ownRecord(w http.ResponseWriter, users store.UserStore, ledger onchain.Ledger, username, password string) (*userinfo.CipheredUserInfo, bool) {
+	userhash, err := ledger.GetUserhash(&username)
+	var user *userinfo.CipheredUserInfo
+	if err == nil {
+		user, err = users.FindByUserhash(userhash)
+	}
+	if err == onchain.ErrUserNotFound || err == onchain.ErrUserDeleted || err == store.ErrNotFound {
+		ErrorWithJSON(w, "User is not found", http.StatusNotFound)
+		return nil, false
+	}
 	if err != nil {
-		panic(err)
+		ErrorWithJSON(w, "Database error", http.StatusInternalServerError)
+		log.Println("Failed find user: ", err)
+		return nil, false
 	}
-	defer session.Close()
 
-	session.SetMode(mgo.Monotonic, true)
-	ensureIndex(session)
+	// the password hash of the tampered record can't be trusted
+	integrity, ok := checkIntegrity(w, user, username, userhash)
+	if !ok {
+		return nil, false
+	}
+	if integrity != userinfo.INTEGRITY_VERIFIED {
+		ErrorWithJSON(w, "Record doesn't match the ledger", http.StatusConflict)
+		return nil, false
+	}
 
-	// init crypdata package
-	err = crypdata.Init()
-	if err != nil {
-		panic(err)
+	if ok, _ := crypdata.VerifyPassword(password, user.Hashedpassword); !ok {
+		ErrorWithJSON(w, "Wrong current password", http.StatusUnauthorized)
+		log.Println("Wrong current password of ", username)
+		return nil, false
 	}
+	return user, true
+}
 
-	// init admin entity
-	err = admin.Init("AdminSuperPassword")
+// updateOwnRecord() replaces the record of the user by the new one
+// in the ledger and the offchain db (see saga package)
+func updateOwnRecord(w http.ResponseWriter, sagas *saga.Coordinator, old, record *userinfo.CipheredUserInfo) bool {
+	_, err := sagas.Update(old, record)
+	if err == saga.ErrInProgress {
+		ErrorWithJSON(w, "User is being changed, try again later", http.StatusConflict)
+		return false
+	}
 	if err != nil {
-		panic(err)
+		ledgerError(w, err, "Update user error")
+		return false
 	}
-
-	mux := goji.NewMux()
-	mux.HandleFunc(pat.Get("/users"), allUsers(session)) // ONLY for DEBUG!
-	mux.HandleFunc(pat.Post("/users"), AddUser(session))
-	mux.HandleFunc(pat.Get("/users/:username"), UserByUsername(session))
-	mux.HandleFunc(pat.Get("/userhashes/:userhash"), userByUserhash(session)) // ONLY for DEBUG!
-	mux.HandleFunc(pat.Put("/users/:username"), UpdateUser(session))
-
-	http.ListenAndServe("localhost:8080", mux)
+	return true
 }
 
-func ensureIndex(s *mgo.Session) {
-	session := s.Copy()
-	defer session.Close()
-
-	c := session.DB(DB_NAME).C(USERS_COLLECTION_NAME)
-
-	// index of offchain database is userhash field
-	index := mgo.Index{
-		Key:        []string{"userhash"},
-		Unique:     true,
-		DropDups:   true,
-		Background: true,
-		Sparse:     true,
+// ownPrivdata() decrypts private data of the record of the user
+// by the unsealed user key or by the data key of the user
+func ownPrivdata(keys store.KeyStore, user *userinfo.CipheredUserInfo, userKey []byte) (json.RawMessage, error) {
+	key := userKey
+	if user.Userkey == "" && user.Keyformat == userinfo.KEYFORMAT_DATA_KEY {
+		var err error
+		key, err = userDataKey(keys, user.Username, false)
+		if err != nil {
+			return nil, err
+		}
 	}
-	err := c.EnsureIndex(index)
+
+	plaintext, err := userinfo.DecryptPrivdata(user, key)
 	if err != nil {
-		panic(err)
+		return nil, err
 	}
+	return userinfo.DecodePrivdata(user, plaintext)
 }
 
-// allUsers() receives all records (users info) in the offchain database
-// NOTE: this function is ONLY for DEBUGGING purposes
-func allUsers(s *mgo.Session) func(w http.ResponseWriter, r *http.Request) {
+// UpdateProfile() lets the user change his own email and private data,
+// the current password is required. Fields missing from the body
+// aren't changed (priv_data: null clears private data)
+func UpdateProfile(users store.UserStore, ledger onchain.Ledger, sagas *saga.Coordinator) func(w http.ResponseWriter, r *http.Request) {
 	return func(w http.ResponseWriter, r *http.Request) {
-		session := s.Copy()
-		defer session.Close()
-
-		c := session.DB(DB_NAME).C(USERS_COLLECTION_NAME)
+		// 1. Extract username (only the user himself, see rbac package)
+		username := pat.Param(r, "username")
 
-		var users []CipheredUserInfo
-		err := c.Find(bson.M{}).All(&users)
+		// 2. Take the new profile
+		var req profileRequest
+		err := json.NewDecoder(r.Body).Decode(&req)
 		if err != nil {
-			ErrorWithJSON(w, "Database error", http.StatusInternalServerError)
-			log.Println("Failed get all users: ", err)
+			ErrorWithJSON(w, "Incorrect body", http.StatusBadRequest)
 			return
 		}
 
-		respBody, err := json.MarshalIndent(users, "", "  ")
-		if err != nil {
-			log.Fatal(err)
+		// 3. Find the record and verify the current password
+		cryptoUser, ok := ownRecord(w, users, ledger, username, req.CurrentPassword)
+		if !ok {
+			return
 		}
 
-		ResponseWithJSON(w, respBody, http.StatusOK)
-	}
-}
-
-// createCipheredUserinfo() is an auxiliary function
-// it builds (copy some info, computes hash of password, encrypt private data)
-// CipheredUserInfo struct from UserInfo
-func createCipheredUserinfo(userInfo *UserInfo, cipheredUserInfo *CipheredUserInfo) error {
-	// 1. build one string object from array of UserInfo.Privdata strings
-	var userPrivData string = "["
-	for ind, pdata := range userInfo.Privdata {
-		if ind > 0 {
-			// we should separate private data strings
-			userPrivData += ", "
+		// 4. Fields missing from the body keep their values
+		user := userinfo.UserInfo{
+			Username: username,
+			Email:    cryptoUser.Email,
+			Password: req.CurrentPassword,
+			Privdata: req.Privdata,
+		}
+		if req.Email != nil {
+			user.Email = *req.Email
+		}
+		var userKey []byte
+		if cryptoUser.Userkey != "" {
+			userKey, err = crypdata.UnsealUserKey(cryptoUser.Userkey, req.CurrentPassword)
+		}
+		if err == nil && len(user.Privdata) == 0 {
+			user.Privdata, err = ownPrivdata(sagas.Keys(), cryptoUser, userKey)
 		}
-		userPrivData += pdata
-	}
-	userPrivData += "]"
-
-	// 2. encrypt private data
-	ciphertext, err := crypdata.Encrypt([]byte(userPrivData))
-	if err != nil {
-		return err
-	}
 
-	cipheredUserInfo.Username = userInfo.Username
-	cipheredUserInfo.Email = userInfo.Email
-	cipheredUserInfo.Hashedpassword = crypdata.Hash(userInfo.Password)
-	cipheredUserInfo.Privdata = hex.EncodeToString(ciphertext) // convert to string representation
+		// 5. Create new crypto data (the password and the user key aren't changed)
+		var newCryptoUser userinfo.CipheredUserInfo
+		if err == nil {
+			err = createCipheredUserinfo(sagas.Keys(), &user, &newCryptoUser, userKey)
+		}
+		if err != nil {
+			ErrorWithJSON(w, "Database error", http.StatusInternalServerError)
+			log.Println("Failed create crypto user: ", err)
+			return
+		}
 
-	// Userhash field is a hash of all user info
-	cipheredUserInfo.Userhash = crypdata.Hash(cipheredUserInfo.Username +
-		cipheredUserInfo.Email +
-		cipheredUserInfo.Hashedpassword +
-		cipheredUserInfo.Privdata)
+		// 6. Update the ledger and the offchain db
+		if !updateOwnRecord(w, sagas, cryptoUser, &newCryptoUser) {
+			return
+		}
+		log.Println("Profile of ", username, " is updated by the user")
 
-	return nil
+		w.WriteHeader(http.StatusNoContent)
+	}
 }
 
-// AddUser() takes new user info (as JSON object in the request),
-// builds ciphered user info and saves this record to the offchain db
-func AddUser(s *mgo.Session) func(w http.ResponseWriter, r *http.Request) {
+// ChangePassword() lets the user change his own password (the current one
+// is required). Private data aren't re-encrypted, only the user key is sealed
+// by the new password. All sessions of the user are revoked
+func ChangePassword(users store.UserStore, ledger onchain.Ledger, sagas *saga.Coordinator, authority *auth.Authority) func(w http.ResponseWriter, r *http.Request) {
 	return func(w http.ResponseWriter, r *http.Request) {
-		session := s.Copy()
-		defer session.Close()
+		// 1. Extract username (only the user himself, see rbac package)
+		username := pat.Param(r, "username")
 
-		// 1. Decode input json object
-		var user UserInfo
-		decoder := json.NewDecoder(r.Body)
-		err := decoder.Decode(&user)
-		if err != nil {
+		var req profileRequest
+		err := json.NewDecoder(r.Body).Decode(&req)
+		if err != nil || req.NewPassword == "" {
 			ErrorWithJSON(w, "Incorrect body", http.StatusBadRequest)
 			return
 		}
 
-		c := session.DB(DB_NAME).C(USERS_COLLECTION_NAME)
+		// 2. Find the record and verify the current password
+		cryptoUser, ok := ownRecord(w, users, ledger, username, req.CurrentPassword)
+		if !ok {
+			return
+		}
 
-		// 2. Builds ciphered user info
-		var cipheredUserInfo CipheredUserInfo
-		err = createCipheredUserinfo(&user, &cipheredUserInfo)
+		// 3. Build the record with the new password
+		newCryptoUser := *cryptoUser
+		newCryptoUser.Hashedpassword, err = crypdata.HashPassword(req.NewPassword)
+		if err == nil && cryptoUser.Userkey != "" {
+			var userKey []byte
+			userKey, err = crypdata.UnsealUserKey(cryptoUser.Userkey, req.CurrentPassword)
+			if err == nil {
+				newCryptoUser.Userkey, err = crypdata.SealUserKey(userKey, req.NewPassword)
+			}
+		}
 		if err != nil {
 			ErrorWithJSON(w, "Database error", http.StatusInternalServerError)
-			log.Println("Failed insert user: ", err)
+			log.Println("Failed change password: ", err)
 			return
 		}
+		userinfo.SetUserhash(&newCryptoUser)
 
-		// 3. Register the new user in the onchain part (create ca-cert)
-		err = onchain.RegisterUser(&cipheredUserInfo.Username)
-		if err != nil {
-			ErrorWithJSON(w, "Database error", http.StatusInternalServerError)
-			log.Println("Failed register user: ", err)
+		// 4. Update the ledger and the offchain db, old sessions are revoked
+		if !updateOwnRecord(w, sagas, cryptoUser, &newCryptoUser) {
 			return
 		}
+		authority.RevokeAll(auth.PRINCIPAL_USER, username)
+		log.Println("Password of ", username, " is changed by the user")
 
-		// 4. Store offchain data for the new user
-		err = c.Insert(cipheredUserInfo)
-		if err != nil {
-			if mgo.IsDup(err) {
-				ErrorWithJSON(w, "User with this userhash already exists", http.StatusBadRequest)
-				return
-			}
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
 
-			ErrorWithJSON(w, "Database error", http.StatusInternalServerError)
-			log.Println("Failed insert user: ", err)
+// UserHistory() returns all changes of the ledger record of the user
+// (when the offchain data were added, changed and deleted), for auditors
+func UserHistory(ledger onchain.Ledger) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		// 1. Extract username
+		username := pat.Param(r, "username")
+
+		// 2. Get the history of the record from onchain part (see onchain package)
+		history, err := ledger.GetUserHistory(&username)
+		if err != nil {
+			ledgerError(w, err, "Failed get history")
+			return
+		}
+		if len(history) == 0 {
+			ErrorWithJSON(w, "User is not found", http.StatusNotFound)
 			return
 		}
 
-		// 5. Add record (username + userhash) into onchain ledger
-		err = onchain.AddUserInfoToLedger(&cipheredUserInfo.Username, &cipheredUserInfo.Userhash)
+		respBody, err := json.MarshalIndent(historyResponse{
+			Username: username,
+			Changes:  len(history),
+			History:  history,
+		}, "", "  ")
 		if err != nil {
-			ErrorWithJSON(w, "Database error", http.StatusInternalServerError)
-			log.Println("Failed add UserInfo to ledger: ", err)
-			return
+			log.Fatal(err)
 		}
 
-		log.Println("Add a new user successfully")
-		w.Header().Set("Content-Type", "application/json")
-		w.Header().Set("Location", r.URL.Path+"/"+cipheredUserInfo.Username)
-		w.WriteHeader(http.StatusCreated)
+		ResponseWithJSON(w, respBody, http.StatusOK)
 	}
 }
 
-// UserByUsername() finds offchain database record with the specified userhash
-// and decrypt its private data
-func UserByUsername(s *mgo.Session) func(w http.ResponseWriter, r *http.Request) {
+// LedgerUsers() returns a page of records of the ledger (usernames and
+// userhashes, tombstones of deleted users too) in the order of usernames:
+// ?page_size (DEFAULT_PAGE_SIZE by default) and ?bookmark of the previous page
+func LedgerUsers(ledger onchain.Ledger) func(w http.ResponseWriter, r *http.Request) {
 	return func(w http.ResponseWriter, r *http.Request) {
-		session := s.Copy()
-		defer session.Close()
-
-		var err error
+		// 1. Take the page size and the bookmark
+		query := r.URL.Query()
+		pageSize := onchain.DEFAULT_PAGE_SIZE
+		if value := query.Get("page_size"); value != "" {
+			var err error
+			pageSize, err = strconv.Atoi(value)
+			if err != nil || pageSize < 1 || pageSize > onchain.MAX_PAGE_SIZE {
+				ErrorWithJSON(w, fmt.Sprintf("page_size has to be from 1 to %d", onchain.MAX_PAGE_SIZE), http.StatusBadRequest)
+				return
+			}
+		}
+		bookmark := query.Get("bookmark")
 
-		// 1. Extract username and password for this user
-		username := pat.Param(r, "username")
-		keys, ok := r.URL.Query()["password"]
-		if !ok || len(keys) < 1 {
-			log.Println("Url param doesn't have password")
+		// 2. Get the page from onchain part (see onchain package)
+		page, err := ledger.QueryUsersPage(pageSize, bookmark)
+		if err != nil {
+			ledgerError(w, err, "Failed list ledger users")
 			return
 		}
-		password := keys[0]
 
-		// 2. Get userhash from onchain part (see onchain package)
-		userhash, err := onchain.GetUserhash(&username)
+		response := ledgerUsersResponse{
+			Users:    page.Records,
+			Fetched:  page.Fetched,
+			Bookmark: page.Bookmark,
+		}
+		if page.Bookmark != "" {
+			next := url.Values{}
+			next.Set("page_size", strconv.Itoa(pageSize))
+			next.Set("bookmark", page.Bookmark)
+			response.Next = r.URL.Path + "?" + next.Encode()
+		}
+
+		respBody, err := json.MarshalIndent(response, "", "  ")
 		if err != nil {
-			ErrorWithJSON(w, "get_userhash error", http.StatusInternalServerError)
-			log.Println("Failed find user: ", err)
-			return
+			log.Fatal(err)
 		}
 
-		c := session.DB(DB_NAME).C(USERS_COLLECTION_NAME)
+		ResponseWithJSON(w, respBody, http.StatusOK)
+	}
+}
 
-		// 3. Find the offchain db record with this userhash
-		var user CipheredUserInfo
-		err = c.Find(bson.M{"userhash": userhash}).One(&user)
+// LedgerUsersCount() returns the number of records of the ledger
+func LedgerUsersCount(ledger onchain.Ledger) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		count, err := ledger.CountUsers()
 		if err != nil {
-			ErrorWithJSON(w, "can't find userhash", http.StatusInternalServerError)
-			log.Println("Failed find user: ", err)
+			ledgerError(w, err, "Failed count ledger users")
 			return
 		}
 
-		if user.Username == "" {
-			ErrorWithJSON(w, "User is not found", http.StatusNotFound)
-			return
+		respBody, err := json.MarshalIndent(count, "", "  ")
+		if err != nil {
+			log.Fatal(err)
 		}
 
-		// 4. If a hash of specified password matches the saved password hash,
-		//    then service should decrypt private data.
-		//    The user has access to his private data!
-		if crypdata.Hash(password) == user.Hashedpassword ||
-			admin.IsAdminPassword(password) {
-			privDataDecodedBytes, error := hex.DecodeString(user.Privdata)
-			plaintext, error := crypdata.Decrypt(privDataDecodedBytes)
-			if error != nil {
-				ErrorWithJSON(w, "Decrypt error", http.StatusInternalServerError)
-				log.Println("Failed find user: ", error)
+		ResponseWithJSON(w, respBody, http.StatusOK)
+	}
+}
+
+// lastReconciliation() returns the report of the last reconciliation
+// (the reconciliation is run if there was no one)
+func lastReconciliation(reconciler *reconcile.Reconciler) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		// 1. Take the last report
+		report := reconciler.Last()
+		if report == nil {
+			var err error
+			report, err = reconciler.Run(false)
+			if err != nil {
+				ErrorWithJSON(w, "Reconciliation error", http.StatusInternalServerError)
+				log.Println("Failed reconcile: ", err)
 				return
 			}
-			user.Privdata = string(plaintext)
 		}
 
-		respBody, err := json.MarshalIndent(user, "", "  ")
+		respBody, err := json.MarshalIndent(report, "", "  ")
 		if err != nil {
 			log.Fatal(err)
 		}
@@ -314,53 +1654,26 @@ func UserByUsername(s *mgo.Session) func(w http.ResponseWriter, r *http.Request)
 	}
 }
 
-// userByUserhash() finds offchain database record with the specified userhash
-// and decrypt its private data
-// NOTE: this function is ONLY for DEBUGGING purposes
-func userByUserhash(s *mgo.Session) func(w http.ResponseWriter, r *http.Request) {
+// Reconcile() compares the ledger and the offchain db now,
+// safe discrepancies are repaired if ?repair=true
+func Reconcile(reconciler *reconcile.Reconciler) func(w http.ResponseWriter, r *http.Request) {
 	return func(w http.ResponseWriter, r *http.Request) {
-		session := s.Copy()
-		defer session.Close()
-
-		// 1. Extract userhash and password for this user
-		userhash := pat.Param(r, "userhash")
-		keys, ok := r.URL.Query()["password"]
-		if !ok || len(keys) < 1 {
-			log.Println("Url param doesn't have password")
+		// 1. Repair changes the ledger
+		repair := r.URL.Query().Get("repair") == "true"
+		if repair && !rbac.Allowed(r, "", rbac.OP_UPDATE) {
+			ErrorWithJSON(w, "Operation update is not allowed", http.StatusForbidden)
 			return
 		}
-		password := keys[0]
-
-		c := session.DB(DB_NAME).C(USERS_COLLECTION_NAME)
 
-		// 2. Find user with the specified userhash
-		var user CipheredUserInfo
-		err := c.Find(bson.M{"userhash": userhash}).One(&user)
+		// 2. Walk the ledger and the offchain db
+		report, err := reconciler.Run(repair)
 		if err != nil {
-			ErrorWithJSON(w, "Database error", http.StatusInternalServerError)
-			log.Println("Failed find user: ", err)
-			return
-		}
-
-		if user.Username == "" {
-			ErrorWithJSON(w, "User is not found", http.StatusNotFound)
+			ErrorWithJSON(w, "Reconciliation error", http.StatusInternalServerError)
+			log.Println("Failed reconcile: ", err)
 			return
 		}
 
-		// 3. If a hash of specified password matches the saved password hash,
-		//    then service should decrypt private data
-		if crypdata.Hash(password) == user.Hashedpassword {
-			privDataDecodedBytes, error := hex.DecodeString(user.Privdata)
-			plaintext, error := crypdata.Decrypt(privDataDecodedBytes)
-			if error != nil {
-				ErrorWithJSON(w, "Decrypt error", http.StatusInternalServerError)
-				log.Println("Failed find user: ", error)
-				return
-			}
-			user.Privdata = string(plaintext)
-		}
-
-		respBody, err := json.MarshalIndent(user, "", "  ")
+		respBody, err := json.MarshalIndent(report, "", "  ")
 		if err != nil {
 			log.Fatal(err)
 		}
@@ -369,91 +1682,159 @@ func userByUserhash(s *mgo.Session) func(w http.ResponseWriter, r *http.Request)
 	}
 }
 
-// UpdateUser() finds offchain database record with the specified userhash
-// and decrypt its private data
-func UpdateUser(s *mgo.Session) func(w http.ResponseWriter, r *http.Request) {
-	return func(w http.ResponseWriter, r *http.Request) {
-		session := s.Copy()
-		defer session.Close()
+// accountRequest is a body of requests of admin accounts management
+type accountRequest struct {
+	Token           string `json:"token"` // bootstrap token
+	Name            string `json:"name"`
+	Password        string `json:"password"`
+	CurrentPassword string `json:"current_password"`
+	Role            string `json:"role"`
+	Identity        string `json:"identity"` // Fabric enrolled identity
+}
 
-		var err error
+// accountError() sends the error of the admin package
+func accountError(w http.ResponseWriter, err error) {
+	switch err {
+	case admin.ErrNotFound:
+		ErrorWithJSON(w, err.Error(), http.StatusNotFound)
+	case admin.ErrExists, admin.ErrBootstrapped, admin.ErrLastAdmin:
+		ErrorWithJSON(w, err.Error(), http.StatusConflict)
+	case admin.ErrBadName, admin.ErrBadRole, admin.ErrWeakPassword, admin.ErrNoIdentity:
+		ErrorWithJSON(w, err.Error(), http.StatusBadRequest)
+	case admin.ErrBadBootstrap, admin.ErrWrongCredentials, admin.ErrDisabled:
+		ErrorWithJSON(w, err.Error(), http.StatusUnauthorized)
+	default:
+		ErrorWithJSON(w, "Database error", http.StatusInternalServerError)
+		log.Println("Failed change admin account: ", err)
+	}
+}
 
-		// 1. Extract username and password for this user
-		username := pat.Param(r, "username")
-		keys, ok := r.URL.Query()["password"]
-		if !ok || len(keys) < 1 {
-			log.Println("Url param doesn't have password")
+// accountResponse() sends the account (without the password hash)
+func accountResponse(w http.ResponseWriter, account interface{}, code int) {
+	respBody, err := json.MarshalIndent(account, "", "  ")
+	if err != nil {
+		log.Fatal(err)
+	}
+	ResponseWithJSON(w, respBody, code)
+}
+
+// BootstrapAdmin() creates the first admin account by the one-time token
+// printed on the first run (see bootstrapAdmin())
+func BootstrapAdmin() func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var req accountRequest
+		err := json.NewDecoder(r.Body).Decode(&req)
+		if err != nil {
+			ErrorWithJSON(w, "Incorrect body", http.StatusBadRequest)
 			return
 		}
-		password := keys[0]
 
-		// 2. Find this user's userhash in onchain part (Hyperledger Fabric)
-		userhash, err := onchain.GetUserhash(&username)
+		account, err := admin.Bootstrap(req.Token, req.Name, req.Password, false)
 		if err != nil {
-			ErrorWithJSON(w, "get_userhash error", http.StatusInternalServerError)
-			log.Println("Failed find user: ", err)
+			accountError(w, err)
 			return
 		}
+		log.Printf("The first admin account %q is created", account.Name)
 
-		c := session.DB(DB_NAME).C(USERS_COLLECTION_NAME)
+		accountResponse(w, account, http.StatusCreated)
+	}
+}
 
-		// 3. Find the offchain db record with this userhash
-		var cryptoUser CipheredUserInfo
-		err = c.Find(bson.M{"userhash": userhash}).One(&cryptoUser)
+// adminAccounts() returns all admin accounts
+func adminAccounts() func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		list, err := admin.List()
 		if err != nil {
-			ErrorWithJSON(w, "Database error", http.StatusInternalServerError)
-			log.Println("Failed find user: ", err)
+			accountError(w, err)
 			return
 		}
+		accountResponse(w, list, http.StatusOK)
+	}
+}
 
-		if cryptoUser.Username == "" {
-			ErrorWithJSON(w, "User is not found", http.StatusNotFound)
+// CreateAccount() adds a new admin account with the role,
+// it may be linked to the Fabric enrolled identity
+func CreateAccount() func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var req accountRequest
+		err := json.NewDecoder(r.Body).Decode(&req)
+		if err != nil {
+			ErrorWithJSON(w, "Incorrect body", http.StatusBadRequest)
 			return
 		}
 
-		// 4. Only admin can change this data
-		if !admin.IsAdminPassword(password) {
-			ErrorWithJSON(w, "Wrong admin password", http.StatusInternalServerError)
-			log.Println("Admin password is wrong")
+		account, err := admin.Create(req.Name, req.Password, req.Role, req.Identity)
+		if err != nil {
+			accountError(w, err)
 			return
 		}
+		log.Printf("Admin account %q (%s) is created by %s", account.Name, account.Role, auth.FromRequest(r).Name)
 
-		// 5. Take new user data (as json object)
-		var user UserInfo
-		decoder := json.NewDecoder(r.Body)
-		err = decoder.Decode(&user)
+		accountResponse(w, account, http.StatusCreated)
+	}
+}
+
+// DisableAccount() disables (or enables) the admin account,
+// sessions of the disabled account are revoked
+func DisableAccount(authority *auth.Authority, disabled bool) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		name := pat.Param(r, "name")
 
+		account, err := admin.SetDisabled(name, disabled)
 		if err != nil {
-			ErrorWithJSON(w, "Incorrect body", http.StatusBadRequest)
+			accountError(w, err)
 			return
 		}
+		if disabled {
+			authority.RevokeAll(auth.PRINCIPAL_ADMIN, name)
+		}
+		log.Printf("Admin account %q: disabled=%v (by %s)", name, disabled, auth.FromRequest(r).Name)
 
-		// 6. Create new crypto data
-		err = createCipheredUserinfo(&user, &cryptoUser)
-		if err != nil {
-			ErrorWithJSON(w, "Database error", http.StatusInternalServerError)
-			log.Println("Failed create crypto user: ", err)
+		accountResponse(w, account, http.StatusOK)
+	}
+}
+
+// RotatePassword() sets a new password of the admin account.
+// The account itself has to give the current password, others need
+// the manage operation. All sessions of the account are revoked
+func RotatePassword(authority *auth.Authority) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		// 1. Extract the name of the account and the caller
+		name := pat.Param(r, "name")
+		principal := auth.FromRequest(r)
+		if !principal.IsAdmin() {
+			ErrorWithJSON(w, "Authorization is required", http.StatusUnauthorized)
 			return
 		}
 
-		// 7. Update the ledger
-		err = onchain.UpdateLedgerUserinfo(&cryptoUser.Username, &cryptoUser.Userhash)
+		var req accountRequest
+		err := json.NewDecoder(r.Body).Decode(&req)
 		if err != nil {
-			ErrorWithJSON(w, "Database error", http.StatusInternalServerError)
-			log.Println("Update ledger user info error: ", err)
+			ErrorWithJSON(w, "Incorrect body", http.StatusBadRequest)
 			return
 		}
 
-		// 8. Update the offchain db
-		err = c.Update(bson.M{"userhash": userhash}, &cryptoUser)
-		if err != nil {
-			ErrorWithJSON(w, "Database error", http.StatusInternalServerError)
-			log.Println("Update db error: ", err)
+		// 2. Check the right to change the password
+		if principal.Name == name {
+			_, err = admin.Authenticate(name, req.CurrentPassword)
+			if err != nil {
+				accountError(w, err)
+				return
+			}
+		} else if !rbac.Allowed(r, "", rbac.OP_MANAGE) {
+			ErrorWithJSON(w, "Operation manage is not allowed", http.StatusForbidden)
 			return
 		}
 
-		log.Println("Update user successfully")
+		// 3. Change the password and revoke old sessions
+		account, err := admin.SetPassword(name, req.Password)
+		if err != nil {
+			accountError(w, err)
+			return
+		}
+		authority.RevokeAll(auth.PRINCIPAL_ADMIN, name)
+		log.Printf("Password of the admin account %q is changed by %s", name, principal.Name)
 
-		w.WriteHeader(http.StatusNoContent)
+		accountResponse(w, account, http.StatusOK)
 	}
 }
@@ -0,0 +1,506 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"./admin"
+	"./auth"
+	"./crypdata"
+	"./onchain"
+	"./reconcile"
+	"./saga"
+	"./store"
+)
+
+// the service with memory backends (see TestMain())
+var testServer *httptest.Server
+
+const TEST_ADMIN_PASSWORD = "adminpass"
+
+func TestMain(m *testing.M) {
+	os.Exit(runTests(m))
+}
+
+func runTests(m *testing.M) int {
+	log.SetOutput(ioutil.Discard)
+
+	dir, err := ioutil.TempDir("", "fabusers")
+	if err != nil {
+		panic(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// weak parameters of password hashes keep tests fast
+	err = crypdata.Init(filepath.Join(dir, "crypdata.pem"))
+	if err == nil {
+		err = crypdata.SetPasswordParams(crypdata.PasswordParams{Memory: 64, Time: 1, Threads: 1, SaltLen: 16, KeyLen: 32})
+	}
+
+	users := store.NewMemoryStore()
+	versions := store.NewMemoryStore()
+	keys := store.NewMemoryKeys()
+	ledger := onchain.NewMemoryLedger()
+	journal := saga.NewMemoryJournal()
+
+	if err == nil {
+		err = admin.Init(ledger, admin.NewMemoryAccounts())
+	}
+	if err == nil {
+		_, err = admin.Bootstrap("", admin.ADMIN_NAME, TEST_ADMIN_PASSWORD, true)
+	}
+	for _, role := range []string{admin.ROLE_AUDITOR, admin.ROLE_SUPPORT} {
+		if err == nil {
+			_, err = admin.Create(role, TEST_ADMIN_PASSWORD, role, "")
+		}
+	}
+	authority, authErr := auth.New()
+	if err == nil {
+		err = authErr
+	}
+	if err != nil {
+		panic(err)
+	}
+
+	sagas := saga.New(users, versions, keys, ledger, journal)
+	testServer = httptest.NewServer(newMux(users, versions, keys, ledger, sagas, reconcile.New(users, sagas), authority))
+	defer testServer.Close()
+
+	return m.Run()
+}
+
+// testUser is the record in responses of GET /users/:username
+type testUser struct {
+	Username  string
+	Email     string
+	Privdata  json.RawMessage
+	Integrity string
+	Keyformat string
+}
+
+// call() sends the request with the JSON body (if body isn't nil),
+// decodes the JSON response to out (if out isn't nil) and returns the status
+func call(t *testing.T, method, path, token string, body, out interface{}) int {
+	var reader io.Reader
+	if body != nil {
+		data, err := json.Marshal(body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		reader = bytes.NewReader(data)
+	}
+	req, err := http.NewRequest(method, testServer.URL+path, reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	if out != nil && resp.StatusCode < 300 {
+		err = json.NewDecoder(resp.Body).Decode(out)
+		if err != nil {
+			t.Fatalf("%s %s: %v", method, path, err)
+		}
+	}
+	return resp.StatusCode
+}
+
+// expect() fails the test if the status isn't the expected one
+func expect(t *testing.T, what string, code int, want int) {
+	t.Helper()
+	if code != want {
+		t.Fatalf("%s: %d, want %d", what, code, want)
+	}
+}
+
+func addUser(t *testing.T, username, password string, privdata interface{}) {
+	t.Helper()
+	body := map[string]interface{}{
+		"username":  username,
+		"email":     username + "@mail.com",
+		"password":  password,
+		"priv_data": privdata,
+	}
+	expect(t, "add "+username, call(t, "POST", "/users", "", body, nil), http.StatusCreated)
+}
+
+func login(t *testing.T, username, password string) *auth.Tokens {
+	t.Helper()
+	var tokens auth.Tokens
+	body := map[string]string{"username": username, "password": password}
+	expect(t, "login "+username, call(t, "POST", "/login", "", body, &tokens), http.StatusOK)
+	return &tokens
+}
+
+func adminLogin(t *testing.T, name string) string {
+	t.Helper()
+	var tokens auth.Tokens
+	body := map[string]string{"username": name, "password": TEST_ADMIN_PASSWORD}
+	expect(t, "login "+name, call(t, "POST", "/admin/login", "", body, &tokens), http.StatusOK)
+	return tokens.AccessToken
+}
+
+func getUser(t *testing.T, username, token string) *testUser {
+	t.Helper()
+	var user testUser
+	expect(t, "get "+username, call(t, "GET", "/users/"+username, token, nil, &user), http.StatusOK)
+	if user.Integrity != "verified" {
+		t.Fatalf("integrity of %s: %s", username, user.Integrity)
+	}
+	return &user
+}
+
+// withKeyModes() runs the test for private data encrypted by data keys
+// and by user keys (crypto.user_keys), usernames get the suffix of the mode
+func withKeyModes(t *testing.T, test func(t *testing.T, suffix string)) {
+	for _, userKeys := range []bool{false, true} {
+		suffix := "-datakey"
+		if userKeys {
+			suffix = "-userkey"
+		}
+		t.Run(suffix[1:], func(t *testing.T) {
+			defer func(previous bool) { cfg.Crypto.UserKeys = previous }(cfg.Crypto.UserKeys)
+			cfg.Crypto.UserKeys = userKeys
+			test(t, suffix)
+		})
+	}
+}
+
+// privdataIs() reports whether private data of the response are the document
+func privdataIs(privdata json.RawMessage, document string) bool {
+	var got, want interface{}
+	if json.Unmarshal(privdata, &got) != nil || json.Unmarshal([]byte(document), &want) != nil {
+		return false
+	}
+	gotBytes, _ := json.Marshal(got)
+	wantBytes, _ := json.Marshal(want)
+	return bytes.Equal(gotBytes, wantBytes)
+}
+
+func TestReadUser(t *testing.T) {
+	withKeyModes(t, func(t *testing.T, suffix string) {
+		username := "ondar07" + suffix
+		other := "alice" + suffix
+		addUser(t, username, "pw", map[string]string{"passport": "1234"})
+		addUser(t, other, "pw", []string{"a", "b"})
+
+		code := call(t, "POST", "/users", "", map[string]string{"username": username, "password": "pw"}, nil)
+		expect(t, "add existing user", code, http.StatusConflict)
+		code = call(t, "POST", "/users", "", map[string]string{"username": "nopassword" + suffix}, nil)
+		expect(t, "add user without password", code, http.StatusBadRequest)
+		expect(t, "anonymous read", call(t, "GET", "/users/"+username, "", nil, nil), http.StatusUnauthorized)
+		code = call(t, "POST", "/login", "", map[string]string{"username": username, "password": "wrong"}, nil)
+		expect(t, "login by wrong password", code, http.StatusUnauthorized)
+
+		// the user reads his own private data only
+		tokens := login(t, username, "pw")
+		user := getUser(t, username, tokens.AccessToken)
+		if !privdataIs(user.Privdata, `{"passport": "1234"}`) {
+			t.Fatalf("private data of the user: %s", user.Privdata)
+		}
+		if suffix == "-datakey" && user.Keyformat != "datakey" {
+			t.Fatalf("keyformat: %q, want datakey", user.Keyformat)
+		}
+		expect(t, "read other user", call(t, "GET", "/users/"+other, tokens.AccessToken, nil, nil), http.StatusForbidden)
+
+		// auditors see private data ciphered
+		user = getUser(t, username, adminLogin(t, admin.ROLE_AUDITOR))
+		if privdataIs(user.Privdata, `{"passport": "1234"}`) {
+			t.Fatal("auditor reads private data")
+		}
+
+		// admins decrypt private data, but not the data encrypted to user keys
+		user = getUser(t, username, adminLogin(t, admin.ROLE_ADMIN))
+		if decrypted := privdataIs(user.Privdata, `{"passport": "1234"}`); decrypted != (suffix == "-datakey") {
+			t.Fatalf("admin reads private data: %s", user.Privdata)
+		}
+	})
+}
+
+func TestUpdateProfile(t *testing.T) {
+	withKeyModes(t, func(t *testing.T, suffix string) {
+		username := "profile" + suffix
+		addUser(t, username, "pw", []string{"a", "b"})
+		addUser(t, "other"+suffix, "pw", nil)
+		tokens := login(t, username, "pw")
+		path := "/users/" + username + "/profile"
+
+		code := call(t, "PUT", path, tokens.AccessToken, map[string]interface{}{"current_password": "wrong", "email": "new@mail.com"}, nil)
+		expect(t, "update by wrong password", code, http.StatusUnauthorized)
+		code = call(t, "PUT", "/users/other"+suffix+"/profile", tokens.AccessToken, map[string]interface{}{"current_password": "pw"}, nil)
+		expect(t, "update other user", code, http.StatusForbidden)
+
+		// fields missing from the body keep their values
+		code = call(t, "PUT", path, tokens.AccessToken, map[string]interface{}{"current_password": "pw", "email": "new@mail.com"}, nil)
+		expect(t, "update email", code, http.StatusNoContent)
+		user := getUser(t, username, tokens.AccessToken)
+		if user.Email != "new@mail.com" || !privdataIs(user.Privdata, `["a", "b"]`) {
+			t.Fatalf("after email update: %s, %s", user.Email, user.Privdata)
+		}
+
+		code = call(t, "PUT", path, tokens.AccessToken, map[string]interface{}{"current_password": "pw", "priv_data": []string{"c"}}, nil)
+		expect(t, "update private data", code, http.StatusNoContent)
+		user = getUser(t, username, tokens.AccessToken)
+		if user.Email != "new@mail.com" || !privdataIs(user.Privdata, `["c"]`) {
+			t.Fatalf("after private data update: %s, %s", user.Email, user.Privdata)
+		}
+	})
+}
+
+func TestChangePassword(t *testing.T) {
+	withKeyModes(t, func(t *testing.T, suffix string) {
+		username := "password" + suffix
+		addUser(t, username, "pw", []string{"a"})
+		tokens := login(t, username, "pw")
+		path := "/users/" + username + "/password"
+
+		code := call(t, "PUT", path, tokens.AccessToken, map[string]string{"current_password": "pw"}, nil)
+		expect(t, "change without the new password", code, http.StatusBadRequest)
+		code = call(t, "PUT", path, tokens.AccessToken, map[string]string{"current_password": "pw", "new_password": "pw2"}, nil)
+		expect(t, "change password", code, http.StatusNoContent)
+
+		// sessions of the old password are revoked
+		expect(t, "read by old session", call(t, "GET", "/users/"+username, tokens.AccessToken, nil, nil), http.StatusUnauthorized)
+		code = call(t, "POST", "/login", "", map[string]string{"username": username, "password": "pw"}, nil)
+		expect(t, "login by old password", code, http.StatusUnauthorized)
+
+		// private data are available with the new password
+		tokens = login(t, username, "pw2")
+		if user := getUser(t, username, tokens.AccessToken); !privdataIs(user.Privdata, `["a"]`) {
+			t.Fatalf("private data after password change: %s", user.Privdata)
+		}
+
+		// admins don't change passwords of users
+		code = call(t, "PUT", path, adminLogin(t, admin.ROLE_ADMIN), map[string]string{"current_password": "pw2", "new_password": "pw3"}, nil)
+		expect(t, "change by admin", code, http.StatusForbidden)
+	})
+}
+
+func TestTokens(t *testing.T) {
+	defer func(previous bool) { cfg.Crypto.UserKeys = previous }(cfg.Crypto.UserKeys)
+	cfg.Crypto.UserKeys = true
+
+	addUser(t, "tokens", "pw", []string{"a"})
+	tokens := login(t, "tokens", "pw")
+
+	// the refresh token is used once, the session keeps the user key
+	var refreshed auth.Tokens
+	body := map[string]string{"refresh_token": tokens.RefreshToken}
+	expect(t, "refresh", call(t, "POST", "/token/refresh", "", body, &refreshed), http.StatusOK)
+	expect(t, "refresh by used token", call(t, "POST", "/token/refresh", "", body, nil), http.StatusUnauthorized)
+	if user := getUser(t, "tokens", refreshed.AccessToken); !privdataIs(user.Privdata, `["a"]`) {
+		t.Fatalf("private data after refresh: %s", user.Privdata)
+	}
+	expect(t, "bad token", call(t, "GET", "/users/tokens", "garbage", nil, nil), http.StatusUnauthorized)
+
+	// logout by the refresh token (the access token may be expired)
+	body = map[string]string{"refresh_token": refreshed.RefreshToken}
+	expect(t, "logout by refresh token", call(t, "POST", "/logout", "", body, nil), http.StatusNoContent)
+	expect(t, "read after logout", call(t, "GET", "/users/tokens", refreshed.AccessToken, nil, nil), http.StatusUnauthorized)
+	expect(t, "logout again", call(t, "POST", "/logout", "", body, nil), http.StatusUnauthorized)
+
+	// logout by the access token
+	tokens = login(t, "tokens", "pw")
+	expect(t, "logout", call(t, "POST", "/logout", tokens.AccessToken, nil, nil), http.StatusNoContent)
+	expect(t, "read after logout", call(t, "GET", "/users/tokens", tokens.AccessToken, nil, nil), http.StatusUnauthorized)
+	expect(t, "anonymous logout", call(t, "POST", "/logout", "", nil, nil), http.StatusUnauthorized)
+}
+
+func TestUpdateUser(t *testing.T) {
+	addUser(t, "support", "pw", []string{"a"})
+	body := map[string]interface{}{"email": "new@mail.com", "password": "pw2", "priv_data": []string{"b"}}
+
+	expect(t, "update by auditor", call(t, "PUT", "/users/support", adminLogin(t, admin.ROLE_AUDITOR), body, nil), http.StatusForbidden)
+	expect(t, "update by the user", call(t, "PUT", "/users/support", login(t, "support", "pw").AccessToken, body, nil), http.StatusForbidden)
+
+	token := adminLogin(t, admin.ROLE_SUPPORT)
+	renamed := map[string]interface{}{"username": "renamed", "password": "pw2"}
+	expect(t, "update username", call(t, "PUT", "/users/support", token, renamed, nil), http.StatusBadRequest)
+	for _, password := range []interface{}{nil, ""} {
+		noPassword := map[string]interface{}{"email": "new@mail.com", "password": password}
+		expect(t, "update without password", call(t, "PUT", "/users/support", token, noPassword, nil), http.StatusBadRequest)
+	}
+	expect(t, "update unknown user", call(t, "PUT", "/users/nobody", token, body, nil), http.StatusNotFound)
+	expect(t, "update by support", call(t, "PUT", "/users/support", token, body, nil), http.StatusNoContent)
+
+	tokens := login(t, "support", "pw2")
+	user := getUser(t, "support", tokens.AccessToken)
+	if user.Email != "new@mail.com" || !privdataIs(user.Privdata, `["b"]`) {
+		t.Fatalf("after update: %s, %s", user.Email, user.Privdata)
+	}
+}
+
+func TestDeleteUser(t *testing.T) {
+	addUser(t, "deleted", "pw", []string{"a"})
+	token := adminLogin(t, admin.ROLE_ADMIN)
+
+	expect(t, "delete by the user", call(t, "DELETE", "/users/deleted", login(t, "deleted", "pw").AccessToken, nil, nil), http.StatusForbidden)
+	expect(t, "delete by support", call(t, "DELETE", "/users/deleted", adminLogin(t, admin.ROLE_SUPPORT), nil, nil), http.StatusForbidden)
+	expect(t, "delete", call(t, "DELETE", "/users/deleted", token, nil, nil), http.StatusNoContent)
+
+	expect(t, "read deleted user", call(t, "GET", "/users/deleted", token, nil, nil), http.StatusGone)
+	expect(t, "delete again", call(t, "DELETE", "/users/deleted", token, nil, nil), http.StatusGone)
+	code := call(t, "POST", "/users", "", map[string]string{"username": "deleted", "password": "pw"}, nil)
+	expect(t, "add deleted user", code, http.StatusConflict)
+	code = call(t, "POST", "/login", "", map[string]string{"username": "deleted", "password": "pw"}, nil)
+	expect(t, "login of deleted user", code, http.StatusUnauthorized)
+
+	var history historyResponse
+	expect(t, "history", call(t, "GET", "/users/deleted/history", token, nil, &history), http.StatusOK)
+	if history.Changes != 2 || !history.History[1].Deleted {
+		t.Fatalf("history of deleted user: %+v", history)
+	}
+}
+
+func TestVersions(t *testing.T) {
+	// admins compare decrypted private data of records encrypted by data keys
+	defer func(previous bool) { cfg.Crypto.UserKeys = previous }(cfg.Crypto.UserKeys)
+	cfg.Crypto.UserKeys = false
+
+	addUser(t, "versions", "pw", []string{"a"})
+	tokens := login(t, "versions", "pw")
+	body := map[string]interface{}{"current_password": "pw", "email": "new@mail.com"}
+	expect(t, "update", call(t, "PUT", "/users/versions/profile", tokens.AccessToken, body, nil), http.StatusNoContent)
+
+	token := adminLogin(t, admin.ROLE_ADMIN)
+	var history historyResponse
+	expect(t, "history", call(t, "GET", "/users/versions/history", token, nil, &history), http.StatusOK)
+	if history.Changes != 2 {
+		t.Fatalf("history: %+v, want 2 changes", history)
+	}
+	first := history.History[0]
+	expect(t, "history by the user", call(t, "GET", "/users/versions/history", tokens.AccessToken, nil, nil), http.StatusForbidden)
+	expect(t, "history of unknown user", call(t, "GET", "/users/nobody/history", token, nil, nil), http.StatusNotFound)
+
+	// the version of the first transaction
+	var user testUser
+	expect(t, "read version", call(t, "GET", "/users/versions?at="+first.TxID, token, nil, &user), http.StatusOK)
+	if user.Email != "versions@mail.com" {
+		t.Fatalf("email of the first version: %s", user.Email)
+	}
+	expect(t, "read by bad point", call(t, "GET", "/users/versions?at=garbage", token, nil, nil), http.StatusBadRequest)
+	expect(t, "read before the first change", call(t, "GET", "/users/versions?at=2000-01-01T00:00:00Z", token, nil, nil), http.StatusNotFound)
+
+	var diff diffResponse
+	expect(t, "diff", call(t, "GET", "/users/versions/diff?from="+first.InfoHash, token, nil, &diff), http.StatusOK)
+	changed := map[string]bool{}
+	for _, change := range diff.Changes {
+		changed[change.Field] = true
+	}
+	if !changed["Email"] || changed["Privdata"] {
+		t.Fatalf("diff: %+v, want Email changed only", diff.Changes)
+	}
+	expect(t, "diff without from", call(t, "GET", "/users/versions/diff", token, nil, nil), http.StatusBadRequest)
+	expect(t, "diff by auditor", call(t, "GET", "/users/versions/diff?from="+first.InfoHash, adminLogin(t, admin.ROLE_AUDITOR), nil, nil), http.StatusForbidden)
+}
+
+func TestLedgerUsers(t *testing.T) {
+	addUser(t, "ledger1", "pw", nil)
+	addUser(t, "ledger2", "pw", nil)
+	token := adminLogin(t, admin.ROLE_AUDITOR)
+
+	var count onchain.UserCount
+	expect(t, "count", call(t, "GET", "/admin/ledger/users/count", token, nil, &count), http.StatusOK)
+
+	listed := 0
+	for next := "/admin/ledger/users?page_size=1"; next != ""; {
+		var page ledgerUsersResponse
+		expect(t, next, call(t, "GET", next, token, nil, &page), http.StatusOK)
+		if page.Fetched != 1 {
+			t.Fatalf("page %s: %+v", next, page)
+		}
+		listed++
+		if listed > count.Total {
+			t.Fatalf("%d records are listed, the count is %d", listed, count.Total)
+		}
+		next = page.Next
+	}
+	if listed != count.Total {
+		t.Fatalf("%d records are listed, the count is %d", listed, count.Total)
+	}
+
+	expect(t, "page_size=0", call(t, "GET", "/admin/ledger/users?page_size=0", token, nil, nil), http.StatusBadRequest)
+	expect(t, "page_size=5000", call(t, "GET", "/admin/ledger/users?page_size=5000", token, nil, nil), http.StatusBadRequest)
+	expect(t, "anonymous list", call(t, "GET", "/admin/ledger/users", "", nil, nil), http.StatusUnauthorized)
+	expect(t, "list by the user", call(t, "GET", "/admin/ledger/users", login(t, "ledger1", "pw").AccessToken, nil, nil), http.StatusForbidden)
+}
+
+func TestListUsers(t *testing.T) {
+	addUser(t, "listed", "listedpass", map[string]string{"passport": "1234"})
+
+	// records of the list and of the user have no password hashes (nor sealed keys)
+	noSecrets := func(what string, record map[string]interface{}) {
+		t.Helper()
+		for field, value := range record {
+			if field == "Hashedpassword" || field == "Userkey" || strings.Contains(fmt.Sprint(value), "$argon2") {
+				t.Fatalf("%s has %s: %v", what, field, value)
+			}
+		}
+	}
+	for _, role := range []string{admin.ROLE_AUDITOR, admin.ROLE_SUPPORT} {
+		var records []map[string]interface{}
+		expect(t, "list by "+role, call(t, "GET", "/users", adminLogin(t, role), nil, &records), http.StatusOK)
+		if len(records) == 0 {
+			t.Fatalf("list by %s is empty", role)
+		}
+		for _, record := range records {
+			noSecrets("record listed by "+role, record)
+		}
+	}
+
+	var record map[string]interface{}
+	token := login(t, "listed", "listedpass").AccessToken
+	expect(t, "get listed", call(t, "GET", "/users/listed", token, nil, &record), http.StatusOK)
+	noSecrets("record of the user", record)
+}
+
+func TestAdminAccounts(t *testing.T) {
+	token := adminLogin(t, admin.ROLE_ADMIN)
+
+	for _, test := range []struct {
+		body map[string]string
+		code int
+	}{
+		{map[string]string{"name": "auditor2", "password": "auditorpass", "role": admin.ROLE_AUDITOR}, http.StatusCreated},
+		{map[string]string{"name": "auditor2", "password": "auditorpass", "role": admin.ROLE_AUDITOR}, http.StatusConflict},
+		{map[string]string{"name": "short", "password": "short", "role": admin.ROLE_AUDITOR}, http.StatusBadRequest},
+		{map[string]string{"name": "god", "password": "longenough", "role": "god"}, http.StatusBadRequest},
+		{map[string]string{"name": "fabric", "password": "longenough", "role": admin.ROLE_SUPPORT, "identity": "nobody"}, http.StatusBadRequest},
+	} {
+		expect(t, "create "+test.body["name"], call(t, "POST", "/admin/accounts", token, test.body, nil), test.code)
+	}
+	expect(t, "disable the last admin", call(t, "POST", "/admin/accounts/admin/disable", token, nil, nil), http.StatusConflict)
+
+	var tokens auth.Tokens
+	body := map[string]string{"username": "auditor2", "password": "auditorpass"}
+	expect(t, "login auditor2", call(t, "POST", "/admin/login", "", body, &tokens), http.StatusOK)
+	expect(t, "manage by auditor", call(t, "GET", "/admin/accounts", tokens.AccessToken, nil, nil), http.StatusForbidden)
+
+	// the disabled account loses its sessions at once
+	expect(t, "disable", call(t, "POST", "/admin/accounts/auditor2/disable", token, nil, nil), http.StatusOK)
+	expect(t, "list by disabled account", call(t, "GET", "/users", tokens.AccessToken, nil, nil), http.StatusUnauthorized)
+	expect(t, "login of disabled account", call(t, "POST", "/admin/login", "", body, nil), http.StatusUnauthorized)
+	expect(t, "enable", call(t, "POST", "/admin/accounts/auditor2/enable", token, nil, nil), http.StatusOK)
+	expect(t, "login of enabled account", call(t, "POST", "/admin/login", "", body, nil), http.StatusOK)
+
+	// the first admin exists, so the bootstrap is closed
+	body = map[string]string{"token": "", "name": "intruder", "password": "intruderpass"}
+	expect(t, "bootstrap", call(t, "POST", "/admin/bootstrap", "", body, nil), http.StatusUnauthorized)
+}
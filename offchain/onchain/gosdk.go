@@ -0,0 +1,334 @@
+/*
+gosdk backend talks to the peer, the orderer and the CA of the Fabric network
+directly (grpc), using Hyperledger Fabric go sdk:
+
+	go get github.com/hyperledger/fabric-sdk-go
+
+The network is described by a connection profile (see offchain/connection.yaml).
+Transactions are signed by the enrolled identity of the user (as js scripts do),
+execute() waits until the transaction is committed by the peer.
+*/
+package onchain
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/hyperledger/fabric-sdk-go/pkg/client/channel"
+	mspclient "github.com/hyperledger/fabric-sdk-go/pkg/client/msp"
+	"github.com/hyperledger/fabric-sdk-go/pkg/common/errors/status"
+	"github.com/hyperledger/fabric-sdk-go/pkg/core/config"
+	"github.com/hyperledger/fabric-sdk-go/pkg/fabsdk"
+)
+
+const GOSDK_BACKEND = "gosdk"
+
+// defaults correspond to basic-network and fabusers/startFabric.sh
+const (
+	DEFAULT_CONNECTION_PROFILE = "connection.yaml"
+	DEFAULT_CRYPTO_STORE       = "gosdk-key-store/msp"
+	DEFAULT_CHANNEL            = "mychannel"
+	DEFAULT_CHAINCODE          = "fabusers"
+	DEFAULT_ORG                = "Org1"
+
+	// see enrollAdmin.js
+	DEFAULT_ADMIN_NAME   = "admin"
+	DEFAULT_ADMIN_SECRET = "adminpw"
+
+	// see registerUser.js
+	USER_AFFILIATION = "org1.department1"
+)
+
+type SDKLedger struct {
+	sdk *fabsdk.FabricSDK
+	ca  *mspclient.Client
+
+	// client.credentialStore.cryptoStore.path of the connection profile
+	cryptoStore string
+
+	channelID   string
+	chaincode   string
+	org         string
+	adminName   string
+	adminSecret string
+
+	// channel clients of enrolled users (username -> client)
+	mu      sync.Mutex
+	clients map[string]*channel.Client
+}
+
+func init() {
+	Register(GOSDK_BACKEND, newSDKLedger)
+}
+
+// newSDKLedger() is a Factory of the gosdk backend
+// options: "connection_profile", "crypto_store", "channel", "chaincode", "org",
+// "admin_name", "admin_secret"
+func newSDKLedger(options map[string]string) (Ledger, error) {
+	profile := option(options, "connection_profile", DEFAULT_CONNECTION_PROFILE)
+
+	sdk, err := fabsdk.New(config.FromFile(profile))
+	if err != nil {
+		return nil, fmt.Errorf("can't create fabric sdk from %s: %v", profile, err)
+	}
+
+	org := option(options, "org", DEFAULT_ORG)
+	ca, err := mspclient.New(sdk.Context(), mspclient.WithOrg(org))
+	if err != nil {
+		sdk.Close()
+		return nil, fmt.Errorf("can't create CA client: %v", err)
+	}
+
+	return &SDKLedger{
+		sdk:         sdk,
+		ca:          ca,
+		cryptoStore: option(options, "crypto_store", DEFAULT_CRYPTO_STORE),
+		channelID:   option(options, "channel", DEFAULT_CHANNEL),
+		chaincode:   option(options, "chaincode", DEFAULT_CHAINCODE),
+		org:         org,
+		adminName:   option(options, "admin_name", DEFAULT_ADMIN_NAME),
+		adminSecret: option(options, "admin_secret", DEFAULT_ADMIN_SECRET),
+		clients:     make(map[string]*channel.Client),
+	}, nil
+}
+
+// Close() releases connections of the sdk
+func (l *SDKLedger) Close() error {
+	l.sdk.Close()
+	return nil
+}
+
+// channelClient() returns a client which signs requests by the user identity
+func (l *SDKLedger) channelClient(username string) (*channel.Client, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if client, ok := l.clients[username]; ok {
+		return client, nil
+	}
+
+	ctx := l.sdk.ChannelContext(l.channelID, fabsdk.WithUser(username), fabsdk.WithOrg(l.org))
+	client, err := channel.New(ctx)
+	if err != nil {
+		return nil, err
+	}
+	l.clients[username] = client
+	return client, nil
+}
+
+// query() evaluates the chaincode function on the peer (without ordering).
+// Queries are signed by admin, so a user that is enrolled by another
+// instance of the service can be found too
+func (l *SDKLedger) query(fcn string, args ...string) ([]byte, error) {
+	client, err := l.channelClient(l.adminName)
+	if err != nil {
+		return nil, &TxError{Fcn: fcn, Err: err}
+	}
+
+	response, err := client.Query(l.request(fcn, args))
+	if err != nil {
+		return nil, newTxError(fcn, response, err)
+	}
+	return response.Payload, nil
+}
+
+// execute() endorses the transaction, sends it to the orderer
+// and waits for the commit event
+func (l *SDKLedger) execute(username string, fcn string, args ...string) error {
+	client, err := l.channelClient(username)
+	if err != nil {
+		return &TxError{Fcn: fcn, Err: err}
+	}
+
+	response, err := client.Execute(l.request(fcn, args))
+	if err != nil {
+		return newTxError(fcn, response, err)
+	}
+	return nil
+}
+
+func (l *SDKLedger) request(fcn string, args []string) channel.Request {
+	request := channel.Request{ChaincodeID: l.chaincode, Fcn: fcn}
+	for _, arg := range args {
+		request.Args = append(request.Args, []byte(arg))
+	}
+	return request
+}
+
+// newTxError() builds TxError from the sdk response and error
+func newTxError(fcn string, response channel.Response, err error) *TxError {
+	txErr := &TxError{Fcn: fcn, TxID: string(response.TransactionID), Err: err}
+	if s, ok := status.FromError(err); ok {
+		txErr.Status = fmt.Sprintf("%s(%d)", s.Group, s.Code)
+		txErr.Message = s.Message
+	}
+	// the error of the chaincode (see CODE_*)
+	if ccErr := newChaincodeError(fcn, err.Error()); ccErr != nil {
+		txErr.Code = ccErr.Code
+		txErr.Message = ccErr.Message
+	}
+	return txErr
+}
+
+func (l *SDKLedger) EnrollAdmin() error {
+	// admin is already enrolled (see credentialStore of the connection profile)
+	if _, err := l.ca.GetSigningIdentity(l.adminName); err == nil {
+		return nil
+	}
+	err := l.ca.Enroll(l.adminName, mspclient.WithSecret(l.adminSecret))
+	if err != nil {
+		return fmt.Errorf("failed to enroll admin: %v", err)
+	}
+	return nil
+}
+
+func (l *SDKLedger) RegisterUser(username *string) error {
+	secret, err := l.ca.Register(&mspclient.RegistrationRequest{
+		Name:        *username,
+		Type:        "client",
+		Affiliation: USER_AFFILIATION,
+	})
+	if err != nil {
+		return fmt.Errorf("failed to register %s: %v", *username, err)
+	}
+
+	err = l.ca.Enroll(*username, mspclient.WithSecret(secret))
+	if err != nil {
+		return fmt.Errorf("failed to enroll %s: %v", *username, err)
+	}
+	return nil
+}
+
+func (l *SDKLedger) GetUserhash(username *string) (string, error) {
+	payload, err := l.query("queryUser", *username)
+	if ErrorCode(err) == CODE_NOT_FOUND {
+		return "", ErrUserNotFound
+	}
+	if err != nil {
+		return "", err
+	}
+
+	// queryUser of the first version returns empty payload for unknown user
+	if len(payload) == 0 {
+		return "", ErrUserNotFound
+	}
+
+	var user User
+	err = json.Unmarshal(payload, &user)
+	if err != nil {
+		return "", &TxError{Fcn: "queryUser", Message: "bad payload " + string(payload), Err: err}
+	}
+	if user.Deleted {
+		return "", ErrUserDeleted
+	}
+	return user.InfoHash, nil
+}
+
+func (l *SDKLedger) AddUserInfoToLedger(username *string, userhash *string) error {
+	return l.execute(*username, "addUser", *username, *userhash)
+}
+
+func (l *SDKLedger) UpdateLedgerUserinfo(username *string, userhash *string) error {
+	return l.execute(*username, "changeUserInfoHash", *username, *userhash)
+}
+
+// DeleteUser() writes the tombstone, the transaction is signed by admin
+// (the identity of the user is revoked before or after it)
+func (l *SDKLedger) DeleteUser(username *string) error {
+	return l.execute(l.adminName, "deleteUser", *username)
+}
+
+// RevokeUser() revokes the identity of the user in the CA
+// and removes its private key from the crypto store
+func (l *SDKLedger) RevokeUser(username *string) error {
+	identity, identityErr := l.ca.GetSigningIdentity(*username)
+
+	_, err := l.ca.Revoke(&mspclient.RevocationRequest{Name: *username, Reason: "cessationofoperation"})
+	if err != nil && !strings.Contains(err.Error(), "already revoked") {
+		return fmt.Errorf("failed to revoke %s: %v", *username, err)
+	}
+
+	l.mu.Lock()
+	delete(l.clients, *username)
+	l.mu.Unlock()
+
+	if identityErr != nil {
+		// the private key was removed by the previous attempt
+		return nil
+	}
+	keyFile := hex.EncodeToString(identity.PrivateKey().SKI()) + "_sk"
+	err = os.Remove(filepath.Join(l.cryptoStore, "keystore", keyFile))
+	if err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("can't remove private key of %s: %v", *username, err)
+	}
+	return nil
+}
+
+func (l *SDKLedger) QueryUsersPage(pageSize int, bookmark string) (*UserPage, error) {
+	payload, err := l.query("queryUsersPage", strconv.Itoa(pageSize), bookmark)
+	if err != nil {
+		return nil, err
+	}
+
+	var page UserPage
+	err = json.Unmarshal(payload, &page)
+	if err != nil {
+		return nil, &TxError{Fcn: "queryUsersPage", Message: "bad payload " + string(payload), Err: err}
+	}
+	return &page, nil
+}
+
+func (l *SDKLedger) CountUsers() (*UserCount, error) {
+	payload, err := l.query("countUsers")
+	if err != nil {
+		return nil, err
+	}
+
+	var count UserCount
+	err = json.Unmarshal(payload, &count)
+	if err != nil {
+		return nil, &TxError{Fcn: "countUsers", Message: "bad payload " + string(payload), Err: err}
+	}
+	return &count, nil
+}
+
+func (l *SDKLedger) GetUserHistory(username *string) ([]HistoryRecord, error) {
+	payload, err := l.query("getUserHistory", *username)
+	if err != nil {
+		return nil, err
+	}
+
+	var history []HistoryRecord
+	err = json.Unmarshal(payload, &history)
+	if err != nil {
+		return nil, &TxError{Fcn: "getUserHistory", Message: "bad payload " + string(payload), Err: err}
+	}
+	return history, nil
+}
+
+// Enrollment() returns the enrollment certificate of the user and the private key
+// (the sdk keeps private keys in <crypto store>/keystore/<ski>_sk files)
+func (l *SDKLedger) Enrollment(username *string) (*Enrollment, error) {
+	identity, err := l.ca.GetSigningIdentity(*username)
+	if err != nil {
+		return nil, err
+	}
+
+	keyFile := hex.EncodeToString(identity.PrivateKey().SKI()) + "_sk"
+	keyBytes, err := ioutil.ReadFile(filepath.Join(l.cryptoStore, "keystore", keyFile))
+	if err != nil {
+		return nil, fmt.Errorf("can't read private key of %s: %v", *username, err)
+	}
+
+	return &Enrollment{
+		Certificate: identity.EnrollmentCertificate(),
+		PrivateKey:  keyBytes,
+	}, nil
+}
@@ -0,0 +1,386 @@
+/*
+memory backend keeps the ledger in the process memory.
+
+It mimics the fabusers chaincode (addUser, queryUser, changeUserInfoHash,
+deleteUser, queryUsersPage, countUsers, getUserHistory) and the CA (enrollAdmin.js, registerUser.js,
+revokeUser.js), so the offchain service can be launched without Fabric network.
+Errors of the chaincode have the same codes (see CODE_*). As with the access rules
+of the chaincode, addUser and changeUserInfoHash are signed by the identity of
+the user (it has to be registered and not revoked), deleteUser by admin.
+NOTE: this backend is ONLY for tests and local development
+*/
+package onchain
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"math/big"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const MEMORY_BACKEND = "memory"
+
+// MemoryLedger is a ledger state (world state) and a list of enrolled identities
+type MemoryLedger struct {
+	mu sync.RWMutex
+
+	// state is a key-value storage like APIstub.GetState()/PutState()
+	state map[string][]byte
+
+	// history keeps all changes of keys like the history database of the peer
+	history map[string][]HistoryRecord
+
+	adminEnrolled bool
+	identities    map[string]*Enrollment
+	revoked       map[string]bool
+}
+
+func init() {
+	Register(MEMORY_BACKEND, func(options map[string]string) (Ledger, error) {
+		return NewMemoryLedger(), nil
+	})
+}
+
+// NewMemoryLedger() creates an empty ledger
+func NewMemoryLedger() *MemoryLedger {
+	return &MemoryLedger{
+		state:      make(map[string][]byte),
+		history:    make(map[string][]HistoryRecord),
+		identities: make(map[string]*Enrollment),
+		revoked:    make(map[string]bool),
+	}
+}
+
+func (l *MemoryLedger) EnrollAdmin() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.adminEnrolled = true
+	return nil
+}
+
+// RegisterUser() works like registerUser.js:
+// admin has to be enrolled, the CA refuses to register the same identity twice
+func (l *MemoryLedger) RegisterUser(username *string) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if !l.adminEnrolled {
+		return errors.New("Failed to get admin.... run enrollAdmin.js")
+	}
+	if l.identities[*username] != nil || l.revoked[*username] {
+		return errors.New("Identity '" + *username + "' is already registered")
+	}
+
+	enrollment, err := newEnrollment(*username)
+	if err != nil {
+		return err
+	}
+	l.identities[*username] = enrollment
+	return nil
+}
+
+func (l *MemoryLedger) Enrollment(username *string) (*Enrollment, error) {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+
+	enrollment := l.identities[*username]
+	if enrollment == nil {
+		return nil, errors.New("Identity '" + *username + "' is not registered")
+	}
+	return enrollment, nil
+}
+
+// RevokeUser() works like revokeUser.js:
+// the identity is revoked and its enrollment is removed from the wallet
+func (l *MemoryLedger) RevokeUser(username *string) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.identities[*username] == nil && !l.revoked[*username] {
+		return errors.New("Identity '" + *username + "' is not registered")
+	}
+	delete(l.identities, *username)
+	l.revoked[*username] = true
+	return nil
+}
+
+// newEnrollment() makes ecdsa key and self-signed certificate like the CA does
+func newEnrollment(username string) (*Enrollment, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: username, OrganizationalUnit: []string{"client"}},
+		NotBefore:    time.Now(),
+		NotAfter:     time.Now().AddDate(1, 0, 0),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+	}
+	certDER, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		return nil, err
+	}
+	keyDER, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Enrollment{
+		Certificate: pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: certDER}),
+		PrivateKey:  pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: keyDER}),
+	}, nil
+}
+
+// chaincodeError() makes the error like the chaincode does
+func chaincodeError(fcn, code, message string) *TxError {
+	return &TxError{Fcn: fcn, Code: code, Message: code + ": " + message}
+}
+
+// checkArgs() validates the username and the info hash (if it isn't nil)
+// like the chaincode does
+func checkArgs(fcn string, username *string, userhash *string) error {
+	if *username == "" || (*username)[0] == 0x00 || len(*username) > 256 {
+		return chaincodeError(fcn, CODE_INVALID_ARGUMENT, "Incorrect username "+*username)
+	}
+	if userhash == nil {
+		return nil
+	}
+	_, err := hex.DecodeString(*userhash)
+	if len(*userhash) < 32 || len(*userhash) > 128 || err != nil || *userhash != strings.ToLower(*userhash) {
+		return chaincodeError(fcn, CODE_INVALID_ARGUMENT, "Info hash "+*userhash+" is not a lowercase hex string")
+	}
+	return nil
+}
+
+// checkSigner() checks the identity that signs the transaction
+// like the access rules of the chaincode do (l.mu is locked)
+func (l *MemoryLedger) checkSigner(fcn string, username string, admin bool) error {
+	if admin && !l.adminEnrolled {
+		return chaincodeError(fcn, CODE_FORBIDDEN, "Identity admin is not enrolled")
+	}
+	if !admin && l.identities[username] == nil {
+		return chaincodeError(fcn, CODE_FORBIDDEN, "Identity "+username+" is not registered or revoked")
+	}
+	return nil
+}
+
+// GetUserhash() works like queryUser chaincode function
+func (l *MemoryLedger) GetUserhash(username *string) (string, error) {
+	if err := checkArgs("queryUser", username, nil); err != nil {
+		return "", err
+	}
+
+	l.mu.RLock()
+	userAsBytes := l.state[*username]
+	l.mu.RUnlock()
+
+	// queryUser returns NOT_FOUND for unknown user
+	if len(userAsBytes) == 0 {
+		return "", ErrUserNotFound
+	}
+
+	var user User
+	err := json.Unmarshal(userAsBytes, &user)
+	if err != nil {
+		return "", err
+	}
+	if user.Deleted {
+		return "", ErrUserDeleted
+	}
+	return user.InfoHash, nil
+}
+
+// AddUserInfoToLedger() works like addUser chaincode function
+// (the existing record isn't overwritten)
+func (l *MemoryLedger) AddUserInfoToLedger(username *string, userhash *string) error {
+	if err := checkArgs("addUser", username, userhash); err != nil {
+		return err
+	}
+	userAsBytes, err := json.Marshal(User{InfoHash: *userhash})
+	if err != nil {
+		return err
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if err := l.checkSigner("addUser", *username, false); err != nil {
+		return err
+	}
+	if len(l.state[*username]) != 0 {
+		return chaincodeError("addUser", CODE_ALREADY_EXISTS, "User "+*username+" already exists")
+	}
+	return l.putState(*username, userAsBytes)
+}
+
+// UpdateLedgerUserinfo() works like changeUserInfoHash chaincode function
+// (the user has to exist and not to be deleted)
+func (l *MemoryLedger) UpdateLedgerUserinfo(username *string, userhash *string) error {
+	if err := checkArgs("changeUserInfoHash", username, userhash); err != nil {
+		return err
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if err := l.checkSigner("changeUserInfoHash", *username, false); err != nil {
+		return err
+	}
+	if len(l.state[*username]) == 0 {
+		return chaincodeError("changeUserInfoHash", CODE_NOT_FOUND, "User "+*username+" does not exist")
+	}
+	user := User{}
+	json.Unmarshal(l.state[*username], &user)
+	if user.Deleted {
+		return chaincodeError("changeUserInfoHash", CODE_NOT_FOUND, "User "+*username+" is deleted")
+	}
+	user.InfoHash = *userhash
+
+	userAsBytes, err := json.Marshal(user)
+	if err != nil {
+		return err
+	}
+	return l.putState(*username, userAsBytes)
+}
+
+// DeleteUser() works like deleteUser chaincode function
+// (the tombstone is written once)
+func (l *MemoryLedger) DeleteUser(username *string) error {
+	if err := checkArgs("deleteUser", username, nil); err != nil {
+		return err
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if err := l.checkSigner("deleteUser", *username, true); err != nil {
+		return err
+	}
+	userAsBytes := l.state[*username]
+	if len(userAsBytes) == 0 {
+		return chaincodeError("deleteUser", CODE_NOT_FOUND, "User "+*username+" does not exist")
+	}
+	user := User{}
+	json.Unmarshal(userAsBytes, &user)
+	if user.Deleted {
+		return nil
+	}
+	user.Deleted = true
+
+	userAsBytes, err := json.Marshal(user)
+	if err != nil {
+		return err
+	}
+	return l.putState(*username, userAsBytes)
+}
+
+// putState() works like APIstub.PutState(), every change is a new
+// transaction with a random id (l.mu is locked)
+func (l *MemoryLedger) putState(key string, value []byte) error {
+	txID := make([]byte, 32)
+	if _, err := rand.Read(txID); err != nil {
+		return err
+	}
+
+	var user User
+	json.Unmarshal(value, &user)
+
+	now := time.Now().UTC()
+	l.state[key] = value
+	l.history[key] = append(l.history[key], HistoryRecord{
+		TxID:      hex.EncodeToString(txID),
+		Timestamp: &now,
+		InfoHash:  user.InfoHash,
+		Deleted:   user.Deleted,
+	})
+	return nil
+}
+
+// GetUserHistory() works like getUserHistory chaincode function
+func (l *MemoryLedger) GetUserHistory(username *string) ([]HistoryRecord, error) {
+	if err := checkArgs("getUserHistory", username, nil); err != nil {
+		return nil, err
+	}
+
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+
+	history := make([]HistoryRecord, len(l.history[*username]))
+	copy(history, l.history[*username])
+	return history, nil
+}
+
+// QueryUsersPage() works like queryUsersPage chaincode function
+// (GetStateByRangeWithPagination() over all keys): the bookmark is
+// the first key of the next page
+func (l *MemoryLedger) QueryUsersPage(pageSize int, bookmark string) (*UserPage, error) {
+	if pageSize < 1 || pageSize > MAX_PAGE_SIZE {
+		return nil, chaincodeError("queryUsersPage", CODE_INVALID_ARGUMENT,
+			fmt.Sprintf("Page size has to be from 1 to %d", MAX_PAGE_SIZE))
+	}
+
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+
+	keys := l.sortedKeys()
+	start := sort.SearchStrings(keys, bookmark)
+	end := start + pageSize
+	page := &UserPage{Records: []UserRecord{}}
+	if end < len(keys) {
+		page.Bookmark = keys[end]
+	} else {
+		end = len(keys)
+	}
+
+	for _, key := range keys[start:end] {
+		record := UserRecord{Key: key}
+		err := json.Unmarshal(l.state[key], &record.Record)
+		if err != nil {
+			return nil, err
+		}
+		page.Records = append(page.Records, record)
+	}
+	page.Fetched = len(page.Records)
+	return page, nil
+}
+
+// CountUsers() works like countUsers chaincode function
+func (l *MemoryLedger) CountUsers() (*UserCount, error) {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+
+	count := &UserCount{}
+	for _, userAsBytes := range l.state {
+		var user User
+		json.Unmarshal(userAsBytes, &user)
+		count.Total++
+		if user.Deleted {
+			count.Deleted++
+		}
+	}
+	return count, nil
+}
+
+// sortedKeys() returns keys of the state in the order of the range query (l.mu is locked)
+func (l *MemoryLedger) sortedKeys() []string {
+	keys := make([]string, 0, len(l.state))
+	for key := range l.state {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
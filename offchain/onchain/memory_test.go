@@ -0,0 +1,266 @@
+package onchain
+
+import (
+	"strings"
+	"testing"
+)
+
+var (
+	hash1 = strings.Repeat("a1", 32)
+	hash2 = strings.Repeat("b2", 32)
+)
+
+// newTestLedger() makes the ledger with enrolled admin and registered users
+func newTestLedger(t *testing.T, usernames ...string) *MemoryLedger {
+	ledger := NewMemoryLedger()
+	if err := ledger.EnrollAdmin(); err != nil {
+		t.Fatal(err)
+	}
+	for _, username := range usernames {
+		username := username
+		if err := ledger.RegisterUser(&username); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return ledger
+}
+
+func TestMemoryLedgerAddAndQuery(t *testing.T) {
+	username := "ondar07"
+	ledger := newTestLedger(t, username)
+
+	if _, err := ledger.GetUserhash(&username); err != ErrUserNotFound {
+		t.Fatalf("GetUserhash() of unknown user: %v, want ErrUserNotFound", err)
+	}
+	if err := ledger.AddUserInfoToLedger(&username, &hash1); err != nil {
+		t.Fatal(err)
+	}
+	userhash, err := ledger.GetUserhash(&username)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if userhash != hash1 {
+		t.Fatalf("GetUserhash() = %s, want %s", userhash, hash1)
+	}
+
+	// addUser doesn't overwrite the existing record
+	err = ledger.AddUserInfoToLedger(&username, &hash2)
+	if ErrorCode(err) != CODE_ALREADY_EXISTS {
+		t.Fatalf("AddUserInfoToLedger() of existing user: %v, want %s", err, CODE_ALREADY_EXISTS)
+	}
+	if userhash, _ := ledger.GetUserhash(&username); userhash != hash1 {
+		t.Fatalf("existing record is overwritten by %s", userhash)
+	}
+}
+
+func TestMemoryLedgerArgs(t *testing.T) {
+	username := "ondar07"
+	ledger := newTestLedger(t, username)
+
+	empty := ""
+	for _, userhash := range []string{"", "abc", strings.ToUpper(hash1), strings.Repeat("zz", 32)} {
+		userhash := userhash
+		err := ledger.AddUserInfoToLedger(&username, &userhash)
+		if ErrorCode(err) != CODE_INVALID_ARGUMENT {
+			t.Errorf("AddUserInfoToLedger(%q): %v, want %s", userhash, err, CODE_INVALID_ARGUMENT)
+		}
+	}
+	if _, err := ledger.GetUserhash(&empty); ErrorCode(err) != CODE_INVALID_ARGUMENT {
+		t.Errorf("GetUserhash(\"\"): %v, want %s", err, CODE_INVALID_ARGUMENT)
+	}
+}
+
+func TestMemoryLedgerSigner(t *testing.T) {
+	username := "ondar07"
+	ledger := newTestLedger(t)
+
+	// the identity of the user isn't registered
+	err := ledger.AddUserInfoToLedger(&username, &hash1)
+	if ErrorCode(err) != CODE_FORBIDDEN {
+		t.Fatalf("AddUserInfoToLedger() without identity: %v, want %s", err, CODE_FORBIDDEN)
+	}
+
+	if err := ledger.RegisterUser(&username); err != nil {
+		t.Fatal(err)
+	}
+	if err := ledger.RegisterUser(&username); err == nil {
+		t.Fatal("RegisterUser() registers the same identity twice")
+	}
+	if err := ledger.AddUserInfoToLedger(&username, &hash1); err != nil {
+		t.Fatal(err)
+	}
+
+	// the revoked identity can't sign and can't be registered again
+	if err := ledger.RevokeUser(&username); err != nil {
+		t.Fatal(err)
+	}
+	err = ledger.UpdateLedgerUserinfo(&username, &hash2)
+	if ErrorCode(err) != CODE_FORBIDDEN {
+		t.Fatalf("UpdateLedgerUserinfo() by revoked identity: %v, want %s", err, CODE_FORBIDDEN)
+	}
+	if err := ledger.RegisterUser(&username); err == nil {
+		t.Fatal("RegisterUser() registers the revoked identity")
+	}
+}
+
+func TestMemoryLedgerUpdate(t *testing.T) {
+	username := "ondar07"
+	ledger := newTestLedger(t, username)
+
+	err := ledger.UpdateLedgerUserinfo(&username, &hash2)
+	if ErrorCode(err) != CODE_NOT_FOUND {
+		t.Fatalf("UpdateLedgerUserinfo() of unknown user: %v, want %s", err, CODE_NOT_FOUND)
+	}
+
+	if err := ledger.AddUserInfoToLedger(&username, &hash1); err != nil {
+		t.Fatal(err)
+	}
+	if err := ledger.UpdateLedgerUserinfo(&username, &hash2); err != nil {
+		t.Fatal(err)
+	}
+	if userhash, _ := ledger.GetUserhash(&username); userhash != hash2 {
+		t.Fatalf("GetUserhash() = %s, want %s", userhash, hash2)
+	}
+}
+
+func TestMemoryLedgerDelete(t *testing.T) {
+	username := "ondar07"
+	ledger := newTestLedger(t, username)
+
+	if err := ledger.AddUserInfoToLedger(&username, &hash1); err != nil {
+		t.Fatal(err)
+	}
+	if err := ledger.DeleteUser(&username); err != nil {
+		t.Fatal(err)
+	}
+	// the tombstone is written once
+	if err := ledger.DeleteUser(&username); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := ledger.GetUserhash(&username); err != ErrUserDeleted {
+		t.Fatalf("GetUserhash() of deleted user: %v, want ErrUserDeleted", err)
+	}
+	err := ledger.UpdateLedgerUserinfo(&username, &hash2)
+	if ErrorCode(err) != CODE_NOT_FOUND {
+		t.Fatalf("UpdateLedgerUserinfo() of deleted user: %v, want %s", err, CODE_NOT_FOUND)
+	}
+	err = ledger.AddUserInfoToLedger(&username, &hash2)
+	if ErrorCode(err) != CODE_ALREADY_EXISTS {
+		t.Fatalf("AddUserInfoToLedger() of deleted user: %v, want %s", err, CODE_ALREADY_EXISTS)
+	}
+
+	history, err := ledger.GetUserHistory(&username)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(history) != 2 || history[0].InfoHash != hash1 || !history[1].Deleted {
+		t.Fatalf("GetUserHistory() = %+v, want the record and the tombstone", history)
+	}
+}
+
+func TestMemoryLedgerHistoryAt(t *testing.T) {
+	username := "ondar07"
+	ledger := newTestLedger(t, username)
+
+	if err := ledger.AddUserInfoToLedger(&username, &hash1); err != nil {
+		t.Fatal(err)
+	}
+	if err := ledger.UpdateLedgerUserinfo(&username, &hash2); err != nil {
+		t.Fatal(err)
+	}
+	history, err := ledger.GetUserHistory(&username)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	record, err := HistoryAt(history, history[0].TxID)
+	if err != nil || record.InfoHash != hash1 {
+		t.Fatalf("HistoryAt(tx id) = %+v, %v, want %s", record, err, hash1)
+	}
+	record, err = HistoryAt(history, hash2)
+	if err != nil || record.TxID != history[1].TxID {
+		t.Fatalf("HistoryAt(userhash) = %+v, %v, want %s", record, err, history[1].TxID)
+	}
+	if _, err := HistoryAt(history, "2000-01-01T00:00:00Z"); err != ErrNoVersion {
+		t.Fatalf("HistoryAt() before the first change: %v, want ErrNoVersion", err)
+	}
+	if _, err := HistoryAt(history, "yesterday"); err != ErrBadPoint {
+		t.Fatalf("HistoryAt(\"yesterday\"): %v, want ErrBadPoint", err)
+	}
+}
+
+func TestMemoryLedgerPages(t *testing.T) {
+	usernames := []string{"user1", "ondar07", "alice", "user10", "bob"}
+	ledger := newTestLedger(t, usernames...)
+	for _, username := range usernames {
+		username := username
+		if err := ledger.AddUserInfoToLedger(&username, &hash1); err != nil {
+			t.Fatal(err)
+		}
+	}
+	deleted := "bob"
+	if err := ledger.DeleteUser(&deleted); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := ledger.QueryUsersPage(0, ""); ErrorCode(err) != CODE_INVALID_ARGUMENT {
+		t.Fatalf("QueryUsersPage(0): %v, want %s", err, CODE_INVALID_ARGUMENT)
+	}
+
+	// all keys are listed in their order, tombstones too
+	var keys []string
+	bookmark := ""
+	for pages := 0; ; pages++ {
+		if pages > len(usernames) {
+			t.Fatal("QueryUsersPage() doesn't reach the last page")
+		}
+		page, err := ledger.QueryUsersPage(2, bookmark)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if page.Fetched != len(page.Records) {
+			t.Fatalf("Fetched = %d, records: %d", page.Fetched, len(page.Records))
+		}
+		for _, record := range page.Records {
+			keys = append(keys, record.Key)
+		}
+		if page.Bookmark == "" {
+			break
+		}
+		bookmark = page.Bookmark
+	}
+	want := "alice,bob,ondar07,user1,user10"
+	if strings.Join(keys, ",") != want {
+		t.Fatalf("listed keys: %v, want %s", keys, want)
+	}
+
+	records, err := QueryAllUsers(ledger)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(records) != len(usernames) {
+		t.Fatalf("QueryAllUsers() returns %d records, want %d", len(records), len(usernames))
+	}
+
+	count, err := ledger.CountUsers()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if count.Total != len(usernames) || count.Deleted != 1 {
+		t.Fatalf("CountUsers() = %+v, want %d total and 1 deleted", count, len(usernames))
+	}
+}
+
+func TestMemoryBackend(t *testing.T) {
+	ledger, err := New(MEMORY_BACKEND, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := ledger.(*MemoryLedger); !ok {
+		t.Fatalf("New(%q) returns %T", MEMORY_BACKEND, ledger)
+	}
+	if _, err := New("unknown", nil); err == nil {
+		t.Fatal("New() of unknown backend doesn't fail")
+	}
+}
@@ -0,0 +1,263 @@
+/*
+nodejs backend provides maintenance of nodejs sdk
+(launching js scripts from fabusers/ in a separate processes)
+
+Every request launches a whole process, so gosdk backend is preferable.
+*/
+package onchain
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+const NODEJS_BACKEND = "nodejs"
+
+// default directory of js scripts (relative to the offchain directory)
+const DEFAULT_SCRIPTS_DIR = "../fabusers"
+
+// NodeLedger launches fabusers/*.js scripts by node
+type NodeLedger struct {
+	scriptsDir string
+}
+
+func init() {
+	Register(NODEJS_BACKEND, newNodeLedger)
+}
+
+// newNodeLedger() is a Factory of the nodejs backend
+// options: "scripts_dir" is a directory with js scripts
+func newNodeLedger(options map[string]string) (Ledger, error) {
+	return NewNodeLedger(option(options, "scripts_dir", DEFAULT_SCRIPTS_DIR)), nil
+}
+
+// NewNodeLedger() creates nodejs backend which uses scripts from scriptsDir
+func NewNodeLedger(scriptsDir string) *NodeLedger {
+	return &NodeLedger{scriptsDir: scriptsDir}
+}
+
+// run() launches the script with arguments and returns its output
+// (stdout and stderr, errors of the chaincode are printed to stderr)
+func (l *NodeLedger) run(script string, args ...string) (string, error) {
+	cmdArgs := append([]string{filepath.Join(l.scriptsDir, script)}, args...)
+	outCmd := exec.Command("node", cmdArgs...)
+
+	var out bytes.Buffer
+	outCmd.Stdout = &out
+	outCmd.Stderr = &out
+	err := outCmd.Run()
+	return out.String(), err
+}
+
+// invoke() launches the script of the chaincode transaction,
+// the error of the chaincode (see CODE_*) is returned as TxError
+func (l *NodeLedger) invoke(fcn string, script string, args ...string) error {
+	output, err := l.run(script, args...)
+	if err != nil {
+		return err
+	}
+	if strings.Contains(output, "Successfully committed") {
+		return nil
+	}
+	if txErr := newChaincodeError(fcn, output); txErr != nil {
+		return txErr
+	}
+	return &TxError{Fcn: fcn, Message: output}
+}
+
+// queryResponse() finds the payload of the query in the output of the script
+func queryResponse(fcn string, output string) (string, error) {
+	re := regexp.MustCompile("OK RESPONSE: (.*)")
+	match := re.FindStringSubmatch(output)
+	if len(match) > 0 {
+		return match[1], nil
+	}
+	if txErr := newChaincodeError(fcn, output); txErr != nil {
+		return "", txErr
+	}
+	return "", &TxError{Fcn: fcn, Message: output}
+}
+
+func (l *NodeLedger) EnrollAdmin() error {
+	_, err := l.run("enrollAdmin.js")
+	return err
+}
+
+func (l *NodeLedger) RegisterUser(username *string) error {
+	_, err := l.run("registerUser.js", *username)
+	return err
+}
+
+func (l *NodeLedger) GetUserhash(username *string) (string, error) {
+	output, err := l.run("query.js", *username)
+	if err != nil {
+		return "", err
+	}
+	payload, err := queryResponse("queryUser", output)
+	if ErrorCode(err) == CODE_NOT_FOUND || (err == nil && payload == "") {
+		// (the chaincode of the first version returns empty payload for unknown user)
+		return "", ErrUserNotFound
+	}
+	if err != nil {
+		return "", err
+	}
+
+	var user User
+	err = json.Unmarshal([]byte(payload), &user)
+	if err != nil {
+		return "", &TxError{Fcn: "queryUser", Message: output, Err: err}
+	}
+	if user.Deleted {
+		return "", ErrUserDeleted
+	}
+	return user.InfoHash, nil
+}
+
+func (l *NodeLedger) AddUserInfoToLedger(username *string, userhash *string) error {
+	return l.invoke("addUser", "addUser.js", *username, *userhash)
+}
+
+func (l *NodeLedger) UpdateLedgerUserinfo(username *string, userhash *string) error {
+	return l.invoke("changeUserInfoHash", "changeUserInfoHash.js", *username, *userhash)
+}
+
+// DeleteUser() launches deleteUser.js (the transaction is signed by admin)
+func (l *NodeLedger) DeleteUser(username *string) error {
+	return l.invoke("deleteUser", "deleteUser.js", *username)
+}
+
+// RevokeUser() launches revokeUser.js and removes the enrollment
+// of the user from hfc-key-store (see Enrollment())
+func (l *NodeLedger) RevokeUser(username *string) error {
+	output, err := l.run("revokeUser.js", *username)
+	if err != nil {
+		return err
+	}
+	if !strings.Contains(output, "Successfully revoked") {
+		return &TxError{Fcn: "revoke", Message: output}
+	}
+
+	storePath := filepath.Join(l.scriptsDir, "hfc-key-store")
+	userPath := filepath.Join(storePath, *username)
+	userBytes, err := ioutil.ReadFile(userPath)
+	if os.IsNotExist(err) {
+		// the enrollment was removed by the previous attempt
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	var user struct {
+		Enrollment struct {
+			SigningIdentity string `json:"signingIdentity"`
+		} `json:"enrollment"`
+	}
+	err = json.Unmarshal(userBytes, &user)
+	if err != nil {
+		return err
+	}
+
+	for _, suffix := range []string{"-priv", "-pub"} {
+		err = os.Remove(filepath.Join(storePath, user.Enrollment.SigningIdentity+suffix))
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	return os.Remove(userPath)
+}
+
+func (l *NodeLedger) QueryUsersPage(pageSize int, bookmark string) (*UserPage, error) {
+	output, err := l.run("queryUsersPage.js", strconv.Itoa(pageSize), bookmark)
+	if err != nil {
+		return nil, err
+	}
+	payload, err := queryResponse("queryUsersPage", output)
+	if err != nil {
+		return nil, err
+	}
+
+	var page UserPage
+	err = json.Unmarshal([]byte(payload), &page)
+	if err != nil {
+		return nil, err
+	}
+	return &page, nil
+}
+
+func (l *NodeLedger) CountUsers() (*UserCount, error) {
+	output, err := l.run("countUsers.js")
+	if err != nil {
+		return nil, err
+	}
+	payload, err := queryResponse("countUsers", output)
+	if err != nil {
+		return nil, err
+	}
+
+	var count UserCount
+	err = json.Unmarshal([]byte(payload), &count)
+	if err != nil {
+		return nil, err
+	}
+	return &count, nil
+}
+
+func (l *NodeLedger) GetUserHistory(username *string) ([]HistoryRecord, error) {
+	output, err := l.run("getUserHistory.js", *username)
+	if err != nil {
+		return nil, err
+	}
+	payload, err := queryResponse("getUserHistory", output)
+	if err != nil {
+		return nil, err
+	}
+
+	var history []HistoryRecord
+	err = json.Unmarshal([]byte(payload), &history)
+	if err != nil {
+		return nil, err
+	}
+	return history, nil
+}
+
+// Enrollment() reads the user enrollment from hfc-key-store of js scripts:
+// the file <username> contains the certificate and the id of the private key,
+// the file <id>-priv contains the private key
+func (l *NodeLedger) Enrollment(username *string) (*Enrollment, error) {
+	storePath := filepath.Join(l.scriptsDir, "hfc-key-store")
+
+	userBytes, err := ioutil.ReadFile(filepath.Join(storePath, *username))
+	if err != nil {
+		return nil, err
+	}
+
+	var user struct {
+		Enrollment struct {
+			SigningIdentity string `json:"signingIdentity"`
+			Identity        struct {
+				Certificate string `json:"certificate"`
+			} `json:"identity"`
+		} `json:"enrollment"`
+	}
+	err = json.Unmarshal(userBytes, &user)
+	if err != nil {
+		return nil, err
+	}
+
+	keyBytes, err := ioutil.ReadFile(filepath.Join(storePath, user.Enrollment.SigningIdentity+"-priv"))
+	if err != nil {
+		return nil, err
+	}
+
+	return &Enrollment{
+		Certificate: []byte(user.Enrollment.Identity.Certificate),
+		PrivateKey:  keyBytes,
+	}, nil
+}
@@ -1,69 +1,295 @@
 /*
 This package implements a connection between the offchain and onchain parts.
-Its main purpose is to provide maintenance of nodejs sdk
-(launching js scripts in a separate processes)
 
-There are a lot of duplicate stupid code here, but this code
-should be replaced by go sdk layer.
+The offchain service works with the ledger only through the Ledger interface,
+so the concrete way to reach the Fabric network (nodejs sdk scripts, go sdk, etc.)
+is a backend that is selected by name (see Register() and New()).
 */
 package onchain
 
 import (
-	"bytes"
 	"errors"
-	"os/exec"
+	"fmt"
+	"net/http"
 	"regexp"
+	"sort"
+	"time"
 )
 
-func EnrollAdmin() error {
-	outCmd := exec.Command("node", "../fabusers/enrollAdmin.js")
+// User is a value of the ledger record (see User struct of the fabusers chaincode)
+type User struct {
+	InfoHash string `json:"info_hash"`
 
-	var out bytes.Buffer
-	outCmd.Stdout = &out
-	err := outCmd.Run()
-	return err
+	// Deleted marks the tombstone of the deleted user (see deleteUser)
+	Deleted bool `json:"deleted,omitempty"`
 }
 
-func RegisterUser(username *string) error {
-	outCmd := exec.Command("node", "../fabusers/registerUser.js", *username)
+// UserRecord is an element of the user listing (see queryUsersPage chaincode function)
+type UserRecord struct {
+	Key    string
+	Record User
+}
+
+// limits of pages of the user listing (MAX_PAGE_SIZE is the limit of the chaincode)
+const (
+	DEFAULT_PAGE_SIZE = 100
+	MAX_PAGE_SIZE     = 1000
+)
 
-	var out bytes.Buffer
-	outCmd.Stdout = &out
-	err := outCmd.Run()
-	return err
+// UserPage is a page of the user listing (queryUsersPage chaincode function result)
+type UserPage struct {
+	Records []UserRecord `json:"records"`
+	Fetched int          `json:"fetched"`
+
+	// Bookmark is the start of the next page (empty for the last page)
+	Bookmark string `json:"bookmark"`
 }
 
-func GetUserhash(username *string) (string, error) {
-	outCmd := exec.Command("node", "../fabusers/query.js", *username)
-	var out bytes.Buffer
-	outCmd.Stdout = &out
-	err := outCmd.Run()
+// UserCount is the number of records of the ledger (countUsers chaincode function result)
+type UserCount struct {
+	Total int `json:"total"`
+
+	// Deleted is the number of tombstones among records
+	Deleted int `json:"deleted"`
+}
+
+// HistoryRecord is a change of the ledger record
+// (an element of getUserHistory chaincode function result)
+type HistoryRecord struct {
+	TxID string `json:"tx_id"`
+
+	// Timestamp is nil if the peer has no time of the transaction
+	Timestamp *time.Time `json:"timestamp,omitempty"`
+
+	InfoHash string `json:"info_hash"`
+
+	// Deleted is true for the tombstone written by deleteUser
+	Deleted bool `json:"deleted"`
+
+	// IsDelete is true if the key was removed from the world state
+	IsDelete bool `json:"is_delete"`
+}
+
+// ErrBadPoint is returned when the point of HistoryAt() is neither
+// a transaction id nor a userhash of the history nor a time
+var ErrBadPoint = errors.New("the point has to be a transaction id, a userhash or a time (RFC3339)")
+
+// ErrNoVersion is returned when there was no record at the point of HistoryAt()
+var ErrNoVersion = errors.New("there is no record at this point")
+
+// HistoryAt() returns the change of the history that was current at the point:
+// the transaction id, the userhash of the change or the time (RFC3339).
+// Changes without the time can't be found by the time, they are skipped
+func HistoryAt(history []HistoryRecord, at string) (*HistoryRecord, error) {
+	for i := len(history) - 1; i >= 0; i-- {
+		if history[i].TxID == at || history[i].InfoHash == at {
+			return &history[i], nil
+		}
+	}
+
+	point, err := time.Parse(time.RFC3339, at)
 	if err != nil {
-		return "", err
+		return nil, ErrBadPoint
 	}
-	output := out.String()
-	re := regexp.MustCompile("OK RESPONSE: \\{\"info_hash\":\"(.*?)\"\\}")
-	match := re.FindStringSubmatch(output)
+	for i := len(history) - 1; i >= 0; i-- {
+		if history[i].Timestamp != nil && !history[i].Timestamp.After(point) {
+			return &history[i], nil
+		}
+	}
+	return nil, ErrNoVersion
+}
+
+// ErrUserNotFound is returned when the ledger has no record for the username
+var ErrUserNotFound = errors.New("Check username")
+
+// ErrUserDeleted is returned when the ledger has the tombstone of the username
+var ErrUserDeleted = errors.New("user is deleted")
+
+// error codes of the fabusers chaincode: the message of the chaincode error
+// starts with the code, e.g. "NOT_FOUND: User ondar07 does not exist"
+const (
+	CODE_ALREADY_EXISTS   = "ALREADY_EXISTS"
+	CODE_NOT_FOUND        = "NOT_FOUND"
+	CODE_INVALID_ARGUMENT = "INVALID_ARGUMENT"
+	CODE_FORBIDDEN        = "FORBIDDEN" // the client identity isn't allowed by the access rules of the chaincode
+)
+
+var chaincodeErrorRe = regexp.MustCompile(`\b(ALREADY_EXISTS|NOT_FOUND|INVALID_ARGUMENT|FORBIDDEN): [^\n"]*`)
+
+// TxError describes a failed chaincode invocation
+type TxError struct {
+	Fcn     string // chaincode function
+	TxID    string // transaction id (empty if there is no transaction)
+	Status  string // status of the peer response or validation code
+	Code    string // error code of the chaincode (CODE_*, empty if there is no code)
+	Message string // message of the peer response
+	Err     error
+}
 
-	if len(match) == 0 {
-		return "", errors.New("Check username")
-	} else {
-		return match[1], nil
+// newChaincodeError() finds the chaincode error (the code and its message)
+// in the output of the sdk, nil if there is no chaincode error
+func newChaincodeError(fcn string, output string) *TxError {
+	match := chaincodeErrorRe.FindStringSubmatch(output)
+	if match == nil {
+		return nil
 	}
+	return &TxError{Fcn: fcn, Code: match[1], Message: match[0]}
 }
 
-func AddUserInfoToLedger(username *string, userhash *string) error {
-	outCmd := exec.Command("node", "../fabusers/addUser.js", *username, *userhash)
-	var out bytes.Buffer
-	outCmd.Stdout = &out
-	err := outCmd.Run()
-	return err
+// ErrorCode() returns the error code of the chaincode (empty for other errors)
+func ErrorCode(err error) string {
+	if txErr, ok := err.(*TxError); ok {
+		return txErr.Code
+	}
+	return ""
+}
+
+// HTTPStatus() maps the error of the ledger to the HTTP status code
+// (500 for errors that aren't caused by the request)
+func HTTPStatus(err error) int {
+	switch err {
+	case ErrUserNotFound:
+		return http.StatusNotFound
+	case ErrUserDeleted:
+		return http.StatusGone
+	}
+	switch ErrorCode(err) {
+	case CODE_ALREADY_EXISTS:
+		return http.StatusConflict
+	case CODE_NOT_FOUND:
+		return http.StatusNotFound
+	case CODE_INVALID_ARGUMENT:
+		return http.StatusBadRequest
+	case CODE_FORBIDDEN:
+		return http.StatusForbidden
+	}
+	return http.StatusInternalServerError
 }
 
-func UpdateLedgerUserinfo(username *string, userhash *string) error {
-	outCmd := exec.Command("node", "../fabusers/changeUserInfoHash.js", *username, *userhash)
-	var out bytes.Buffer
-	outCmd.Stdout = &out
-	err := outCmd.Run()
-	return err
+func (e *TxError) Error() string {
+	msg := fmt.Sprintf("%s failed", e.Fcn)
+	if e.TxID != "" {
+		msg += " (tx " + e.TxID + ")"
+	}
+	if e.Status != "" {
+		msg += ": status " + e.Status
+	}
+	if e.Message != "" {
+		msg += ": " + e.Message
+	}
+	if e.Err != nil {
+		msg += ": " + e.Err.Error()
+	}
+	return msg
+}
+
+// Ledger is a set of operations the offchain part needs from the onchain part.
+// The ledger is a key-value storage ('username': 'userhash')
+type Ledger interface {
+	// EnrollAdmin() enrolls admin entity of the Fabric
+	EnrollAdmin() error
+
+	// RegisterUser() registers and enrolls a new user (creates ca-cert)
+	RegisterUser(username *string) error
+
+	// GetUserhash() returns userhash stored in the ledger for this username
+	GetUserhash(username *string) (string, error)
+
+	// AddUserInfoToLedger() adds record (username + userhash) into the ledger
+	AddUserInfoToLedger(username *string, userhash *string) error
+
+	// UpdateLedgerUserinfo() changes userhash of the existing record
+	UpdateLedgerUserinfo(username *string, userhash *string) error
+
+	// DeleteUser() replaces the record by the tombstone (the username
+	// can't be used again, the last userhash stays in the ledger)
+	DeleteUser(username *string) error
+
+	// RevokeUser() revokes the CA identity of the user and destroys
+	// its enrollment private key
+	RevokeUser(username *string) error
+
+	// QueryUsersPage() returns a page of records of the ledger in the order
+	// of usernames, bookmark is the bookmark of the previous page
+	// (empty for the first page)
+	QueryUsersPage(pageSize int, bookmark string) (*UserPage, error)
+
+	// CountUsers() returns the number of records of the ledger
+	CountUsers() (*UserCount, error)
+
+	// GetUserHistory() returns all changes of the record of this username,
+	// the oldest first (empty for unknown username)
+	GetUserHistory(username *string) ([]HistoryRecord, error)
+
+	// Enrollment() returns the enrollment of the registered user
+	Enrollment(username *string) (*Enrollment, error)
+}
+
+// QueryAllUsers() pages through all records of the ledger
+func QueryAllUsers(ledger Ledger) ([]UserRecord, error) {
+	var records []UserRecord
+	bookmark := ""
+	for {
+		page, err := ledger.QueryUsersPage(MAX_PAGE_SIZE, bookmark)
+		if err != nil {
+			return nil, err
+		}
+		records = append(records, page.Records...)
+		// (the same bookmark would repeat the page forever)
+		if page.Bookmark == "" || page.Bookmark == bookmark {
+			return records, nil
+		}
+		bookmark = page.Bookmark
+	}
+}
+
+// Enrollment is a user identity issued by the CA (PEM encoded)
+type Enrollment struct {
+	Certificate []byte
+	PrivateKey  []byte
+}
+
+// Factory creates a Ledger backend.
+// options are backend specific settings (e.g. a path to the scripts directory)
+type Factory func(options map[string]string) (Ledger, error)
+
+var backends = make(map[string]Factory)
+
+// Register() makes a ledger backend available by the name.
+// It is intended to be called from init() of the file that implements the backend.
+func Register(name string, factory Factory) {
+	if factory == nil {
+		panic("onchain: Register factory is nil")
+	}
+	if _, dup := backends[name]; dup {
+		panic("onchain: Register called twice for backend " + name)
+	}
+	backends[name] = factory
+}
+
+// New() creates the ledger backend registered with this name
+func New(name string, options map[string]string) (Ledger, error) {
+	factory, ok := backends[name]
+	if !ok {
+		return nil, errors.New("unknown ledger backend: " + name)
+	}
+	return factory(options)
+}
+
+// option() returns options[key] or def if the option is not specified
+func option(options map[string]string, key string, def string) string {
+	if value, ok := options[key]; ok && value != "" {
+		return value
+	}
+	return def
+}
+
+// Backends() returns sorted names of all registered ledger backends
+func Backends() []string {
+	var names []string
+	for name := range backends {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
 }
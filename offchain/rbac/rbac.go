@@ -0,0 +1,150 @@
+/*
+This package implements role-based access control.
+
+A role is given to the caller (see auth package):
+
+	admin accounts have roles of their accounts (admin, auditor, support),
+	the user has the role "self" for his own record only.
+
+The policy table maps roles to operations. Every route of the mux requires
+an operation (see Protect()), Middleware() refuses requests of callers whose
+role doesn't allow it. Handlers check additional operations by Allowed()
+(e.g. decryption of private data on read).
+*/
+package rbac
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"goji.io"
+	"goji.io/middleware"
+	"goji.io/pat"
+
+	"../admin"
+	"../auth"
+)
+
+// the role of the user for his own record
+const ROLE_SELF = "self"
+
+// operations
+const (
+	OP_READ_PUBLIC  = "read_public"  // read the record (private data ciphered)
+	OP_READ_PRIVATE = "read_private" // decrypt private data
+	OP_UPDATE       = "update"       // change the record
+	OP_DELETE       = "delete"       // remove the user
+	OP_LIST         = "list"         // list users
+	OP_AUDIT        = "audit"        // reports, metrics
+	OP_MANAGE       = "manage"       // manage admin accounts
+	OP_SELF_SERVICE = "self_service" // change own profile and password
+	OP_DIFF         = "diff"         // compare versions of the record
+)
+
+// Policy maps roles to allowed operations
+var Policy = map[string][]string{
+	admin.ROLE_ADMIN:   {OP_READ_PUBLIC, OP_READ_PRIVATE, OP_UPDATE, OP_DELETE, OP_LIST, OP_AUDIT, OP_MANAGE, OP_DIFF},
+	admin.ROLE_AUDITOR: {OP_READ_PUBLIC, OP_LIST, OP_AUDIT},
+	admin.ROLE_SUPPORT: {OP_READ_PUBLIC, OP_UPDATE, OP_LIST},
+	ROLE_SELF:          {OP_READ_PUBLIC, OP_READ_PRIVATE, OP_SELF_SERVICE},
+}
+
+// route is a protected route of the mux
+type route struct {
+	op string
+
+	// the route has the :username parameter (the target user)
+	hasUsername bool
+}
+
+// Enforcer keeps operations of routes
+type Enforcer struct {
+	routes map[goji.Pattern]route
+}
+
+func New() *Enforcer {
+	return &Enforcer{routes: make(map[goji.Pattern]route)}
+}
+
+// Protect() makes the route require the operation,
+// routes that aren't protected are public
+func (e *Enforcer) Protect(pattern *pat.Pattern, op string) *pat.Pattern {
+	e.routes[pattern] = route{
+		op:          op,
+		hasUsername: strings.Contains(pattern.String(), "/:username"),
+	}
+	return pattern
+}
+
+type contextKey struct{}
+
+// Middleware() finds the account of the caller and checks the operation
+// of the matched route (it has to be used after auth.Authority.Middleware())
+func (e *Enforcer) Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		principal := auth.FromRequest(r)
+
+		// the account is read on every request, so a disabled account
+		// or a changed role takes effect at once
+		if principal.IsAdmin() {
+			account, err := admin.Find(principal.Name)
+			if err != nil || account.Disabled {
+				deny(w, http.StatusUnauthorized, "admin account is not available")
+				return
+			}
+			r = r.WithContext(context.WithValue(r.Context(), contextKey{}, account))
+		}
+
+		rt, ok := e.routes[middleware.Pattern(r.Context())]
+		if !ok {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		username := ""
+		if rt.hasUsername {
+			username = pat.Param(r, "username")
+		}
+		if !Allowed(r, username, rt.op) {
+			if principal == nil {
+				deny(w, http.StatusUnauthorized, "Authorization is required")
+			} else {
+				deny(w, http.StatusForbidden, "Operation "+rt.op+" is not allowed")
+			}
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// Role() returns the role of the caller for the record of username
+// (empty if the caller has no role)
+func Role(r *http.Request, username string) string {
+	principal := auth.FromRequest(r)
+	if principal.IsUser(username) {
+		return ROLE_SELF
+	}
+	if account, ok := r.Context().Value(contextKey{}).(*admin.Account); ok {
+		return account.Role
+	}
+	return ""
+}
+
+// Allowed() reports whether the caller may do the operation
+// with the record of username (empty username - any record)
+func Allowed(r *http.Request, username string, op string) bool {
+	for _, allowed := range Policy[Role(r, username)] {
+		if allowed == op {
+			return true
+		}
+	}
+	return false
+}
+
+func deny(w http.ResponseWriter, code int, message string) {
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.WriteHeader(code)
+	fmt.Fprintf(w, "{message: %q}", message)
+}
@@ -0,0 +1,169 @@
+package rbac
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+
+	"goji.io"
+	"goji.io/middleware"
+	"goji.io/pat"
+
+	"../admin"
+	"../auth"
+	"../crypdata"
+	"../onchain"
+)
+
+const TEST_PASSWORD = "password"
+
+func TestMain(m *testing.M) {
+	// weak parameters of password hashes keep tests fast
+	err := crypdata.SetPasswordParams(crypdata.PasswordParams{Memory: 64, Time: 1, Threads: 1, SaltLen: 16, KeyLen: 32})
+	if err == nil {
+		err = admin.Init(onchain.NewMemoryLedger(), admin.NewMemoryAccounts())
+	}
+	for _, role := range admin.Roles() {
+		if err == nil {
+			_, err = admin.Create(role, TEST_PASSWORD, role, "")
+		}
+	}
+	if err == nil {
+		_, err = admin.Create("disabled", TEST_PASSWORD, admin.ROLE_SUPPORT, "")
+	}
+	if err == nil {
+		_, err = admin.SetDisabled("disabled", true)
+	}
+	if err != nil {
+		panic(err)
+	}
+	os.Exit(m.Run())
+}
+
+// newTestMux() makes the mux with routes protected like the service does,
+// every handler reports whether the caller may decrypt private data
+func newTestMux(authority *auth.Authority) *goji.Mux {
+	guard := New()
+	adminAccounts := pat.Get("/admin/accounts")
+	mux := goji.NewMux()
+	mux.Use(authority.Middleware)
+	mux.Use(guard.Middleware)
+
+	handler := func(w http.ResponseWriter, r *http.Request) {
+		username := ""
+		if middleware.Pattern(r.Context()) != adminAccounts {
+			username = pat.Param(r, "username")
+		}
+		if Allowed(r, username, OP_READ_PRIVATE) {
+			w.Header().Set("X-Private", "true")
+		}
+	}
+	mux.HandleFunc(pat.Get("/version"), func(w http.ResponseWriter, r *http.Request) {})
+	mux.HandleFunc(guard.Protect(pat.Get("/users/:username"), OP_READ_PUBLIC), handler)
+	mux.HandleFunc(guard.Protect(pat.Put("/users/:username"), OP_UPDATE), handler)
+	mux.HandleFunc(guard.Protect(pat.Delete("/users/:username"), OP_DELETE), handler)
+	mux.HandleFunc(guard.Protect(pat.Put("/users/:username/password"), OP_SELF_SERVICE), handler)
+	mux.HandleFunc(guard.Protect(adminAccounts, OP_MANAGE), handler)
+	return mux
+}
+
+func TestMiddleware(t *testing.T) {
+	authority, err := auth.New()
+	if err != nil {
+		t.Fatal(err)
+	}
+	mux := newTestMux(authority)
+
+	tokens := map[string]string{"": ""}
+	for _, name := range []string{admin.ROLE_ADMIN, admin.ROLE_AUDITOR, admin.ROLE_SUPPORT, "disabled"} {
+		login, err := authority.Login(auth.PRINCIPAL_ADMIN, name, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		tokens[name] = login.AccessToken
+	}
+	login, err := authority.Login(auth.PRINCIPAL_USER, "ondar07", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tokens["ondar07"] = login.AccessToken
+
+	tests := []struct {
+		caller  string
+		method  string
+		path    string
+		code    int
+		private bool
+	}{
+		// public routes
+		{"", "GET", "/version", http.StatusOK, false},
+
+		// anonymous callers have no role
+		{"", "GET", "/users/ondar07", http.StatusUnauthorized, false},
+		{"", "PUT", "/users/ondar07/password", http.StatusUnauthorized, false},
+
+		// the user has the role only for his own record
+		{"ondar07", "GET", "/users/ondar07", http.StatusOK, true},
+		{"ondar07", "PUT", "/users/ondar07/password", http.StatusOK, true},
+		{"ondar07", "GET", "/users/alice", http.StatusForbidden, false},
+		{"ondar07", "PUT", "/users/alice/password", http.StatusForbidden, false},
+		{"ondar07", "PUT", "/users/ondar07", http.StatusForbidden, false},
+		{"ondar07", "DELETE", "/users/ondar07", http.StatusForbidden, false},
+		{"ondar07", "GET", "/admin/accounts", http.StatusForbidden, false},
+
+		// auditors read public data only
+		{admin.ROLE_AUDITOR, "GET", "/users/ondar07", http.StatusOK, false},
+		{admin.ROLE_AUDITOR, "PUT", "/users/ondar07", http.StatusForbidden, false},
+		{admin.ROLE_AUDITOR, "DELETE", "/users/ondar07", http.StatusForbidden, false},
+		{admin.ROLE_AUDITOR, "GET", "/admin/accounts", http.StatusForbidden, false},
+
+		// support updates records, but doesn't delete them
+		{admin.ROLE_SUPPORT, "GET", "/users/ondar07", http.StatusOK, false},
+		{admin.ROLE_SUPPORT, "PUT", "/users/ondar07", http.StatusOK, false},
+		{admin.ROLE_SUPPORT, "DELETE", "/users/ondar07", http.StatusForbidden, false},
+		{admin.ROLE_SUPPORT, "PUT", "/users/ondar07/password", http.StatusForbidden, false},
+
+		// admins don't change passwords of users (self-service only)
+		{admin.ROLE_ADMIN, "GET", "/users/ondar07", http.StatusOK, true},
+		{admin.ROLE_ADMIN, "DELETE", "/users/ondar07", http.StatusOK, true},
+		{admin.ROLE_ADMIN, "GET", "/admin/accounts", http.StatusOK, true},
+		{admin.ROLE_ADMIN, "PUT", "/users/ondar07/password", http.StatusForbidden, false},
+
+		// sessions of the disabled account are refused at once
+		{"disabled", "GET", "/users/ondar07", http.StatusUnauthorized, false},
+		{"disabled", "GET", "/version", http.StatusUnauthorized, false},
+	}
+
+	for _, test := range tests {
+		r := httptest.NewRequest(test.method, test.path, nil)
+		if tokens[test.caller] != "" {
+			r.Header.Set("Authorization", "Bearer "+tokens[test.caller])
+		}
+		w := httptest.NewRecorder()
+		mux.ServeHTTP(w, r)
+
+		if w.Code != test.code {
+			t.Errorf("%q %s %s: %d, want %d", test.caller, test.method, test.path, w.Code, test.code)
+		}
+		if private := w.Header().Get("X-Private") == "true"; private != test.private {
+			t.Errorf("%q %s %s: read_private is %v, want %v", test.caller, test.method, test.path, private, test.private)
+		}
+	}
+}
+
+func TestPolicy(t *testing.T) {
+	for _, role := range append(admin.Roles(), ROLE_SELF) {
+		if len(Policy[role]) == 0 {
+			t.Errorf("role %s has no operations", role)
+		}
+	}
+	// only admins manage accounts
+	for role, ops := range Policy {
+		for _, op := range ops {
+			if op == OP_MANAGE && role != admin.ROLE_ADMIN {
+				t.Errorf("role %s manages admin accounts", role)
+			}
+		}
+	}
+}
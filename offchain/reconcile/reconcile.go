@@ -0,0 +1,311 @@
+/*
+This package compares the ledger and the offchain db (reconciliation).
+
+Every ledger record ('username': 'userhash') has to point to the offchain
+record with this userhash, and every offchain record has to be pointed
+by the ledger record of its username. Mismatches are:
+
+	missing_offchain - the ledger userhash has no offchain record
+	                   (and there is no other record of the user)
+	hash_mismatch    - the ledger userhash has no offchain record,
+	                   but the offchain db has another record of the user
+	orphan_offchain  - the offchain record isn't pointed by the ledger
+
+Users with unfinished operations (see saga package) are skipped.
+
+The only repair that is safe is returning the ledger to the single intact
+offchain record of the user (hash_mismatch): it's what the compensation
+of the failed update does. The userhash of the record has to be the previous
+userhash of the ledger record (the failed update leaves it so): the userhash isn't
+keyed, so a record forged in the offchain db has an intact userhash too, but
+the ledger never had it, and an older record restored in the offchain db (e.g.
+with the old password) would roll the user back. The repair is run as
+an operation of the saga coordinator, so it doesn't race with other operations
+of the user. Other mismatches are reported for the admin.
+*/
+package reconcile
+
+import (
+	"log"
+	"sort"
+	"sync"
+	"time"
+
+	"../onchain"
+	"../saga"
+	"../store"
+	"../userinfo"
+)
+
+// kinds of discrepancies
+const (
+	MISSING_OFFCHAIN = "missing_offchain"
+	HASH_MISMATCH    = "hash_mismatch"
+	ORPHAN_OFFCHAIN  = "orphan_offchain"
+)
+
+// Discrepancy is a mismatch of the ledger and the offchain db
+type Discrepancy struct {
+	Kind     string
+	Username string
+
+	LedgerUserhash   string `json:",omitempty"`
+	OffchainUserhash string `json:",omitempty"`
+
+	Repairable bool
+	Repaired   bool
+	Reason     string `json:",omitempty"` // why the discrepancy isn't repairable
+	Error      string `json:",omitempty"`
+}
+
+// Report is a result of the reconciliation
+type Report struct {
+	Started  time.Time
+	Finished time.Time
+	Repair   bool
+
+	LedgerRecords   int
+	OffchainRecords int
+	Consistent      int // users whose ledger record points to their offchain record
+	InProgress      int // users with unfinished operations (skipped)
+
+	Discrepancies []Discrepancy
+}
+
+// Reconciler keeps the report of the last reconciliation
+type Reconciler struct {
+	users  store.UserStore
+	ledger onchain.Ledger
+	sagas  *saga.Coordinator
+
+	mu   sync.Mutex // one reconciliation at a time
+	last *Report
+}
+
+// New() creates the reconciler, users with unfinished operations
+// of the coordinator are skipped, repairs are run by it
+func New(users store.UserStore, sagas *saga.Coordinator) *Reconciler {
+	return &Reconciler{users: users, ledger: sagas.Ledger(), sagas: sagas}
+}
+
+// Last() returns the report of the last reconciliation (nil if there wasn't one)
+func (r *Reconciler) Last() *Report {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	return r.last
+}
+
+// Loop() reconciles every interval (it never returns)
+func (r *Reconciler) Loop(interval time.Duration, repair bool) {
+	for {
+		time.Sleep(interval)
+		report, err := r.Run(repair)
+		if err != nil {
+			log.Println("Failed reconcile: ", err)
+			continue
+		}
+		if len(report.Discrepancies) > 0 {
+			log.Println("Reconciliation found ", len(report.Discrepancies), " discrepancies")
+		}
+	}
+}
+
+// Run() walks both the ledger and the offchain db and classifies mismatches,
+// safe cases are repaired if repair is set
+func (r *Reconciler) Run(repair bool) (*Report, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	report := &Report{Started: time.Now().UTC(), Repair: repair}
+
+	busy := make(map[string]bool)
+	ops, err := r.sagas.Pending()
+	if err != nil {
+		return nil, err
+	}
+	for _, op := range ops {
+		busy[op.Username] = true
+	}
+
+	records, err := r.users.List()
+	if err != nil {
+		return nil, err
+	}
+	report.OffchainRecords = len(records)
+
+	// offchain records of every user (by username)
+	offchain := make(map[string][]userinfo.CipheredUserInfo)
+	for _, record := range records {
+		offchain[record.Username] = append(offchain[record.Username], record)
+	}
+
+	// the ledger records (username -> userhash)
+	ledgerRecords, err := onchain.QueryAllUsers(r.ledger)
+	if err != nil {
+		return nil, err
+	}
+	report.LedgerRecords = len(ledgerRecords)
+	ledger := make(map[string]string)
+	for _, record := range ledgerRecords {
+		// tombstones of deleted users have no offchain records
+		if record.Record.Deleted {
+			continue
+		}
+		ledger[record.Key] = record.Record.InfoHash
+	}
+	// users added while the ledger was paged through may be missed,
+	// so users of the offchain db are also queried one by one
+	for username := range offchain {
+		if _, ok := ledger[username]; ok {
+			continue
+		}
+		name := username
+		userhash, err := r.ledger.GetUserhash(&name)
+		if err == onchain.ErrUserNotFound || err == onchain.ErrUserDeleted {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		ledger[username] = userhash
+	}
+
+	usernames := make(map[string]bool)
+	for username := range ledger {
+		usernames[username] = true
+	}
+	for username := range offchain {
+		usernames[username] = true
+	}
+	sorted := make([]string, 0, len(usernames))
+	for username := range usernames {
+		sorted = append(sorted, username)
+	}
+	sort.Strings(sorted)
+
+	for _, username := range sorted {
+		if busy[username] {
+			report.InProgress++
+			continue
+		}
+		report.check(username, ledger, offchain[username])
+	}
+
+	for i := range report.Discrepancies {
+		r.checkHistory(&report.Discrepancies[i])
+	}
+
+	if repair {
+		for i := range report.Discrepancies {
+			r.repair(&report.Discrepancies[i])
+		}
+	}
+
+	report.Finished = time.Now().UTC()
+	r.last = report
+	return report, nil
+}
+
+// check() classifies the ledger record and offchain records of the user
+func (report *Report) check(username string, ledger map[string]string, records []userinfo.CipheredUserInfo) {
+	ledgerUserhash, onLedger := ledger[username]
+
+	pointed := false
+	for _, record := range records {
+		if onLedger && record.Userhash == ledgerUserhash {
+			pointed = true
+		}
+	}
+
+	if onLedger && len(records) == 0 {
+		report.add(Discrepancy{
+			Kind:           MISSING_OFFCHAIN,
+			Username:       username,
+			LedgerUserhash: ledgerUserhash,
+		})
+		return
+	}
+
+	if onLedger && !pointed {
+		d := Discrepancy{
+			Kind:           HASH_MISMATCH,
+			Username:       username,
+			LedgerUserhash: ledgerUserhash,
+		}
+		if len(records) == 1 {
+			d.OffchainUserhash = records[0].Userhash
+			d.Repairable = userinfo.ComputeUserhash(&records[0]) == records[0].Userhash
+			if !d.Repairable {
+				d.Reason = "the offchain record doesn't match its userhash"
+			}
+		} else {
+			d.Reason = "the user has several offchain records"
+		}
+		report.add(d)
+		return
+	}
+
+	if pointed {
+		report.Consistent++
+	}
+	for _, record := range records {
+		if pointed && record.Userhash == ledgerUserhash {
+			continue
+		}
+		report.add(Discrepancy{
+			Kind:             ORPHAN_OFFCHAIN,
+			Username:         username,
+			LedgerUserhash:   ledgerUserhash,
+			OffchainUserhash: record.Userhash,
+		})
+	}
+}
+
+func (report *Report) add(d Discrepancy) {
+	report.Discrepancies = append(report.Discrepancies, d)
+}
+
+// checkHistory() leaves the repairable discrepancy repairable only if
+// the userhash of the offchain record is the previous userhash of the ledger
+// record (the last change of the ledger history is the current userhash)
+func (r *Reconciler) checkHistory(d *Discrepancy) {
+	if !d.Repairable {
+		return
+	}
+	d.Repairable = false
+
+	history, err := r.ledger.GetUserHistory(&d.Username)
+	if err != nil {
+		d.Error = err.Error()
+		return
+	}
+	last := len(history) - 1
+	if last < 1 || history[last].InfoHash != d.LedgerUserhash {
+		d.Reason = "the ledger history has no previous userhash"
+		return
+	}
+	previous := history[last-1]
+	if previous.InfoHash != d.OffchainUserhash || previous.Deleted || previous.IsDelete {
+		d.Reason = "the offchain userhash isn't the previous ledger userhash"
+		return
+	}
+	d.Repairable = true
+}
+
+// repair() points the ledger to the offchain record of the user
+func (r *Reconciler) repair(d *Discrepancy) {
+	if !d.Repairable {
+		return
+	}
+	record, err := r.users.FindByUserhash(d.OffchainUserhash)
+	if err == nil {
+		_, err = r.sagas.Repair(record, d.LedgerUserhash)
+	}
+	if err != nil {
+		d.Error = err.Error()
+		return
+	}
+	d.Repaired = true
+	log.Println("Reconciliation: ledger record of ", d.Username, " is returned to ", d.OffchainUserhash)
+}
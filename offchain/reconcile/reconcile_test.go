@@ -0,0 +1,204 @@
+package reconcile
+
+import (
+	"testing"
+
+	"../onchain"
+	"../saga"
+	"../store"
+	"../userinfo"
+)
+
+type testEnv struct {
+	*Reconciler
+
+	users   *store.MemoryStore
+	ledger  *onchain.MemoryLedger
+	journal *saga.MemoryJournal
+}
+
+func newTestEnv(t *testing.T) *testEnv {
+	env := &testEnv{
+		users:   store.NewMemoryStore(),
+		ledger:  onchain.NewMemoryLedger(),
+		journal: saga.NewMemoryJournal(),
+	}
+	if err := env.ledger.EnrollAdmin(); err != nil {
+		t.Fatal(err)
+	}
+	sagas := saga.New(env.users, store.NewMemoryStore(), store.NewMemoryKeys(), env.ledger, env.journal)
+	sagas.MaxAttempts = 1
+	sagas.RetryDelay = 0
+	env.Reconciler = New(env.users, sagas)
+	return env
+}
+
+// newRecord() makes the record with the valid userhash
+func newRecord(username, email string) *userinfo.CipheredUserInfo {
+	record := &userinfo.CipheredUserInfo{Username: username, Email: email, Hashedpassword: "hash", Privdata: "00"}
+	userinfo.SetUserhash(record)
+	return record
+}
+
+// addUser() adds the user to the ledger with userhashes of the changes
+// (the last one is current) and the record to the offchain db (if it isn't nil)
+func (env *testEnv) addUser(t *testing.T, username string, record *userinfo.CipheredUserInfo, changes ...string) {
+	if err := env.ledger.RegisterUser(&username); err != nil {
+		t.Fatal(err)
+	}
+	for i := range changes {
+		var err error
+		if i == 0 {
+			err = env.ledger.AddUserInfoToLedger(&username, &changes[i])
+		} else {
+			err = env.ledger.UpdateLedgerUserinfo(&username, &changes[i])
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	if record != nil {
+		if err := env.users.Insert(record); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func (env *testEnv) run(t *testing.T, repair bool) *Report {
+	report, err := env.Run(repair)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return report
+}
+
+func (env *testEnv) checkLedger(t *testing.T, username string, want string) {
+	t.Helper()
+	userhash, err := env.ledger.GetUserhash(&username)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if userhash != want {
+		t.Fatalf("ledger userhash of %s: %s, want %s", username, userhash, want)
+	}
+}
+
+// discrepancy() returns the discrepancy of the user (nil if there is none)
+func discrepancy(report *Report, username string) *Discrepancy {
+	for i := range report.Discrepancies {
+		if report.Discrepancies[i].Username == username {
+			return &report.Discrepancies[i]
+		}
+	}
+	return nil
+}
+
+func TestRun(t *testing.T) {
+	env := newTestEnv(t)
+
+	consistent := newRecord("ondar07", "ondar07@mail.com")
+	env.addUser(t, "ondar07", consistent, consistent.Userhash)
+
+	// the ledger userhash has no record
+	env.addUser(t, "missing", nil, newRecord("missing", "x@y").Userhash)
+
+	// the record isn't in the ledger
+	orphan := newRecord("orphan", "orphan@mail.com")
+	if err := env.users.Insert(orphan); err != nil {
+		t.Fatal(err)
+	}
+
+	// the user has an unfinished operation
+	busy := newRecord("busy", "busy@mail.com")
+	env.addUser(t, "busy", busy, newRecord("busy", "new@mail.com").Userhash)
+	env.journal.Save(&saga.Operation{ID: "1", Kind: saga.KIND_UPDATE, Username: "busy", State: saga.STATE_PREPARED})
+
+	report := env.run(t, false)
+	if report.Consistent != 1 || report.InProgress != 1 || report.OffchainRecords != 3 || len(report.Discrepancies) != 2 {
+		t.Fatalf("report: %+v", report)
+	}
+	if d := discrepancy(report, "missing"); d == nil || d.Kind != MISSING_OFFCHAIN || d.Repairable {
+		t.Fatalf("discrepancy of missing: %+v", d)
+	}
+	if d := discrepancy(report, "orphan"); d == nil || d.Kind != ORPHAN_OFFCHAIN || d.OffchainUserhash != orphan.Userhash || d.Repairable {
+		t.Fatalf("discrepancy of orphan: %+v", d)
+	}
+	if env.Last() != report {
+		t.Fatal("Last() isn't the report of the last run")
+	}
+}
+
+func TestRepair(t *testing.T) {
+	env := newTestEnv(t)
+
+	// the failed update left the new userhash in the ledger
+	record := newRecord("ondar07", "ondar07@mail.com")
+	updated := newRecord("ondar07", "new@mail.com")
+	env.addUser(t, "ondar07", record, record.Userhash, updated.Userhash)
+
+	report := env.run(t, false)
+	d := discrepancy(report, "ondar07")
+	if d == nil || d.Kind != HASH_MISMATCH || !d.Repairable || d.Repaired {
+		t.Fatalf("discrepancy: %+v", d)
+	}
+	env.checkLedger(t, "ondar07", updated.Userhash)
+
+	report = env.run(t, true)
+	if d := discrepancy(report, "ondar07"); d == nil || !d.Repaired || d.Error != "" {
+		t.Fatalf("repaired discrepancy: %+v", d)
+	}
+	env.checkLedger(t, "ondar07", record.Userhash)
+
+	// the repair is run by the coordinator and finished
+	if ops, _ := env.journal.Pending(); len(ops) != 0 {
+		t.Fatalf("journal has %d operations", len(ops))
+	}
+	report = env.run(t, true)
+	if report.Consistent != 1 || len(report.Discrepancies) != 0 {
+		t.Fatalf("report after the repair: %+v", report)
+	}
+}
+
+func TestRepairRefused(t *testing.T) {
+	env := newTestEnv(t)
+
+	// the old record restored in the offchain db (e.g. with the old password)
+	// would roll the user back
+	restored := newRecord("restored", "old@mail.com")
+	env.addUser(t, "restored", restored,
+		restored.Userhash,
+		newRecord("restored", "second@mail.com").Userhash,
+		newRecord("restored", "third@mail.com").Userhash)
+
+	// the ledger never had the userhash of the forged record
+	forged := newRecord("forged", "evil@mail.com")
+	env.addUser(t, "forged", forged, newRecord("forged", "x@y").Userhash)
+
+	// the record doesn't match its userhash
+	tampered := newRecord("tampered", "tampered@mail.com")
+	tamperedHash := tampered.Userhash
+	tampered.Email = "evil@mail.com"
+	env.addUser(t, "tampered", tampered, tamperedHash, newRecord("tampered", "new@mail.com").Userhash)
+
+	// the user has several records
+	first := newRecord("several", "first@mail.com")
+	second := newRecord("several", "second@mail.com")
+	env.addUser(t, "several", first, first.Userhash, newRecord("several", "new@mail.com").Userhash)
+	if err := env.users.Insert(second); err != nil {
+		t.Fatal(err)
+	}
+
+	ledgerUserhashes := make(map[string]string)
+	for _, username := range []string{"restored", "forged", "tampered", "several"} {
+		ledgerUserhashes[username], _ = env.ledger.GetUserhash(&username)
+	}
+
+	report := env.run(t, true)
+	for username, userhash := range ledgerUserhashes {
+		d := discrepancy(report, username)
+		if d == nil || d.Kind != HASH_MISMATCH || d.Repairable || d.Repaired || d.Reason == "" {
+			t.Errorf("discrepancy of %s: %+v", username, d)
+		}
+		env.checkLedger(t, username, userhash)
+	}
+}
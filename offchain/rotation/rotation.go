@@ -0,0 +1,393 @@
+/*
+This package re-encrypts private data of all offchain db records by a new
+crypdata key (key rotation).
+
+Userhash is a hash of the ciphered private data, so every record gets a new
+userhash and the ledger record of the user is changed too (changeUserInfoHash).
+The new record is a new version (see store.VersionStore), it's saved before
+the ledger gets its userhash. The old record is saved as a version too
+(records saved before versions have no version).
+
+Every record goes through the states prepared -> ledger -> done, the state
+is saved to the progress file after every step. If rotation is interrupted,
+it can be launched again with the same progress file and it continues from
+the saved state (a prepared record is reused, so the ledger gets the same userhash).
+
+A record is rotated only if it matches the ledger userhash of its user
+(see userinfo.CheckIntegrity()): the new userhash of a record changed in the
+offchain db bypassing the ledger (or of a record missing from the ledger) would
+make the change legitimate in the ledger. Such records are reported as failures.
+
+Records encrypted by data keys of users aren't changed: data keys (see
+store.KeyStore) are re-wrapped by the new key before records are rotated.
+A key which is wrapped by the new key already is left as is, so interrupted
+rotation re-wraps only the rest of keys.
+*/
+package rotation
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"os"
+
+	"../crypdata"
+	"../onchain"
+	"../store"
+	"../userinfo"
+)
+
+// states of the record rotation
+const (
+	STATE_PREPARED = "prepared" // the new record is built
+	STATE_LEDGER   = "ledger"   // the ledger has the new userhash
+	STATE_DONE     = "done"     // the offchain db has the new record
+)
+
+type Options struct {
+	// DryRun only checks that all records can be rotated, nothing is changed
+	DryRun bool
+
+	// ProgressPath is a file with states of records (empty - don't save progress)
+	ProgressPath string
+}
+
+// Step is a rotation state of one record
+type Step struct {
+	Username    string
+	OldUserhash string
+	NewUserhash string
+	State       string
+
+	// the new record (it is kept until the offchain db is updated)
+	Record *userinfo.CipheredUserInfo `json:",omitempty"`
+
+	// the password hash of the new record (records are encoded without it)
+	Hashedpassword string `json:",omitempty"`
+}
+
+// Failure describes the record which can't be rotated
+type Failure struct {
+	Username string
+	Userhash string
+	Error    string
+}
+
+// Report is a result of the rotation
+type Report struct {
+	DryRun bool
+
+	Total   int // records in the offchain db
+	Rotated int // records rotated by this launch
+	Done    int // records rotated before (by the interrupted launch)
+	Pending int // records that would be rotated (dry run)
+	Skipped int // records encrypted to user keys (the service key doesn't protect them)
+
+	Unchanged int // records encrypted by data keys of users
+	Rewrapped int // data keys re-wrapped by the new key (or would be re-wrapped by dry run)
+
+	Failed []Failure
+}
+
+// progress is a set of steps (by old userhash) saved to the file
+type progress struct {
+	path  string
+	Steps map[string]*Step
+}
+
+// Rotate() re-wraps data keys of users and re-encrypts private data of all
+// records from oldKey to newKey and updates the offchain db and the ledger.
+// newKey can be nil for dry run
+func Rotate(users store.UserStore, versions store.VersionStore, keys store.KeyStore, ledger onchain.Ledger, oldKey, newKey *crypdata.Key, options Options) (*Report, error) {
+	prog, err := loadProgress(options.ProgressPath)
+	if err != nil {
+		return nil, err
+	}
+
+	report := &Report{DryRun: options.DryRun}
+	err = rewrap(keys, oldKey, newKey, report)
+	if err != nil {
+		return report, err
+	}
+
+	// userhashes of already rotated records
+	rotated := make(map[string]bool)
+	for _, step := range prog.Steps {
+		if step.State == STATE_DONE {
+			rotated[step.NewUserhash] = true
+		}
+	}
+
+	records, err := users.List()
+	if err != nil {
+		return nil, err
+	}
+
+	report.Total = len(records)
+	for i := range records {
+		user := &records[i]
+
+		if rotated[user.Userhash] {
+			report.Done++
+			continue
+		}
+
+		step, ok := prog.Steps[user.Userhash]
+		if !ok {
+			step, err = prepare(user, oldKey, newKey, options.DryRun)
+			if err == errAlreadyRotated {
+				report.Done++
+				continue
+			}
+			if err == crypdata.ErrUserKeyRequired {
+				report.Skipped++
+				continue
+			}
+			if err == crypdata.ErrDataKeyRequired {
+				report.Unchanged++
+				continue
+			}
+			if err == nil {
+				err = checkLedger(ledger, user, nil)
+			}
+			if err != nil {
+				report.fail(user, err)
+				continue
+			}
+			if options.DryRun {
+				report.Pending++
+				continue
+			}
+			prog.Steps[user.Userhash] = step
+			if err = prog.save(); err != nil {
+				return report, err
+			}
+		} else if err = checkLedger(ledger, user, step); err != nil {
+			report.fail(user, err)
+			continue
+		}
+
+		if options.DryRun {
+			report.Pending++
+			continue
+		}
+
+		err = apply(users, versions, ledger, step, prog)
+		if err != nil {
+			report.fail(user, err)
+			continue
+		}
+		report.Rotated++
+	}
+
+	return report, nil
+}
+
+var errAlreadyRotated = errors.New("record is encrypted by the new key already")
+
+var errLedgerMismatch = errors.New("record doesn't match the ledger")
+
+// checkLedger() verifies the record by the ledger userhash of its user.
+// The ledger has the new userhash of the step if the interrupted launch
+// updated the ledger, but didn't save the state
+func checkLedger(ledger onchain.Ledger, user *userinfo.CipheredUserInfo, step *Step) error {
+	userhash, err := ledger.GetUserhash(&user.Username)
+	if err != nil {
+		return err
+	}
+	if step != nil && userhash == step.NewUserhash {
+		userhash = step.OldUserhash
+	}
+	if userinfo.CheckIntegrity(user, user.Username, userhash) != userinfo.INTEGRITY_VERIFIED {
+		return errLedgerMismatch
+	}
+	return nil
+}
+
+// rewrap() re-wraps data keys of users by the new key
+func rewrap(keys store.KeyStore, oldKey, newKey *crypdata.Key, report *Report) error {
+	dataKeys, err := keys.List()
+	if err != nil {
+		return err
+	}
+
+	for i := range dataKeys {
+		key := &dataKeys[i]
+		failure := Failure{Username: key.Username}
+
+		wrapped, err := hex.DecodeString(key.Wrapped)
+		var dataKey []byte
+		if err == nil {
+			dataKey, err = oldKey.Decrypt(wrapped)
+		}
+		if err != nil && newKey != nil {
+			if _, newErr := newKey.Decrypt(wrapped); newErr == nil {
+				// the key was re-wrapped by the interrupted launch
+				continue
+			}
+		}
+		if err == nil && !report.DryRun {
+			wrapped, err = newKey.Encrypt(dataKey)
+			if err == nil {
+				key.Wrapped = hex.EncodeToString(wrapped)
+				err = keys.Replace(key)
+			}
+		}
+		if err != nil {
+			failure.Error = "data key: " + err.Error()
+			report.Failed = append(report.Failed, failure)
+			continue
+		}
+		report.Rewrapped++
+	}
+	return nil
+}
+
+// prepare() builds the record with private data encrypted by the new key
+func prepare(user *userinfo.CipheredUserInfo, oldKey, newKey *crypdata.Key, dryRun bool) (*Step, error) {
+	// the service key doesn't protect data encrypted to the user key,
+	// data keys are re-wrapped instead of records
+	if user.Userkey != "" {
+		return nil, crypdata.ErrUserKeyRequired
+	}
+	if user.Keyformat == userinfo.KEYFORMAT_DATA_KEY {
+		return nil, crypdata.ErrDataKeyRequired
+	}
+
+	ciphertext, err := hex.DecodeString(user.Privdata)
+	if err != nil {
+		return nil, err
+	}
+
+	plaintext, err := oldKey.Decrypt(ciphertext)
+	if err != nil {
+		// the progress file is lost, but the record is rotated
+		if newKey != nil {
+			if _, newErr := newKey.Decrypt(ciphertext); newErr == nil {
+				return nil, errAlreadyRotated
+			}
+		}
+		return nil, err
+	}
+
+	if dryRun {
+		return nil, nil
+	}
+
+	newCiphertext, err := newKey.Encrypt(plaintext)
+	if err != nil {
+		return nil, err
+	}
+
+	record := *user
+	record.Privdata = hex.EncodeToString(newCiphertext)
+	userinfo.SetUserhash(&record)
+
+	return &Step{
+		Username:    user.Username,
+		OldUserhash: user.Userhash,
+		NewUserhash: record.Userhash,
+		State:       STATE_PREPARED,
+		Record:      &record,
+
+		Hashedpassword: record.Hashedpassword,
+	}, nil
+}
+
+// apply() updates the ledger and the offchain db, the state is saved after every step
+func apply(users store.UserStore, versions store.VersionStore, ledger onchain.Ledger, step *Step, prog *progress) error {
+	if step.State == STATE_PREPARED {
+		// the old record is replaced by the last step, so it's kept now
+		// (it's verified by the ledger, see checkLedger())
+		old, err := users.FindByUserhash(step.OldUserhash)
+		if err == nil {
+			err = versions.Insert(old)
+		}
+		if err != nil && err != store.ErrDuplicate && err != store.ErrNotFound {
+			return err
+		}
+
+		err = versions.Insert(step.Record)
+		if err != nil && err != store.ErrDuplicate {
+			return err
+		}
+		err = ledger.UpdateLedgerUserinfo(&step.Username, &step.NewUserhash)
+		if err != nil {
+			return err
+		}
+		step.State = STATE_LEDGER
+		if err = prog.save(); err != nil {
+			return err
+		}
+	}
+
+	if step.State == STATE_LEDGER {
+		err := users.Replace(step.OldUserhash, step.Record)
+		if err == store.ErrNotFound {
+			// the record was updated, but the state wasn't saved
+			_, err = users.FindByUserhash(step.NewUserhash)
+		}
+		if err != nil {
+			return err
+		}
+		step.State = STATE_DONE
+		step.Record = nil
+		step.Hashedpassword = ""
+		if err = prog.save(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (r *Report) fail(user *userinfo.CipheredUserInfo, err error) {
+	r.Failed = append(r.Failed, Failure{
+		Username: user.Username,
+		Userhash: user.Userhash,
+		Error:    err.Error(),
+	})
+}
+
+func loadProgress(path string) (*progress, error) {
+	prog := &progress{path: path, Steps: make(map[string]*Step)}
+	if path == "" {
+		return prog, nil
+	}
+
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return prog, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	err = json.Unmarshal(data, &prog.Steps)
+	if err != nil {
+		return nil, err
+	}
+	for _, step := range prog.Steps {
+		if step.Record != nil {
+			step.Record.Hashedpassword = step.Hashedpassword
+		}
+	}
+	return prog, nil
+}
+
+// save() rewrites the progress file atomically
+func (p *progress) save() error {
+	if p.path == "" {
+		return nil
+	}
+
+	data, err := json.MarshalIndent(p.Steps, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmpPath := p.path + ".tmp"
+	err = ioutil.WriteFile(tmpPath, data, 0600)
+	if err != nil {
+		return err
+	}
+	return os.Rename(tmpPath, p.path)
+}
@@ -0,0 +1,270 @@
+package rotation
+
+import (
+	"encoding/hex"
+	"path/filepath"
+	"testing"
+
+	"../crypdata"
+	"../onchain"
+	"../store"
+	"../userinfo"
+)
+
+// testEnv is the offchain db and the ledger with keys of the rotation
+type testEnv struct {
+	users    *store.MemoryStore
+	versions *store.MemoryStore
+	keys     *store.MemoryKeys
+	ledger   *onchain.MemoryLedger
+
+	oldKey, newKey *crypdata.Key
+}
+
+func newTestEnv(t *testing.T) *testEnv {
+	dir := t.TempDir()
+	oldKey, err := crypdata.LoadKey(filepath.Join(dir, "old.pem"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	newKey, err := crypdata.LoadKey(filepath.Join(dir, "new.pem"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	ledger := onchain.NewMemoryLedger()
+	if err := ledger.EnrollAdmin(); err != nil {
+		t.Fatal(err)
+	}
+	return &testEnv{
+		users:    store.NewMemoryStore(),
+		versions: store.NewMemoryStore(),
+		keys:     store.NewMemoryKeys(),
+		ledger:   ledger,
+		oldKey:   oldKey,
+		newKey:   newKey,
+	}
+}
+
+// addRecord() adds the record encrypted by the old key to the offchain db
+// and its userhash to the ledger (if inLedger is set)
+func (env *testEnv) addRecord(t *testing.T, username string, inLedger bool) *userinfo.CipheredUserInfo {
+	ciphertext, err := env.oldKey.Encrypt([]byte(`["` + username + `"]`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	record := &userinfo.CipheredUserInfo{
+		Username:       username,
+		Email:          username + "@mail.com",
+		Hashedpassword: "hash",
+		Privdata:       hex.EncodeToString(ciphertext),
+		Privformat:     userinfo.PRIVFORMAT_JSON,
+	}
+	userinfo.SetUserhash(record)
+	if err := env.users.Insert(record); err != nil {
+		t.Fatal(err)
+	}
+	if inLedger {
+		if err := env.ledger.RegisterUser(&username); err != nil {
+			t.Fatal(err)
+		}
+		if err := env.ledger.AddUserInfoToLedger(&username, &record.Userhash); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return record
+}
+
+func (env *testEnv) rotate(t *testing.T, options Options) *Report {
+	report, err := Rotate(env.users, env.versions, env.keys, env.ledger, env.oldKey, env.newKey, options)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return report
+}
+
+// checkRotated() fails the test if the current record of the user isn't
+// encrypted by the new key or the ledger doesn't point to it
+func (env *testEnv) checkRotated(t *testing.T, username string) {
+	t.Helper()
+	userhash, err := env.ledger.GetUserhash(&username)
+	if err != nil {
+		t.Fatal(err)
+	}
+	record, err := env.users.FindByUserhash(userhash)
+	if err != nil {
+		t.Fatalf("record of %s isn't found by the ledger userhash: %v", username, err)
+	}
+	if userinfo.CheckIntegrity(record, username, userhash) != userinfo.INTEGRITY_VERIFIED {
+		t.Fatalf("record of %s doesn't match the ledger", username)
+	}
+	ciphertext, _ := hex.DecodeString(record.Privdata)
+	plaintext, err := env.newKey.Decrypt(ciphertext)
+	if err != nil || string(plaintext) != `["`+username+`"]` {
+		t.Fatalf("private data of %s: %q, %v", username, plaintext, err)
+	}
+	if _, err := env.versions.FindByUserhash(userhash); err != nil {
+		t.Fatalf("the new record of %s isn't a version: %v", username, err)
+	}
+}
+
+// checkFailed() fails the test if the report doesn't list exactly these users as failed
+func checkFailed(t *testing.T, report *Report, usernames ...string) {
+	t.Helper()
+	failed := make(map[string]bool)
+	for _, failure := range report.Failed {
+		failed[failure.Username] = true
+	}
+	if len(report.Failed) != len(usernames) {
+		t.Fatalf("failed: %+v, want %v", report.Failed, usernames)
+	}
+	for _, username := range usernames {
+		if !failed[username] {
+			t.Fatalf("failed: %+v, want %v", report.Failed, usernames)
+		}
+	}
+}
+
+func TestRotate(t *testing.T) {
+	env := newTestEnv(t)
+	first := env.addRecord(t, "ondar07", true)
+	env.addRecord(t, "alice", true)
+
+	// the data key is re-wrapped, its record isn't changed
+	dataKey, err := crypdata.NewDataKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	wrapped, err := env.oldKey.Encrypt(dataKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := env.keys.Insert(&store.DataKey{Username: "bob", Wrapped: hex.EncodeToString(wrapped)}); err != nil {
+		t.Fatal(err)
+	}
+	bob := &userinfo.CipheredUserInfo{Username: "bob", Privdata: "abcd", Keyformat: userinfo.KEYFORMAT_DATA_KEY}
+	userinfo.SetUserhash(bob)
+	if err := env.users.Insert(bob); err != nil {
+		t.Fatal(err)
+	}
+
+	report := env.rotate(t, Options{})
+	if report.Total != 3 || report.Rotated != 2 || report.Unchanged != 1 || report.Rewrapped != 1 {
+		t.Fatalf("report: %+v", report)
+	}
+	checkFailed(t, report)
+	env.checkRotated(t, "ondar07")
+	env.checkRotated(t, "alice")
+
+	// the old record is kept as a version
+	if _, err := env.versions.FindByUserhash(first.Userhash); err != nil {
+		t.Fatalf("the old record isn't a version: %v", err)
+	}
+	key, err := env.keys.Find("bob")
+	if err != nil {
+		t.Fatal(err)
+	}
+	wrapped, _ = hex.DecodeString(key.Wrapped)
+	if unwrapped, err := env.newKey.Decrypt(wrapped); err != nil || string(unwrapped) != string(dataKey) {
+		t.Fatalf("the data key isn't re-wrapped by the new key: %v", err)
+	}
+
+	// the second launch finds records rotated
+	report = env.rotate(t, Options{})
+	if report.Rotated != 0 || report.Done != 2 || report.Rewrapped != 0 {
+		t.Fatalf("report of the second launch: %+v", report)
+	}
+}
+
+func TestRotateTampered(t *testing.T) {
+	env := newTestEnv(t)
+	env.addRecord(t, "ondar07", true)
+
+	// the record changed bypassing the ledger
+	tampered := env.addRecord(t, "alice", true)
+	changed := *tampered
+	changed.Email = "evil@mail.com"
+	if err := env.users.Replace(tampered.Userhash, &changed); err != nil {
+		t.Fatal(err)
+	}
+
+	// the record missing from the ledger
+	orphan := env.addRecord(t, "orphan", false)
+
+	// the record of other user with the userhash of the ledger record of mallory
+	mallory := "mallory"
+	if err := env.ledger.RegisterUser(&mallory); err != nil {
+		t.Fatal(err)
+	}
+	alien := env.addRecord(t, "eve", false)
+	if err := env.ledger.AddUserInfoToLedger(&mallory, &alien.Userhash); err != nil {
+		t.Fatal(err)
+	}
+
+	// dry run reports them too
+	report := env.rotate(t, Options{DryRun: true})
+	if report.Pending != 1 {
+		t.Fatalf("dry run report: %+v", report)
+	}
+	checkFailed(t, report, "alice", "orphan", "eve")
+
+	report = env.rotate(t, Options{})
+	if report.Rotated != 1 {
+		t.Fatalf("report: %+v", report)
+	}
+	checkFailed(t, report, "alice", "orphan", "eve")
+	env.checkRotated(t, "ondar07")
+
+	// the ledger keeps userhashes of the untouched records
+	username := "alice"
+	if userhash, err := env.ledger.GetUserhash(&username); err != nil || userhash != tampered.Userhash {
+		t.Fatalf("ledger userhash of alice: %s, %v", userhash, err)
+	}
+	if record, err := env.users.FindByUserhash(tampered.Userhash); err != nil || record.Privdata != tampered.Privdata {
+		t.Fatalf("the tampered record is changed: %+v, %v", record, err)
+	}
+	if record, err := env.users.FindByUserhash(orphan.Userhash); err != nil || record.Privdata != orphan.Privdata {
+		t.Fatalf("the orphan record is changed: %+v, %v", record, err)
+	}
+	if userhash, err := env.ledger.GetUserhash(&mallory); err != nil || userhash != alien.Userhash {
+		t.Fatalf("ledger userhash of mallory: %s, %v", userhash, err)
+	}
+}
+
+func TestRotateResume(t *testing.T) {
+	env := newTestEnv(t)
+	record := env.addRecord(t, "ondar07", true)
+	env.addRecord(t, "alice", true)
+	path := filepath.Join(t.TempDir(), "progress.json")
+
+	// the interrupted launch updated the ledger, but didn't save the state
+	step, err := prepare(record, env.oldKey, env.newKey, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	prog := &progress{path: path, Steps: map[string]*Step{record.Userhash: step}}
+	if err := prog.save(); err != nil {
+		t.Fatal(err)
+	}
+	if err := env.ledger.UpdateLedgerUserinfo(&step.Username, &step.NewUserhash); err != nil {
+		t.Fatal(err)
+	}
+
+	report := env.rotate(t, Options{ProgressPath: path})
+	if report.Rotated != 2 {
+		t.Fatalf("report: %+v", report)
+	}
+	checkFailed(t, report)
+	env.checkRotated(t, "ondar07")
+	env.checkRotated(t, "alice")
+
+	// the ledger userhash is the prepared one
+	username := "ondar07"
+	if userhash, _ := env.ledger.GetUserhash(&username); userhash != step.NewUserhash {
+		t.Fatalf("ledger userhash: %s, want the prepared %s", userhash, step.NewUserhash)
+	}
+
+	report = env.rotate(t, Options{ProgressPath: path})
+	if report.Rotated != 0 || report.Done != 2 {
+		t.Fatalf("report of the next launch: %+v", report)
+	}
+}
@@ -0,0 +1,112 @@
+package saga
+
+import (
+	"sort"
+	"sync"
+
+	"gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+)
+
+// Journal keeps unfinished operations
+type Journal interface {
+	// Save() inserts or replaces the operation
+	Save(op *Operation) error
+
+	// Delete() removes the finished operation
+	Delete(id string) error
+
+	// Pending() returns all operations (the oldest first)
+	Pending() ([]*Operation, error)
+}
+
+// MongoJournal keeps operations in the mongodb collection
+type MongoJournal struct {
+	session    *mgo.Session
+	database   string
+	collection string
+}
+
+// NewMongoJournal() uses the existing session,
+// every operation works with a copy of it
+func NewMongoJournal(session *mgo.Session, database, collection string) *MongoJournal {
+	return &MongoJournal{
+		session:    session,
+		database:   database,
+		collection: collection,
+	}
+}
+
+func (j *MongoJournal) with(f func(c *mgo.Collection) error) error {
+	session := j.session.Copy()
+	defer session.Close()
+
+	return f(session.DB(j.database).C(j.collection))
+}
+
+func (j *MongoJournal) Save(op *Operation) error {
+	return j.with(func(c *mgo.Collection) error {
+		_, err := c.UpsertId(op.ID, op)
+		return err
+	})
+}
+
+func (j *MongoJournal) Delete(id string) error {
+	return j.with(func(c *mgo.Collection) error {
+		err := c.RemoveId(id)
+		if err == mgo.ErrNotFound {
+			return nil
+		}
+		return err
+	})
+}
+
+func (j *MongoJournal) Pending() ([]*Operation, error) {
+	var ops []*Operation
+	err := j.with(func(c *mgo.Collection) error {
+		return c.Find(bson.M{}).Sort("created").All(&ops)
+	})
+	return ops, err
+}
+
+// MemoryJournal keeps operations in the process memory
+// (they are lost on crash, so it's ONLY for tests and local development)
+type MemoryJournal struct {
+	mu  sync.Mutex
+	ops map[string]Operation
+}
+
+func NewMemoryJournal() *MemoryJournal {
+	return &MemoryJournal{ops: make(map[string]Operation)}
+}
+
+func (j *MemoryJournal) Save(op *Operation) error {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	j.ops[op.ID] = *op
+	return nil
+}
+
+func (j *MemoryJournal) Delete(id string) error {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	delete(j.ops, id)
+	return nil
+}
+
+func (j *MemoryJournal) Pending() ([]*Operation, error) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	ops := make([]*Operation, 0, len(j.ops))
+	for _, op := range j.ops {
+		op := op
+		ops = append(ops, &op)
+	}
+	sort.Slice(ops, func(i, k int) bool {
+		return ops[i].Created.Before(ops[k].Created)
+	})
+	return ops, nil
+}
@@ -0,0 +1,685 @@
+/*
+This package runs changes of a user as durable multi-step operations (sagas).
+
+A change touches two storages: the offchain db (store.UserStore and
+store.VersionStore) and the ledger. A new version of the record is saved
+before the ledger gets its userhash, so every userhash of the ledger
+history has its version. The changed record is saved as a version too
+(records saved before versions have no version).
+Every operation is saved to the journal before the first side effect and after
+every step, so the service that crashed in the middle of the operation
+continues it on start (see Recover()).
+
+	create: started -> prepared -> stored (offchain db) -> done (ledger)
+	update: prepared -> ledger (version, ledger) -> done (offchain db)
+	delete: prepared -> shredded (CA identity, data key) -> removed (offchain db, all versions) -> done (ledger)
+	repair: prepared -> done (ledger, see reconcile package)
+
+A failed step is retried (MaxAttempts), then the failed and the completed steps
+are undone by compensating actions in the reverse order (the record and its
+version are removed from the offchain db, the old userhash is returned to
+the ledger) and the operation is aborted. So the offchain db and the ledger
+never stay diverged. The ledger transaction can be committed despite the error,
+so the ledger is checked after a failed ledger step (the step is made
+if the ledger has the new userhash) and by compensating actions: the record
+of the created user isn't removed if the ledger has its userhash, the operation
+is finished instead.
+Deletion can't be undone (the keys are destroyed by the first step), so the failed
+deletion stays in the journal and is continued by Recover().
+Finished (done or aborted) operations are removed from the journal.
+*/
+package saga
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+
+	"../onchain"
+	"../store"
+	"../userinfo"
+)
+
+// kinds of operations
+const (
+	KIND_CREATE = "create"
+	KIND_UPDATE = "update"
+	KIND_DELETE = "delete"
+	KIND_REPAIR = "repair"
+)
+
+// states of operations
+const (
+	STATE_STARTED      = "started"      // create: the user is being registered, the record isn't built yet
+	STATE_PREPARED     = "prepared"     // the new record is built
+	STATE_STORED       = "stored"       // create: the offchain db has the record
+	STATE_LEDGER       = "ledger"       // update: the ledger has the new userhash
+	STATE_SHREDDED     = "shredded"     // delete: the CA identity is revoked, the data key is destroyed
+	STATE_REMOVED      = "removed"      // delete: the offchain db has no record
+	STATE_DONE         = "done"         // both storages are changed
+	STATE_COMPENSATING = "compensating" // the failed and completed steps are being undone
+	STATE_ABORTED      = "aborted"      // completed steps are undone
+)
+
+const (
+	DEFAULT_MAX_ATTEMPTS      = 3
+	DEFAULT_RETRY_DELAY       = time.Second
+	DEFAULT_RECOVERY_INTERVAL = time.Minute
+)
+
+// ErrUserExists is returned when the ledger has a record of the new user
+var ErrUserExists = errors.New("user already exists")
+
+// ErrInProgress is returned when there is an unfinished operation of the user
+var ErrInProgress = errors.New("another operation of the user is in progress")
+
+// errLedgerMade is returned by the compensating action when the ledger
+// has the userhash of the new record, so the operation is finished instead
+var errLedgerMade = errors.New("ledger has the new userhash")
+
+// ErrLedgerChanged is returned when the ledger record to repair was changed
+// after the reconciliation found it
+var ErrLedgerChanged = errors.New("ledger record of the user was changed")
+
+// ErrUsernameChanged is returned when the new record has another username
+// (the ledger record of the username would point to the record of another user)
+var ErrUsernameChanged = errors.New("username of the record can't be changed")
+
+// Operation is a journal record
+type Operation struct {
+	ID       string `bson:"_id"`
+	Kind     string
+	Username string
+	State    string
+
+	// Reached is the state the operation reached before compensation
+	Reached string `bson:",omitempty"`
+
+	// OldRecord is the record that is changed (update)
+	// or only the username and the userhash of the deleted record (delete)
+	// or of the ledger record to repair (repair)
+	OldRecord *userinfo.CipheredUserInfo `bson:",omitempty"`
+	// Record is the new record
+	Record *userinfo.CipheredUserInfo `bson:",omitempty"`
+
+	Attempts int
+	Error    string `bson:",omitempty"`
+
+	Created time.Time
+	Updated time.Time
+}
+
+// step moves the operation from the state to the next one,
+// undo() is its compensating action (nil if the step is the last one),
+// it's called for the failed step too, so it undoes the step made partly.
+// made() reports whether the failed step is made anyway (nil if it can't be)
+type step struct {
+	from string
+	to   string
+	do   func(c *Coordinator, op *Operation) error
+	undo func(c *Coordinator, op *Operation) error
+	made func(c *Coordinator, op *Operation) bool
+}
+
+var steps = map[string][]step{
+	KIND_CREATE: {
+		{from: STATE_PREPARED, to: STATE_STORED, do: insertRecord, undo: deleteRecord},
+		{from: STATE_STORED, to: STATE_DONE, do: addToLedger, made: ledgerMade},
+	},
+	KIND_UPDATE: {
+		{from: STATE_PREPARED, to: STATE_LEDGER, do: updateLedger, undo: revertLedger, made: ledgerMade},
+		{from: STATE_LEDGER, to: STATE_DONE, do: replaceRecord},
+	},
+	KIND_DELETE: {
+		{from: STATE_PREPARED, to: STATE_SHREDDED, do: shredKeys},
+		{from: STATE_SHREDDED, to: STATE_REMOVED, do: removeRecord},
+		{from: STATE_REMOVED, to: STATE_DONE, do: addTombstone},
+	},
+	KIND_REPAIR: {
+		{from: STATE_PREPARED, to: STATE_DONE, do: repairLedger, made: ledgerMade},
+	},
+}
+
+// Coordinator runs operations and keeps them in the journal
+type Coordinator struct {
+	users    store.UserStore
+	versions store.VersionStore
+	keys     store.KeyStore
+	ledger   onchain.Ledger
+	journal  Journal
+
+	// MaxAttempts is a number of attempts of a step before compensation
+	MaxAttempts int
+	// RetryDelay is a delay between attempts (it grows with every attempt)
+	RetryDelay time.Duration
+
+	mu      sync.Mutex
+	running map[string]bool // operations (by id) run by this process
+}
+
+// New() creates the coordinator
+func New(users store.UserStore, versions store.VersionStore, keys store.KeyStore, ledger onchain.Ledger, journal Journal) *Coordinator {
+	return &Coordinator{
+		users:       users,
+		versions:    versions,
+		keys:        keys,
+		ledger:      ledger,
+		journal:     journal,
+		MaxAttempts: DEFAULT_MAX_ATTEMPTS,
+		RetryDelay:  DEFAULT_RETRY_DELAY,
+		running:     make(map[string]bool),
+	}
+}
+
+// Ledger() returns the ledger the coordinator works with
+func (c *Coordinator) Ledger() onchain.Ledger {
+	return c.ledger
+}
+
+// Keys() returns the data keys of users the coordinator destroys on deletion
+func (c *Coordinator) Keys() store.KeyStore {
+	return c.keys
+}
+
+// Create() registers the new user in the CA, builds the record by build()
+// and saves it to the offchain db and the ledger
+func (c *Coordinator) Create(username string, build func(record *userinfo.CipheredUserInfo) error) (*Operation, error) {
+	// the username of the deleted user can't be taken again
+	// (the ledger keeps the tombstone, the CA identity is revoked)
+	_, err := c.ledger.GetUserhash(&username)
+	if err == nil || err == onchain.ErrUserDeleted {
+		return nil, ErrUserExists
+	}
+	if err != onchain.ErrUserNotFound {
+		return nil, err
+	}
+
+	op, err := c.begin(&Operation{Kind: KIND_CREATE, Username: username, State: STATE_STARTED})
+	if err != nil {
+		return nil, err
+	}
+	defer c.release(op)
+
+	// the identity registered by the aborted operation is reused
+	// (the CA refuses to register it twice)
+	if _, err = c.ledger.Enrollment(&username); err != nil {
+		err = c.ledger.RegisterUser(&username)
+	}
+	if err == nil {
+		op.Record = new(userinfo.CipheredUserInfo)
+		err = build(op.Record)
+	}
+	if err != nil {
+		op.Error = err.Error()
+		c.finish(op, STATE_ABORTED)
+		return op, err
+	}
+
+	err = c.advance(op, STATE_PREPARED)
+	if err != nil {
+		return op, err
+	}
+	return op, c.run(op)
+}
+
+// Update() replaces the old record by the new one in the offchain db and the ledger
+func (c *Coordinator) Update(old, record *userinfo.CipheredUserInfo) (*Operation, error) {
+	if record.Username != old.Username {
+		return nil, ErrUsernameChanged
+	}
+
+	oldRecord := *old
+	newRecord := *record
+	op, err := c.begin(&Operation{
+		Kind:      KIND_UPDATE,
+		Username:  old.Username,
+		State:     STATE_PREPARED,
+		OldRecord: &oldRecord,
+		Record:    &newRecord,
+	})
+	if err != nil {
+		return nil, err
+	}
+	defer c.release(op)
+
+	return op, c.run(op)
+}
+
+// Delete() destroys the key material of the user (the CA identity, the data key),
+// removes the record from the offchain db and writes the tombstone to the ledger.
+// The journal keeps only the username and the userhash (no personal data)
+func (c *Coordinator) Delete(username, userhash string) (*Operation, error) {
+	op, err := c.begin(&Operation{
+		Kind:      KIND_DELETE,
+		Username:  username,
+		State:     STATE_PREPARED,
+		OldRecord: &userinfo.CipheredUserInfo{Username: username, Userhash: userhash},
+	})
+	if err != nil {
+		return nil, err
+	}
+	defer c.release(op)
+
+	return op, c.run(op)
+}
+
+// Repair() returns the ledger record of the user from userhash (the ledger
+// userhash the reconciliation found) to the intact offchain record.
+// The ledger changed after the reconciliation isn't repaired (ErrLedgerChanged)
+func (c *Coordinator) Repair(record *userinfo.CipheredUserInfo, userhash string) (*Operation, error) {
+	newRecord := *record
+	op, err := c.begin(&Operation{
+		Kind:      KIND_REPAIR,
+		Username:  record.Username,
+		State:     STATE_PREPARED,
+		OldRecord: &userinfo.CipheredUserInfo{Username: record.Username, Userhash: userhash},
+		Record:    &newRecord,
+	})
+	if err != nil {
+		return nil, err
+	}
+	defer c.release(op)
+
+	return op, c.run(op)
+}
+
+// Pending() returns unfinished operations of the journal
+func (c *Coordinator) Pending() ([]*Operation, error) {
+	return c.journal.Pending()
+}
+
+// Recover() continues (or compensates) operations left by the crashed service.
+// Operations that are run by this process are skipped
+func (c *Coordinator) Recover() error {
+	ops, err := c.journal.Pending()
+	if err != nil {
+		return err
+	}
+
+	for _, op := range ops {
+		if !c.acquire(op) {
+			continue
+		}
+		err = c.recover(op)
+		c.release(op)
+		if err != nil {
+			log.Println("Failed recover operation ", op.ID, " (", op.Kind, " ", op.Username, "): ", err)
+		} else {
+			log.Println("Recovered operation ", op.ID, " (", op.Kind, " ", op.Username, "): ", op.State)
+		}
+	}
+	return nil
+}
+
+// RecoverLoop() calls Recover() every interval (it never returns)
+func (c *Coordinator) RecoverLoop(interval time.Duration) {
+	for {
+		time.Sleep(interval)
+		if err := c.Recover(); err != nil {
+			log.Println("Failed recover operations: ", err)
+		}
+	}
+}
+
+func (c *Coordinator) recover(op *Operation) error {
+	switch op.State {
+	case STATE_STARTED:
+		// the password isn't saved, so the record can't be built again
+		// (the registered identity is reused by the next Create())
+		return c.finish(op, STATE_ABORTED)
+	case STATE_COMPENSATING:
+		return c.compensate(op)
+	}
+	return c.run(op)
+}
+
+// run() makes the remaining steps, a failed step is retried
+// and then the operation is compensated
+func (c *Coordinator) run(op *Operation) error {
+	for {
+		err := c.forward(op)
+		if err == nil {
+			return nil
+		}
+
+		op.Attempts++
+		op.Error = err.Error()
+		if op.Attempts >= c.MaxAttempts && op.Kind == KIND_DELETE {
+			log.Println("Operation ", op.ID, " failed, it will be continued later: ", err)
+			if saveErr := c.save(op); saveErr != nil {
+				return saveErr
+			}
+			return err
+		}
+		if op.Attempts >= c.MaxAttempts {
+			log.Println("Operation ", op.ID, " failed, compensate it: ", err)
+			if compErr := c.compensate(op); compErr != nil {
+				return fmt.Errorf("%v (compensation failed: %v)", err, compErr)
+			}
+			if op.State == STATE_DONE {
+				return nil
+			}
+			return err
+		}
+		if saveErr := c.save(op); saveErr != nil {
+			return saveErr
+		}
+		time.Sleep(c.RetryDelay * time.Duration(op.Attempts))
+	}
+}
+
+// forward() makes steps from the current state of the operation
+func (c *Coordinator) forward(op *Operation) error {
+	for _, s := range steps[op.Kind] {
+		if op.State != s.from {
+			continue
+		}
+		err := s.do(c, op)
+		if err != nil && (s.made == nil || !s.made(c, op)) {
+			return err
+		}
+		if s.to == STATE_DONE {
+			return c.finish(op, STATE_DONE)
+		}
+		err = c.advance(op, s.to)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// compensate() undoes the failed step and completed steps in the reverse order
+func (c *Coordinator) compensate(op *Operation) error {
+	if op.State != STATE_COMPENSATING {
+		op.Reached = op.State
+		err := c.advance(op, STATE_COMPENSATING)
+		if err != nil {
+			return err
+		}
+	}
+
+	kindSteps := steps[op.Kind]
+	failed := 0
+	for i, s := range kindSteps {
+		if s.from == op.Reached {
+			failed = i
+		}
+	}
+	for i := failed; i >= 0; i-- {
+		if kindSteps[i].undo == nil {
+			continue
+		}
+		err := kindSteps[i].undo(c, op)
+		if err == errLedgerMade {
+			log.Println("Operation ", op.ID, " (", op.Kind, " ", op.Username, ") is made by the ledger, it's finished")
+			op.Error = ""
+			return c.finish(op, STATE_DONE)
+		}
+		if err != nil {
+			op.Error = err.Error()
+			c.save(op)
+			return err
+		}
+	}
+	return c.finish(op, STATE_ABORTED)
+}
+
+// begin() saves the new operation, there can be only one operation of the user
+func (c *Coordinator) begin(op *Operation) (*Operation, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	ops, err := c.journal.Pending()
+	if err != nil {
+		return nil, err
+	}
+	for _, pending := range ops {
+		if pending.Username == op.Username {
+			return nil, ErrInProgress
+		}
+	}
+
+	op.ID, err = newID()
+	if err != nil {
+		return nil, err
+	}
+	op.Created = time.Now().UTC()
+	err = c.save(op)
+	if err != nil {
+		return nil, err
+	}
+	c.running[op.ID] = true
+	return op, nil
+}
+
+func (c *Coordinator) acquire(op *Operation) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.running[op.ID] {
+		return false
+	}
+	c.running[op.ID] = true
+	return true
+}
+
+func (c *Coordinator) release(op *Operation) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	delete(c.running, op.ID)
+}
+
+func (c *Coordinator) advance(op *Operation, state string) error {
+	op.State = state
+	op.Attempts = 0
+	return c.save(op)
+}
+
+func (c *Coordinator) save(op *Operation) error {
+	op.Updated = time.Now().UTC()
+	return c.journal.Save(op)
+}
+
+// finish() removes the finished operation from the journal
+func (c *Coordinator) finish(op *Operation, state string) error {
+	op.State = state
+	if state == STATE_ABORTED {
+		log.Println("Operation ", op.ID, " (", op.Kind, " ", op.Username, ") is aborted: ", op.Error)
+	}
+	return c.journal.Delete(op.ID)
+}
+
+func newID() (string, error) {
+	id := make([]byte, 16)
+	if _, err := rand.Read(id); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(id), nil
+}
+
+// steps of operations
+
+func insertRecord(c *Coordinator, op *Operation) error {
+	err := saveVersion(c, op.Record)
+	if err != nil {
+		return err
+	}
+
+	err = c.users.Insert(op.Record)
+	if err == store.ErrDuplicate {
+		// the record was inserted, but the state wasn't saved
+		// (userhash includes random salts, so it's the same record)
+		return nil
+	}
+	return err
+}
+
+func deleteRecord(c *Coordinator, op *Operation) error {
+	// the ledger transaction of the failed step can be committed later
+	// (e.g. after the timeout), then the record is kept and the operation
+	// is finished. The record isn't removed until the ledger can be queried
+	userhash, err := c.ledger.GetUserhash(&op.Username)
+	if err == nil && userhash == op.Record.Userhash {
+		return errLedgerMade
+	}
+	if err != nil && err != onchain.ErrUserNotFound {
+		return err
+	}
+
+	err = c.users.Delete(op.Record.Userhash)
+	if err != nil && err != store.ErrNotFound {
+		return err
+	}
+
+	// the ledger never had the version
+	err = c.versions.Delete(op.Record.Userhash)
+	if err == store.ErrNotFound {
+		return nil
+	}
+	return err
+}
+
+// saveVersion() keeps the version of the record before the ledger gets its userhash
+func saveVersion(c *Coordinator, record *userinfo.CipheredUserInfo) error {
+	err := c.versions.Insert(record)
+	if err == store.ErrDuplicate {
+		// the version was saved by the previous attempt
+		return nil
+	}
+	return err
+}
+
+func addToLedger(c *Coordinator, op *Operation) error {
+	err := c.ledger.AddUserInfoToLedger(&op.Record.Username, &op.Record.Userhash)
+	if onchain.ErrorCode(err) == onchain.CODE_ALREADY_EXISTS {
+		// the userhash was added by the previous attempt, but the state wasn't saved
+		// (the chaincode doesn't overwrite the record)
+		if userhash, _ := c.ledger.GetUserhash(&op.Record.Username); userhash == op.Record.Userhash {
+			return nil
+		}
+	}
+	return err
+}
+
+func updateLedger(c *Coordinator, op *Operation) error {
+	// the old record is replaced by the last step, so it's kept now
+	// (a tampered record isn't a version of its userhash)
+	if userinfo.ComputeUserhash(op.OldRecord) == op.OldRecord.Userhash {
+		err := saveVersion(c, op.OldRecord)
+		if err != nil {
+			return err
+		}
+	}
+
+	err := saveVersion(c, op.Record)
+	if err != nil {
+		return err
+	}
+	return c.ledger.UpdateLedgerUserinfo(&op.Record.Username, &op.Record.Userhash)
+}
+
+// ledgerMade() reports whether the ledger has the userhash of the new record
+// (the transaction of the failed ledger step can be committed despite the error)
+func ledgerMade(c *Coordinator, op *Operation) bool {
+	userhash, err := c.ledger.GetUserhash(&op.Username)
+	return err == nil && userhash == op.Record.Userhash
+}
+
+func revertLedger(c *Coordinator, op *Operation) error {
+	userhash, err := c.ledger.GetUserhash(&op.Username)
+	if err != nil {
+		return err
+	}
+	if userhash != op.OldRecord.Userhash {
+		err = c.ledger.UpdateLedgerUserinfo(&op.OldRecord.Username, &op.OldRecord.Userhash)
+		if err != nil {
+			return err
+		}
+	}
+
+	// the version is kept only if the ledger history has its userhash
+	history, err := c.ledger.GetUserHistory(&op.Username)
+	if err != nil {
+		return err
+	}
+	for _, change := range history {
+		if change.InfoHash == op.Record.Userhash {
+			return nil
+		}
+	}
+	err = c.versions.Delete(op.Record.Userhash)
+	if err == store.ErrNotFound {
+		return nil
+	}
+	return err
+}
+
+func replaceRecord(c *Coordinator, op *Operation) error {
+	err := c.users.Replace(op.OldRecord.Userhash, op.Record)
+	if err == store.ErrNotFound {
+		// the record was replaced, but the state wasn't saved
+		_, err = c.users.FindByUserhash(op.Record.Userhash)
+	}
+	return err
+}
+
+func shredKeys(c *Coordinator, op *Operation) error {
+	err := c.ledger.RevokeUser(&op.Username)
+	if err != nil {
+		return err
+	}
+
+	// records and versions of the user can't be decrypted without the data key
+	// (even from backups of the offchain db)
+	err = c.keys.Delete(op.Username)
+	if err == store.ErrNotFound {
+		// the key was destroyed, but the state wasn't saved
+		// (or records are encrypted by other keys)
+		return nil
+	}
+	return err
+}
+
+func removeRecord(c *Coordinator, op *Operation) error {
+	err := c.versions.DeleteByUsername(op.Username)
+	if err != nil {
+		return err
+	}
+
+	err = c.users.Delete(op.OldRecord.Userhash)
+	if err == store.ErrNotFound {
+		// the record was removed, but the state wasn't saved
+		return nil
+	}
+	return err
+}
+
+func repairLedger(c *Coordinator, op *Operation) error {
+	userhash, err := c.ledger.GetUserhash(&op.Username)
+	if err != nil {
+		return err
+	}
+	if userhash == op.Record.Userhash {
+		// the ledger was repaired, but the state wasn't saved
+		return nil
+	}
+	if userhash != op.OldRecord.Userhash {
+		return ErrLedgerChanged
+	}
+
+	err = saveVersion(c, op.Record)
+	if err != nil {
+		return err
+	}
+	return c.ledger.UpdateLedgerUserinfo(&op.Record.Username, &op.Record.Userhash)
+}
+
+func addTombstone(c *Coordinator, op *Operation) error {
+	return c.ledger.DeleteUser(&op.Username)
+}
@@ -0,0 +1,519 @@
+package saga
+
+import (
+	"errors"
+	"testing"
+
+	"../onchain"
+	"../store"
+	"../userinfo"
+)
+
+var errUnavailable = errors.New("peer is unavailable")
+
+// flakyLedger fails transactions of the ledger.
+// If commit is true, the failed transaction is committed anyway
+// (e.g. the client got timeout, but the peers committed the block)
+type flakyLedger struct {
+	*onchain.MemoryLedger
+
+	failures int // number of transactions to fail (-1 - all)
+	commit   bool
+	down     bool // queries fail too
+}
+
+func (l *flakyLedger) fail(tx func() error) error {
+	if l.failures == 0 {
+		return tx()
+	}
+	if l.failures > 0 {
+		l.failures--
+	}
+	if l.commit {
+		tx()
+	}
+	return errUnavailable
+}
+
+func (l *flakyLedger) GetUserhash(username *string) (string, error) {
+	if l.down {
+		return "", errUnavailable
+	}
+	return l.MemoryLedger.GetUserhash(username)
+}
+
+func (l *flakyLedger) AddUserInfoToLedger(username *string, userhash *string) error {
+	return l.fail(func() error { return l.MemoryLedger.AddUserInfoToLedger(username, userhash) })
+}
+
+func (l *flakyLedger) UpdateLedgerUserinfo(username *string, userhash *string) error {
+	return l.fail(func() error { return l.MemoryLedger.UpdateLedgerUserinfo(username, userhash) })
+}
+
+func (l *flakyLedger) DeleteUser(username *string) error {
+	return l.fail(func() error { return l.MemoryLedger.DeleteUser(username) })
+}
+
+// flakyUsers fails replacements of records
+type flakyUsers struct {
+	*store.MemoryStore
+
+	failures int
+}
+
+func (s *flakyUsers) Replace(userhash string, user *userinfo.CipheredUserInfo) error {
+	if s.failures != 0 {
+		s.failures--
+		return errUnavailable
+	}
+	return s.MemoryStore.Replace(userhash, user)
+}
+
+type testSaga struct {
+	*Coordinator
+
+	users    *flakyUsers
+	versions *store.MemoryStore
+	keys     *store.MemoryKeys
+	ledger   *flakyLedger
+	journal  *MemoryJournal
+}
+
+func newTestSaga(t *testing.T) *testSaga {
+	s := &testSaga{
+		users:    &flakyUsers{MemoryStore: store.NewMemoryStore()},
+		versions: store.NewMemoryStore(),
+		keys:     store.NewMemoryKeys(),
+		ledger:   &flakyLedger{MemoryLedger: onchain.NewMemoryLedger()},
+		journal:  NewMemoryJournal(),
+	}
+	if err := s.ledger.EnrollAdmin(); err != nil {
+		t.Fatal(err)
+	}
+	s.Coordinator = New(s.users, s.versions, s.keys, s.ledger, s.journal)
+	s.MaxAttempts = 2
+	s.RetryDelay = 0
+	return s
+}
+
+// newRecord() makes the record with the valid userhash
+func newRecord(username, email string) *userinfo.CipheredUserInfo {
+	record := &userinfo.CipheredUserInfo{Username: username, Email: email, Hashedpassword: "hash", Privdata: "00"}
+	record.Userhash = userinfo.ComputeUserhash(record)
+	return record
+}
+
+// create() makes the user by the saga
+func (s *testSaga) create(t *testing.T, username string) *userinfo.CipheredUserInfo {
+	record := newRecord(username, username+"@mail.com")
+	op, err := s.Create(username, func(r *userinfo.CipheredUserInfo) error {
+		*r = *record
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if op.State != STATE_DONE {
+		t.Fatalf("Create() state: %s, want %s", op.State, STATE_DONE)
+	}
+	return record
+}
+
+func (s *testSaga) checkLedger(t *testing.T, username string, want string) {
+	userhash, err := s.ledger.GetUserhash(&username)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if userhash != want {
+		t.Fatalf("ledger userhash: %s, want %s", userhash, want)
+	}
+}
+
+func (s *testSaga) checkRecord(t *testing.T, userhash string, exists bool) {
+	_, err := s.users.FindByUserhash(userhash)
+	if exists && err != nil {
+		t.Fatalf("record %s: %v", userhash, err)
+	}
+	if !exists && err != store.ErrNotFound {
+		t.Fatalf("record %s: %v, want ErrNotFound", userhash, err)
+	}
+}
+
+func (s *testSaga) checkVersion(t *testing.T, userhash string, exists bool) {
+	_, err := s.versions.FindByUserhash(userhash)
+	if exists && err != nil {
+		t.Fatalf("version %s: %v", userhash, err)
+	}
+	if !exists && err != store.ErrNotFound {
+		t.Fatalf("version %s: %v, want ErrNotFound", userhash, err)
+	}
+}
+
+func (s *testSaga) checkJournal(t *testing.T, pending int) {
+	ops, err := s.journal.Pending()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(ops) != pending {
+		t.Fatalf("journal has %d operations, want %d", len(ops), pending)
+	}
+}
+
+func TestCreate(t *testing.T) {
+	s := newTestSaga(t)
+	record := s.create(t, "ondar07")
+
+	s.checkLedger(t, "ondar07", record.Userhash)
+	s.checkRecord(t, record.Userhash, true)
+	s.checkVersion(t, record.Userhash, true)
+	s.checkJournal(t, 0)
+
+	_, err := s.Create("ondar07", func(r *userinfo.CipheredUserInfo) error { return nil })
+	if err != ErrUserExists {
+		t.Fatalf("Create() of existing user: %v, want ErrUserExists", err)
+	}
+}
+
+func TestCreateCompensation(t *testing.T) {
+	s := newTestSaga(t)
+	s.ledger.failures = -1
+
+	record := newRecord("ondar07", "ondar07@mail.com")
+	op, err := s.Create("ondar07", func(r *userinfo.CipheredUserInfo) error {
+		*r = *record
+		return nil
+	})
+	if err != errUnavailable {
+		t.Fatalf("Create(): %v, want %v", err, errUnavailable)
+	}
+	if op.State != STATE_ABORTED || op.Reached != STATE_STORED {
+		t.Fatalf("operation state: %s (reached %s), want %s (reached %s)", op.State, op.Reached, STATE_ABORTED, STATE_STORED)
+	}
+
+	// the record and its version are removed
+	username := "ondar07"
+	if _, err := s.ledger.GetUserhash(&username); err != onchain.ErrUserNotFound {
+		t.Fatalf("ledger: %v, want ErrUserNotFound", err)
+	}
+	s.checkRecord(t, record.Userhash, false)
+	s.checkVersion(t, record.Userhash, false)
+	s.checkJournal(t, 0)
+
+	// the next attempt reuses the registered identity
+	s.ledger.failures = 0
+	s.create(t, "ondar07")
+}
+
+func TestCreateAmbiguousLedgerError(t *testing.T) {
+	s := newTestSaga(t)
+
+	// the transaction is committed, but the client gets the error
+	s.ledger.failures = -1
+	s.ledger.commit = true
+
+	record := newRecord("ondar07", "ondar07@mail.com")
+	op, err := s.Create("ondar07", func(r *userinfo.CipheredUserInfo) error {
+		*r = *record
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if op.State != STATE_DONE {
+		t.Fatalf("operation state: %s, want %s", op.State, STATE_DONE)
+	}
+	s.checkLedger(t, "ondar07", record.Userhash)
+	s.checkRecord(t, record.Userhash, true)
+}
+
+func TestCreateCompensationLedgerMade(t *testing.T) {
+	s := newTestSaga(t)
+	record := newRecord("ondar07", "ondar07@mail.com")
+
+	// the ledger step of the creation failed, the operation was being
+	// compensated when the transaction was committed (e.g. after the timeout)
+	username := "ondar07"
+	if err := s.ledger.RegisterUser(&username); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.users.Insert(record); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.versions.Insert(record); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.ledger.AddUserInfoToLedger(&username, &record.Userhash); err != nil {
+		t.Fatal(err)
+	}
+	s.journal.Save(&Operation{
+		ID:       "1",
+		Kind:     KIND_CREATE,
+		Username: "ondar07",
+		State:    STATE_COMPENSATING,
+		Reached:  STATE_STORED,
+		Record:   record,
+	})
+
+	// the record isn't removed while the ledger can't be queried
+	s.ledger.down = true
+	if err := s.Recover(); err != nil {
+		t.Fatal(err)
+	}
+	s.checkRecord(t, record.Userhash, true)
+	s.checkJournal(t, 1)
+
+	// the ledger has the userhash, so the operation is finished, not compensated
+	s.ledger.down = false
+	if err := s.Recover(); err != nil {
+		t.Fatal(err)
+	}
+	s.checkLedger(t, "ondar07", record.Userhash)
+	s.checkRecord(t, record.Userhash, true)
+	s.checkVersion(t, record.Userhash, true)
+	s.checkJournal(t, 0)
+}
+
+func TestUpdate(t *testing.T) {
+	s := newTestSaga(t)
+	old := s.create(t, "ondar07")
+	record := newRecord("ondar07", "new@mail.com")
+
+	// the retried step succeeds
+	s.ledger.failures = 1
+	op, err := s.Update(old, record)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if op.State != STATE_DONE {
+		t.Fatalf("operation state: %s, want %s", op.State, STATE_DONE)
+	}
+	s.checkLedger(t, "ondar07", record.Userhash)
+	s.checkRecord(t, old.Userhash, false)
+	s.checkRecord(t, record.Userhash, true)
+	s.checkVersion(t, old.Userhash, true)
+	s.checkVersion(t, record.Userhash, true)
+
+	other := newRecord("alice", "alice@mail.com")
+	if _, err := s.Update(record, other); err != ErrUsernameChanged {
+		t.Fatalf("Update() of username: %v, want ErrUsernameChanged", err)
+	}
+}
+
+func TestUpdateLedgerCompensation(t *testing.T) {
+	s := newTestSaga(t)
+	old := s.create(t, "ondar07")
+	record := newRecord("ondar07", "new@mail.com")
+
+	s.ledger.failures = -1
+	op, err := s.Update(old, record)
+	if err == nil {
+		t.Fatal("Update() doesn't fail")
+	}
+	if op.State != STATE_ABORTED {
+		t.Fatalf("operation state: %s, want %s", op.State, STATE_ABORTED)
+	}
+
+	// the ledger never had the new userhash, so its version is removed
+	s.checkLedger(t, "ondar07", old.Userhash)
+	s.checkRecord(t, old.Userhash, true)
+	s.checkRecord(t, record.Userhash, false)
+	s.checkVersion(t, old.Userhash, true)
+	s.checkVersion(t, record.Userhash, false)
+	s.checkJournal(t, 0)
+}
+
+func TestUpdateRecordCompensation(t *testing.T) {
+	s := newTestSaga(t)
+	old := s.create(t, "ondar07")
+	record := newRecord("ondar07", "new@mail.com")
+
+	s.users.failures = -1
+	op, err := s.Update(old, record)
+	if err != errUnavailable {
+		t.Fatalf("Update(): %v, want %v", err, errUnavailable)
+	}
+	if op.State != STATE_ABORTED || op.Reached != STATE_LEDGER {
+		t.Fatalf("operation state: %s (reached %s), want %s (reached %s)", op.State, op.Reached, STATE_ABORTED, STATE_LEDGER)
+	}
+
+	// the ledger gets the old userhash back, the new version stays
+	// since the ledger history has its userhash
+	s.checkLedger(t, "ondar07", old.Userhash)
+	s.checkRecord(t, old.Userhash, true)
+	s.checkVersion(t, record.Userhash, true)
+	s.checkJournal(t, 0)
+}
+
+func TestDelete(t *testing.T) {
+	s := newTestSaga(t)
+	record := s.create(t, "ondar07")
+	if err := s.keys.Insert(&store.DataKey{Username: "ondar07", Wrapped: "00"}); err != nil {
+		t.Fatal(err)
+	}
+
+	op, err := s.Delete("ondar07", record.Userhash)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if op.State != STATE_DONE {
+		t.Fatalf("operation state: %s, want %s", op.State, STATE_DONE)
+	}
+
+	username := "ondar07"
+	if _, err := s.ledger.GetUserhash(&username); err != onchain.ErrUserDeleted {
+		t.Fatalf("ledger: %v, want ErrUserDeleted", err)
+	}
+	if _, err := s.ledger.Enrollment(&username); err == nil {
+		t.Fatal("the identity of the deleted user isn't revoked")
+	}
+	if _, err := s.keys.Find(username); err != store.ErrNotFound {
+		t.Fatalf("data key: %v, want ErrNotFound", err)
+	}
+	s.checkRecord(t, record.Userhash, false)
+	s.checkVersion(t, record.Userhash, false)
+	s.checkJournal(t, 0)
+
+	// the username of the deleted user can't be taken again
+	_, err = s.Create("ondar07", func(r *userinfo.CipheredUserInfo) error { return nil })
+	if err != ErrUserExists {
+		t.Fatalf("Create() of deleted user: %v, want ErrUserExists", err)
+	}
+}
+
+func TestDeleteRecovery(t *testing.T) {
+	s := newTestSaga(t)
+	record := s.create(t, "ondar07")
+
+	// deletion can't be undone, so it stays in the journal
+	s.ledger.failures = -1
+	op, err := s.Delete("ondar07", record.Userhash)
+	if err != errUnavailable {
+		t.Fatalf("Delete(): %v, want %v", err, errUnavailable)
+	}
+	if op.State != STATE_REMOVED {
+		t.Fatalf("operation state: %s, want %s", op.State, STATE_REMOVED)
+	}
+	s.checkRecord(t, record.Userhash, false)
+	s.checkJournal(t, 1)
+
+	// other operations of the user wait for it
+	if _, err := s.Update(record, newRecord("ondar07", "new@mail.com")); err != ErrInProgress {
+		t.Fatalf("Update() of the user being deleted: %v, want ErrInProgress", err)
+	}
+
+	s.ledger.failures = 0
+	if err := s.Recover(); err != nil {
+		t.Fatal(err)
+	}
+	s.checkJournal(t, 0)
+	username := "ondar07"
+	if _, err := s.ledger.GetUserhash(&username); err != onchain.ErrUserDeleted {
+		t.Fatalf("ledger: %v, want ErrUserDeleted", err)
+	}
+}
+
+func TestRecover(t *testing.T) {
+	s := newTestSaga(t)
+	username := "ondar07"
+	if err := s.ledger.RegisterUser(&username); err != nil {
+		t.Fatal(err)
+	}
+
+	// the service crashed after the record was stored
+	stored := newRecord("ondar07", "ondar07@mail.com")
+	if err := s.versions.Insert(stored); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.users.Insert(stored); err != nil {
+		t.Fatal(err)
+	}
+	s.journal.Save(&Operation{ID: "1", Kind: KIND_CREATE, Username: "ondar07", State: STATE_STORED, Record: stored})
+
+	// the service crashed before the record was built (the password isn't saved)
+	s.journal.Save(&Operation{ID: "2", Kind: KIND_CREATE, Username: "alice", State: STATE_STARTED})
+
+	if err := s.Recover(); err != nil {
+		t.Fatal(err)
+	}
+	s.checkLedger(t, "ondar07", stored.Userhash)
+	s.checkRecord(t, stored.Userhash, true)
+	s.checkJournal(t, 0)
+
+	alice := "alice"
+	if _, err := s.ledger.GetUserhash(&alice); err != onchain.ErrUserNotFound {
+		t.Fatalf("ledger: %v, want ErrUserNotFound", err)
+	}
+}
+
+func TestRecoverCompensation(t *testing.T) {
+	s := newTestSaga(t)
+	old := s.create(t, "ondar07")
+	record := newRecord("ondar07", "new@mail.com")
+
+	// the service crashed while the update was compensated:
+	// the ledger has the new userhash, the offchain db has the old record
+	username := "ondar07"
+	if err := s.versions.Insert(record); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.ledger.UpdateLedgerUserinfo(&username, &record.Userhash); err != nil {
+		t.Fatal(err)
+	}
+	s.journal.Save(&Operation{
+		ID:        "1",
+		Kind:      KIND_UPDATE,
+		Username:  "ondar07",
+		State:     STATE_COMPENSATING,
+		Reached:   STATE_LEDGER,
+		OldRecord: old,
+		Record:    record,
+	})
+
+	if err := s.Recover(); err != nil {
+		t.Fatal(err)
+	}
+	s.checkLedger(t, "ondar07", old.Userhash)
+	s.checkRecord(t, old.Userhash, true)
+	s.checkJournal(t, 0)
+}
+
+func TestRepair(t *testing.T) {
+	s := newTestSaga(t)
+	old := s.create(t, "ondar07")
+	record := newRecord("ondar07", "new@mail.com")
+
+	// the failed update left the new userhash in the ledger
+	username := "ondar07"
+	if err := s.ledger.UpdateLedgerUserinfo(&username, &record.Userhash); err != nil {
+		t.Fatal(err)
+	}
+
+	// the ledger changed after the reconciliation isn't repaired
+	other := newRecord("ondar07", "other@mail.com")
+	op, err := s.Repair(old, other.Userhash)
+	if err != ErrLedgerChanged {
+		t.Fatalf("Repair() of changed ledger: %v, want ErrLedgerChanged", err)
+	}
+	if op.State != STATE_ABORTED {
+		t.Fatalf("operation state: %s, want %s", op.State, STATE_ABORTED)
+	}
+	s.checkLedger(t, "ondar07", record.Userhash)
+
+	// the repair waits for other operations of the user
+	s.journal.Save(&Operation{ID: "1", Kind: KIND_UPDATE, Username: "ondar07", State: STATE_PREPARED})
+	if _, err := s.Repair(old, record.Userhash); err != ErrInProgress {
+		t.Fatalf("Repair() of busy user: %v, want ErrInProgress", err)
+	}
+	s.journal.Delete("1")
+
+	op, err = s.Repair(old, record.Userhash)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if op.State != STATE_DONE {
+		t.Fatalf("operation state: %s, want %s", op.State, STATE_DONE)
+	}
+	s.checkLedger(t, "ondar07", old.Userhash)
+	s.checkRecord(t, old.Userhash, true)
+	s.checkJournal(t, 0)
+}
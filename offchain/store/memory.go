@@ -0,0 +1,182 @@
+package store
+
+import (
+	"sync"
+
+	"../userinfo"
+)
+
+// MemoryStore keeps records in the process memory (in the insertion order).
+// It is a UserStore and a VersionStore.
+// NOTE: this store is ONLY for tests and local development
+type MemoryStore struct {
+	mu sync.RWMutex
+
+	users map[string]*userinfo.CipheredUserInfo // by userhash
+	order []string
+}
+
+// NewMemoryStore() creates an empty store
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{users: make(map[string]*userinfo.CipheredUserInfo)}
+}
+
+func (s *MemoryStore) Insert(user *userinfo.CipheredUserInfo) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.users[user.Userhash] != nil {
+		return ErrDuplicate
+	}
+	record := *user
+	s.users[user.Userhash] = &record
+	s.order = append(s.order, user.Userhash)
+	return nil
+}
+
+func (s *MemoryStore) FindByUserhash(userhash string) (*userinfo.CipheredUserInfo, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	record := s.users[userhash]
+	if record == nil {
+		return nil, ErrNotFound
+	}
+	user := *record
+	return &user, nil
+}
+
+func (s *MemoryStore) Replace(userhash string, user *userinfo.CipheredUserInfo) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.users[userhash] == nil {
+		return ErrNotFound
+	}
+	if user.Userhash != userhash && s.users[user.Userhash] != nil {
+		return ErrDuplicate
+	}
+
+	record := *user
+	delete(s.users, userhash)
+	s.users[user.Userhash] = &record
+	for i, hash := range s.order {
+		if hash == userhash {
+			s.order[i] = user.Userhash
+			break
+		}
+	}
+	return nil
+}
+
+func (s *MemoryStore) List() ([]userinfo.CipheredUserInfo, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	users := make([]userinfo.CipheredUserInfo, 0, len(s.order))
+	for _, userhash := range s.order {
+		users = append(users, *s.users[userhash])
+	}
+	return users, nil
+}
+
+func (s *MemoryStore) Delete(userhash string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.users[userhash] == nil {
+		return ErrNotFound
+	}
+	delete(s.users, userhash)
+	for i, hash := range s.order {
+		if hash == userhash {
+			s.order = append(s.order[:i], s.order[i+1:]...)
+			break
+		}
+	}
+	return nil
+}
+
+func (s *MemoryStore) DeleteByUsername(username string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	order := s.order[:0]
+	for _, userhash := range s.order {
+		if s.users[userhash].Username == username {
+			delete(s.users, userhash)
+			continue
+		}
+		order = append(order, userhash)
+	}
+	s.order = order
+	return nil
+}
+
+// MemoryKeys keeps data keys of users in the process memory.
+// NOTE: this store is ONLY for tests and local development
+type MemoryKeys struct {
+	mu sync.RWMutex
+
+	keys map[string]DataKey // by username
+}
+
+// NewMemoryKeys() creates an empty store of data keys
+func NewMemoryKeys() *MemoryKeys {
+	return &MemoryKeys{keys: make(map[string]DataKey)}
+}
+
+func (s *MemoryKeys) Insert(key *DataKey) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, ok := s.keys[key.Username]; ok {
+		return ErrDuplicate
+	}
+	s.keys[key.Username] = *key
+	return nil
+}
+
+func (s *MemoryKeys) Find(username string) (*DataKey, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	key, ok := s.keys[username]
+	if !ok {
+		return nil, ErrNotFound
+	}
+	return &key, nil
+}
+
+func (s *MemoryKeys) Replace(key *DataKey) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, ok := s.keys[key.Username]; !ok {
+		return ErrNotFound
+	}
+	s.keys[key.Username] = *key
+	return nil
+}
+
+func (s *MemoryKeys) List() ([]DataKey, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	keys := make([]DataKey, 0, len(s.keys))
+	for _, key := range s.keys {
+		keys = append(keys, key)
+	}
+	return keys, nil
+}
+
+func (s *MemoryKeys) Delete(username string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, ok := s.keys[username]; !ok {
+		return ErrNotFound
+	}
+	delete(s.keys, username)
+	return nil
+}
@@ -0,0 +1,141 @@
+package store
+
+import (
+	"testing"
+
+	"../userinfo"
+)
+
+func TestMemoryStore(t *testing.T) {
+	var users UserStore = NewMemoryStore()
+
+	for _, user := range []userinfo.CipheredUserInfo{
+		{Userhash: "h1", Username: "ondar07", Email: "ondar07@mail.com"},
+		{Userhash: "h2", Username: "alice"},
+	} {
+		user := user
+		if err := users.Insert(&user); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := users.Insert(&userinfo.CipheredUserInfo{Userhash: "h1"}); err != ErrDuplicate {
+		t.Fatalf("Insert() of existing userhash: %v, want ErrDuplicate", err)
+	}
+
+	user, err := users.FindByUserhash("h1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if user.Username != "ondar07" || user.Email != "ondar07@mail.com" {
+		t.Fatalf("FindByUserhash() = %+v", user)
+	}
+	// the store keeps its own copy of the record
+	user.Email = "changed@mail.com"
+	if stored, _ := users.FindByUserhash("h1"); stored.Email != "ondar07@mail.com" {
+		t.Fatal("the record is changed outside the store")
+	}
+	if _, err := users.FindByUserhash("h3"); err != ErrNotFound {
+		t.Fatalf("FindByUserhash() of unknown userhash: %v, want ErrNotFound", err)
+	}
+
+	// the record gets the new userhash and keeps its place in the list
+	user.Userhash = "h3"
+	if err := users.Replace("h1", user); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := users.FindByUserhash("h1"); err != ErrNotFound {
+		t.Fatalf("FindByUserhash() of replaced userhash: %v, want ErrNotFound", err)
+	}
+	if err := users.Replace("h3", &userinfo.CipheredUserInfo{Userhash: "h2"}); err != ErrDuplicate {
+		t.Fatalf("Replace() by existing userhash: %v, want ErrDuplicate", err)
+	}
+	if err := users.Replace("h1", user); err != ErrNotFound {
+		t.Fatalf("Replace() of unknown userhash: %v, want ErrNotFound", err)
+	}
+
+	list, err := users.List()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(list) != 2 || list[0].Userhash != "h3" || list[1].Userhash != "h2" {
+		t.Fatalf("List() = %+v, want h3 and h2", list)
+	}
+
+	if err := users.Delete("h3"); err != nil {
+		t.Fatal(err)
+	}
+	if err := users.Delete("h3"); err != ErrNotFound {
+		t.Fatalf("Delete() of deleted userhash: %v, want ErrNotFound", err)
+	}
+	if list, _ := users.List(); len(list) != 1 || list[0].Userhash != "h2" {
+		t.Fatalf("List() after Delete() = %+v, want h2", list)
+	}
+}
+
+func TestMemoryStoreVersions(t *testing.T) {
+	var versions VersionStore = NewMemoryStore()
+
+	for _, version := range []userinfo.CipheredUserInfo{
+		{Userhash: "h1", Username: "ondar07"},
+		{Userhash: "h2", Username: "alice"},
+		{Userhash: "h3", Username: "ondar07"},
+	} {
+		version := version
+		if err := versions.Insert(&version); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := versions.DeleteByUsername("ondar07"); err != nil {
+		t.Fatal(err)
+	}
+	for _, userhash := range []string{"h1", "h3"} {
+		if _, err := versions.FindByUserhash(userhash); err != ErrNotFound {
+			t.Fatalf("version %s of the erased user: %v, want ErrNotFound", userhash, err)
+		}
+	}
+	if _, err := versions.FindByUserhash("h2"); err != nil {
+		t.Fatalf("version of other user is removed: %v", err)
+	}
+}
+
+func TestMemoryKeys(t *testing.T) {
+	var keys KeyStore = NewMemoryKeys()
+
+	if err := keys.Insert(&DataKey{Username: "ondar07", Wrapped: "k1"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := keys.Insert(&DataKey{Username: "ondar07", Wrapped: "k2"}); err != ErrDuplicate {
+		t.Fatalf("Insert() of the second key: %v, want ErrDuplicate", err)
+	}
+	if _, err := keys.Find("alice"); err != ErrNotFound {
+		t.Fatalf("Find() of unknown user: %v, want ErrNotFound", err)
+	}
+	if err := keys.Replace(&DataKey{Username: "alice", Wrapped: "k2"}); err != ErrNotFound {
+		t.Fatalf("Replace() of unknown user: %v, want ErrNotFound", err)
+	}
+
+	if err := keys.Replace(&DataKey{Username: "ondar07", Wrapped: "k2"}); err != nil {
+		t.Fatal(err)
+	}
+	key, err := keys.Find("ondar07")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if key.Wrapped != "k2" {
+		t.Fatalf("Find() = %+v, want the replaced key", key)
+	}
+	if list, _ := keys.List(); len(list) != 1 {
+		t.Fatalf("List() = %+v, want one key", list)
+	}
+
+	if err := keys.Delete("ondar07"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := keys.Find("ondar07"); err != ErrNotFound {
+		t.Fatalf("Find() of destroyed key: %v, want ErrNotFound", err)
+	}
+	if err := keys.Delete("ondar07"); err != ErrNotFound {
+		t.Fatalf("Delete() of destroyed key: %v, want ErrNotFound", err)
+	}
+}
@@ -0,0 +1,211 @@
+package store
+
+import (
+	"gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+
+	"../userinfo"
+)
+
+// MongoStore keeps records in the mongodb collection.
+// It is a UserStore and a VersionStore.
+type MongoStore struct {
+	session    *mgo.Session
+	database   string
+	collection string
+}
+
+// DialMongo() connects to mongodb and makes the userhash index
+func DialMongo(url, database, collection string) (*MongoStore, error) {
+	session, err := mgo.Dial(url)
+	if err != nil {
+		return nil, err
+	}
+	session.SetMode(mgo.Monotonic, true)
+
+	s := NewMongoStore(session, database, collection)
+	err = s.ensureIndex()
+	if err != nil {
+		session.Close()
+		return nil, err
+	}
+	return s, nil
+}
+
+// NewMongoVersions() keeps versions of records in the collection
+// of the same db (the session of the UserStore is used)
+func NewMongoVersions(session *mgo.Session, database, collection string) (*MongoStore, error) {
+	s := NewMongoStore(session, database, collection)
+	err := s.ensureIndex()
+	if err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// NewMongoStore() uses the existing session,
+// every operation works with a copy of it
+func NewMongoStore(session *mgo.Session, database, collection string) *MongoStore {
+	return &MongoStore{
+		session:    session,
+		database:   database,
+		collection: collection,
+	}
+}
+
+// Session() returns the session of the store (to keep other collections in the same db)
+func (s *MongoStore) Session() *mgo.Session {
+	return s.session
+}
+
+func (s *MongoStore) Close() error {
+	s.session.Close()
+	return nil
+}
+
+// with() calls f with the collection of a session copy
+func (s *MongoStore) with(f func(c *mgo.Collection) error) error {
+	session := s.session.Copy()
+	defer session.Close()
+
+	err := f(session.DB(s.database).C(s.collection))
+	if err == mgo.ErrNotFound {
+		return ErrNotFound
+	}
+	if mgo.IsDup(err) {
+		return ErrDuplicate
+	}
+	return err
+}
+
+func (s *MongoStore) ensureIndex() error {
+	// index of offchain database is userhash field
+	index := mgo.Index{
+		Key:        []string{"userhash"},
+		Unique:     true,
+		DropDups:   true,
+		Background: true,
+		Sparse:     true,
+	}
+	return s.with(func(c *mgo.Collection) error {
+		err := c.EnsureIndex(index)
+		if err != nil {
+			return err
+		}
+		// versions of the user are removed by the username
+		return c.EnsureIndexKey("username")
+	})
+}
+
+func (s *MongoStore) Insert(user *userinfo.CipheredUserInfo) error {
+	return s.with(func(c *mgo.Collection) error {
+		return c.Insert(user)
+	})
+}
+
+func (s *MongoStore) FindByUserhash(userhash string) (*userinfo.CipheredUserInfo, error) {
+	var user userinfo.CipheredUserInfo
+	err := s.with(func(c *mgo.Collection) error {
+		return c.Find(bson.M{"userhash": userhash}).One(&user)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &user, nil
+}
+
+func (s *MongoStore) Replace(userhash string, user *userinfo.CipheredUserInfo) error {
+	return s.with(func(c *mgo.Collection) error {
+		return c.Update(bson.M{"userhash": userhash}, user)
+	})
+}
+
+func (s *MongoStore) List() ([]userinfo.CipheredUserInfo, error) {
+	var users []userinfo.CipheredUserInfo
+	err := s.with(func(c *mgo.Collection) error {
+		return c.Find(bson.M{}).All(&users)
+	})
+	return users, err
+}
+
+func (s *MongoStore) Delete(userhash string) error {
+	return s.with(func(c *mgo.Collection) error {
+		return c.Remove(bson.M{"userhash": userhash})
+	})
+}
+
+func (s *MongoStore) DeleteByUsername(username string) error {
+	return s.with(func(c *mgo.Collection) error {
+		_, err := c.RemoveAll(bson.M{"username": username})
+		return err
+	})
+}
+
+// MongoKeys keeps data keys of users in the mongodb collection
+// (the username is the _id of the document)
+type MongoKeys struct {
+	session    *mgo.Session
+	database   string
+	collection string
+}
+
+// NewMongoKeys() keeps data keys in the collection of the same db
+// (the session of the UserStore is used)
+func NewMongoKeys(session *mgo.Session, database, collection string) *MongoKeys {
+	return &MongoKeys{
+		session:    session,
+		database:   database,
+		collection: collection,
+	}
+}
+
+func (s *MongoKeys) with(f func(c *mgo.Collection) error) error {
+	session := s.session.Copy()
+	defer session.Close()
+
+	err := f(session.DB(s.database).C(s.collection))
+	if err == mgo.ErrNotFound {
+		return ErrNotFound
+	}
+	if mgo.IsDup(err) {
+		return ErrDuplicate
+	}
+	return err
+}
+
+func (s *MongoKeys) Insert(key *DataKey) error {
+	return s.with(func(c *mgo.Collection) error {
+		return c.Insert(key)
+	})
+}
+
+func (s *MongoKeys) Find(username string) (*DataKey, error) {
+	var key DataKey
+	err := s.with(func(c *mgo.Collection) error {
+		return c.FindId(username).One(&key)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &key, nil
+}
+
+func (s *MongoKeys) Replace(key *DataKey) error {
+	return s.with(func(c *mgo.Collection) error {
+		return c.UpdateId(key.Username, key)
+	})
+}
+
+func (s *MongoKeys) List() ([]DataKey, error) {
+	var keys []DataKey
+	err := s.with(func(c *mgo.Collection) error {
+		return c.Find(bson.M{}).All(&keys)
+	})
+	return keys, err
+}
+
+func (s *MongoKeys) Delete(username string) error {
+	return s.with(func(c *mgo.Collection) error {
+		return c.RemoveId(username)
+	})
+}
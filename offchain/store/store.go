@@ -0,0 +1,103 @@
+/*
+This package implements the offchain db of user records.
+
+Handlers of the service work with the db only through the UserStore
+interface, the record is found by its userhash (the ledger keeps it).
+There are two implementations: mongodb (MongoStore) and the process
+memory (MemoryStore, for tests and local development).
+
+UserStore keeps the current record of every user. VersionStore keeps
+every version of records (the same implementations in another collection):
+a version is never changed, so every userhash that the ledger ever had
+is resolved to the record (see onchain.Ledger.GetUserHistory()).
+
+KeyStore keeps data keys of users apart from records (MongoKeys and MemoryKeys):
+the data key is destroyed when the user is erased, so records and versions
+of the user left in backups can't be decrypted (see crypdata.NewDataKey()).
+*/
+package store
+
+import (
+	"errors"
+
+	"../userinfo"
+)
+
+// store backends (see config store.backend)
+const (
+	MONGO_BACKEND  = "mongo"
+	MEMORY_BACKEND = "memory"
+)
+
+// ErrNotFound is returned when there is no record with the userhash
+var ErrNotFound = errors.New("record is not found")
+
+// ErrDuplicate is returned when a record with the same userhash exists
+var ErrDuplicate = errors.New("record with this userhash already exists")
+
+// UserStore is a storage of offchain records, the index is the userhash field
+type UserStore interface {
+	// Insert() saves the new record
+	Insert(user *userinfo.CipheredUserInfo) error
+
+	// FindByUserhash() returns the record with this userhash
+	FindByUserhash(userhash string) (*userinfo.CipheredUserInfo, error)
+
+	// Replace() replaces the record with this userhash by the user record
+	// (the user record may have a new userhash)
+	Replace(userhash string, user *userinfo.CipheredUserInfo) error
+
+	// List() returns all records
+	List() ([]userinfo.CipheredUserInfo, error)
+
+	// Delete() removes the record with this userhash
+	Delete(userhash string) error
+}
+
+// VersionStore is a storage of immutable versions of records,
+// the index is the userhash field
+type VersionStore interface {
+	// Insert() saves the version (ErrDuplicate if it is saved already)
+	Insert(user *userinfo.CipheredUserInfo) error
+
+	// FindByUserhash() returns the version with this userhash
+	FindByUserhash(userhash string) (*userinfo.CipheredUserInfo, error)
+
+	// Delete() removes the version with this userhash
+	// (only the version that never got to the ledger)
+	Delete(userhash string) error
+
+	// DeleteByUsername() removes all versions of the user (erasure)
+	DeleteByUsername(username string) error
+}
+
+// DataKey is the data key of the user wrapped by the key of the service
+type DataKey struct {
+	Username string `bson:"_id"`
+
+	// Wrapped is the data key encrypted by the key of the service (hex)
+	Wrapped string
+}
+
+// KeyStore is a storage of data keys of users, the index is the username
+type KeyStore interface {
+	// Insert() saves the data key of the user (ErrDuplicate if the user has one)
+	Insert(key *DataKey) error
+
+	// Find() returns the data key of the user
+	Find(username string) (*DataKey, error)
+
+	// Replace() replaces the data key of the user (the key is re-wrapped)
+	Replace(key *DataKey) error
+
+	// List() returns data keys of all users
+	List() ([]DataKey, error)
+
+	// Delete() destroys the data key of the user (erasure)
+	Delete(username string) error
+}
+
+// Backends() returns names of the store backends
+func Backends() []string {
+	return []string{MEMORY_BACKEND, MONGO_BACKEND}
+}
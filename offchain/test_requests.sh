@@ -1,13 +1,67 @@
 #!/bin/bash
 
 
+# 0. On the first run (admin.password isn't set) create the first admin account
+#    by the bootstrap token printed by the service:
+#    curl -X POST -d '{"token": "...", "name": "admin", "password": "AdminSuperPassword"}' http://localhost:8080/admin/bootstrap
+
 # 1. To add a new user with data described in userinfo.json:
 curl -X POST -H "Content-Type: application/json" -d @userinfo.json http://localhost:8080/users
 
-# 2. To receive user data
-#    Moreover, if password matches user password or admin password, this request get private user data (decrypted data)
-curl -H "Content-Type: application/json" http://localhost:8080/users/ondar07?password=superPassword
+# 2. To log in (the user or admin), the response contains access_token and refresh_token
+#    (jq is used to extract tokens)
+USER_TOKEN=$(curl -s -X POST -H "Content-Type: application/json" \
+    -d '{"username": "ondar07", "password": "superPassword"}' http://localhost:8080/login | jq -r .access_token)
+ADMIN_TOKEN=$(curl -s -X POST -H "Content-Type: application/json" \
+    -d '{"username": "admin", "password": "AdminSuperPassword"}' http://localhost:8080/admin/login | jq -r .access_token)
+
+# 3. To receive user data
+#    Moreover, if the token belongs to this user or admin, this request get private user data (decrypted data)
+curl -H "Authorization: Bearer $USER_TOKEN" http://localhost:8080/users/ondar07
+
+# 4. TO update user data with newuserinfo.json
+#    If the token doesn't belong to admin the service will not update data
+curl -X PUT -H "Content-Type: application/json" -H "Authorization: Bearer $ADMIN_TOKEN" \
+    -d @newuserinfo.json http://localhost:8080/users/ondar07
+
+# 4a. The user changes his own profile and password (the current password is required)
+curl -X PUT -H "Content-Type: application/json" -H "Authorization: Bearer $USER_TOKEN" \
+    -d '{"current_password": "superPassword", "email": "new@mail.ru", "priv_data": {"name": "Ondar, A.", "phones": ["1234"]}}' \
+    http://localhost:8080/users/ondar07/profile
+#    curl -X PUT -H "Authorization: Bearer $USER_TOKEN" \
+#        -d '{"current_password": "superPassword", "new_password": "..."}' http://localhost:8080/users/ondar07/password
+
+# 4b. To convert private data of the first version ("[a, b]" strings) to JSON
+#    (stop the service before): ./fabusers_srv -migrate-privdata
+
+# 5. To compare the ledger and the offchain db (only admin)
+#    GET returns the last report, POST reconciles now (?repair=true repairs safe cases)
+curl -H "Authorization: Bearer $ADMIN_TOKEN" http://localhost:8080/admin/reconciliation
+curl -X POST -H "Authorization: Bearer $ADMIN_TOKEN" "http://localhost:8080/admin/reconciliation?repair=true"
+
+#    To page through all ledger records (admin, auditor or support):
+#    the response has Next (the URL of the next page) except for the last page
+curl -H "Authorization: Bearer $ADMIN_TOKEN" "http://localhost:8080/admin/ledger/users?page_size=100"
+curl -H "Authorization: Bearer $ADMIN_TOKEN" http://localhost:8080/admin/ledger/users/count
+
+# 5a. To see all ledger changes of the user record (admin or auditor)
+curl -H "Authorization: Bearer $ADMIN_TOKEN" http://localhost:8080/users/ondar07/history
+
+#    The record as it was at a point (a tx id or a userhash of the history or a time)
+#    and changed fields between two versions (only admin)
+curl -H "Authorization: Bearer $ADMIN_TOKEN" "http://localhost:8080/users/ondar07?at=2019-05-01T12:00:00Z"
+#    curl -H "Authorization: Bearer $ADMIN_TOKEN" "http://localhost:8080/users/ondar07/diff?from=<tx id>&to=<tx id>"
+
+# 5b. To delete the user (only admin): keys are destroyed, the ledger keeps the tombstone
+#    curl -X DELETE -H "Authorization: Bearer $ADMIN_TOKEN" http://localhost:8080/users/ondar07
+
+# 6. To get new tokens by the refresh token (it can be used once):
+#    curl -X POST -d '{"refresh_token": "..."}' http://localhost:8080/token/refresh
+#    To revoke all tokens of the session:
+curl -X POST -H "Authorization: Bearer $USER_TOKEN" http://localhost:8080/logout
 
-# 3. TO update user data with newuserinfo.json
-#    If password doesn't matches to admin's password the service will not update data
-curl -X PUT -H "Content-Type: application/json" -d @newuserinfo.json http://localhost:8080/users/ondar07?password=AdminSuperPassword
\ No newline at end of file
+# 7. To manage admin accounts (only admin)
+curl -X POST -H "Content-Type: application/json" -H "Authorization: Bearer $ADMIN_TOKEN" \
+    -d '{"name": "auditor1", "password": "AuditorPassword", "role": "auditor"}' http://localhost:8080/admin/accounts
+curl -H "Authorization: Bearer $ADMIN_TOKEN" http://localhost:8080/admin/accounts
+curl -X POST -H "Authorization: Bearer $ADMIN_TOKEN" http://localhost:8080/admin/accounts/auditor1/disable
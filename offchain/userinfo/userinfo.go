@@ -0,0 +1,324 @@
+/*
+This package describes user info: the incoming JSON object (UserInfo)
+and the offchain db record (CipheredUserInfo) built from it.
+
+Private data is a JSON document (any JSON value: an array, an object with
+named fields, etc.), it's encrypted as compact JSON and returned as is after
+decryption. Records of the first version keep private data as one string
+"[a, b]" (see PRIVFORMAT_LEGACY and MigratePrivdata()).
+*/
+package userinfo
+
+import (
+	"bytes"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"strconv"
+	"strings"
+
+	"../crypdata"
+)
+
+// formats of private data (the plaintext)
+const (
+	PRIVFORMAT_LEGACY = ""     // strings joined into "[a, b]"
+	PRIVFORMAT_JSON   = "json" // JSON document
+)
+
+// keys that encrypt private data (the user key is used if Userkey is set)
+const (
+	KEYFORMAT_SERVICE  = ""        // the key of the service (records of the previous version)
+	KEYFORMAT_DATA_KEY = "datakey" // the data key of the user (see store.KeyStore)
+)
+
+// formats of userhash (what is hashed, see ComputeUserhash())
+const (
+	HASHFORMAT_LEGACY = ""       // fields are joined as is
+	HASHFORMAT_FIELDS = "fields" // fields are prefixed by their lengths
+)
+
+// ErrBadPrivdata is returned when private data is not a JSON document
+var ErrBadPrivdata = errors.New("priv_data has to be a JSON document")
+
+// The service handles incoming requests that consist of JSON objects
+// These JSON objects have to match to this struct
+type UserInfo struct {
+	Username string `json:"username"`
+	Email    string `json:"email"`
+	Password string `json:"password"`
+
+	Privdata json.RawMessage `json:"priv_data"`
+}
+
+// offchain db record corresponds to this struct
+// db index field is Userhash field
+type CipheredUserInfo struct {
+	// Userhash is a hash value of all user info
+	// (Username, Email, Hashedpassword, Privdata, Privformat, Userkey, Keyformat)
+	Userhash string
+
+	// Hashformat is the format of Userhash (HASHFORMAT_*)
+	Hashformat string `bson:",omitempty" json:",omitempty"`
+
+	Username string
+	Email    string
+
+	// Hashedpassword is the argon2 hash of the password (see crypdata.HashPassword()).
+	// It is never sent to clients
+	Hashedpassword string `json:"-"`
+
+	Privdata string
+
+	// Privformat is the format of private data (PRIVFORMAT_*)
+	Privformat string `bson:",omitempty" json:",omitempty"`
+
+	// Userkey is the user key sealed by the user password (only if Privdata
+	// is encrypted to the user key, see crypdata.SealUserKey()).
+	// It is never sent to clients
+	Userkey string `bson:",omitempty" json:"-"`
+
+	// Keyformat is the key that encrypts Privdata if Userkey isn't set (KEYFORMAT_*)
+	Keyformat string `bson:",omitempty" json:",omitempty"`
+}
+
+// CreateCipheredUserinfo() is an auxiliary function
+// it builds (copy some info, computes hash of password, encrypt private data)
+// CipheredUserInfo struct from UserInfo.
+// If userKey is not nil (see crypdata.NewUserKey()), private data is encrypted
+// to it and it's sealed by the password, otherwise by the data key of the user
+// (see crypdata.NewDataKey())
+func CreateCipheredUserinfo(userInfo *UserInfo, cipheredUserInfo *CipheredUserInfo, userKey, dataKey []byte) error {
+	// 1. private data is kept as compact JSON (absent private data is null)
+	userPrivData, err := EncodePrivdata(userInfo.Privdata)
+	if err != nil {
+		return err
+	}
+
+	// 2. encrypt private data
+	var ciphertext []byte
+	var userkey, keyformat string
+	if userKey != nil {
+		ciphertext, err = crypdata.EncryptForUser(userKey, userPrivData)
+		if err == nil {
+			userkey, err = crypdata.SealUserKey(userKey, userInfo.Password)
+		}
+	} else {
+		ciphertext, err = crypdata.EncryptByDataKey(dataKey, userPrivData)
+		keyformat = KEYFORMAT_DATA_KEY
+	}
+	if err != nil {
+		return err
+	}
+
+	// 3. salted hash of password
+	hashedPassword, err := crypdata.HashPassword(userInfo.Password)
+	if err != nil {
+		return err
+	}
+
+	cipheredUserInfo.Username = userInfo.Username
+	cipheredUserInfo.Email = userInfo.Email
+	cipheredUserInfo.Hashedpassword = hashedPassword
+	cipheredUserInfo.Privdata = hex.EncodeToString(ciphertext) // convert to string representation
+	cipheredUserInfo.Privformat = PRIVFORMAT_JSON
+	cipheredUserInfo.Userkey = userkey
+	cipheredUserInfo.Keyformat = keyformat
+
+	SetUserhash(cipheredUserInfo)
+
+	return nil
+}
+
+// EncodePrivdata() validates the private data document and compacts it
+func EncodePrivdata(privdata json.RawMessage) ([]byte, error) {
+	if len(bytes.TrimSpace(privdata)) == 0 {
+		return []byte("null"), nil
+	}
+	var buf bytes.Buffer
+	if err := json.Compact(&buf, privdata); err != nil {
+		return nil, ErrBadPrivdata
+	}
+	return buf.Bytes(), nil
+}
+
+// DecodePrivdata() returns decrypted private data of the record as
+// the JSON document (legacy strings are returned as the array of strings)
+func DecodePrivdata(cipheredUserInfo *CipheredUserInfo, plaintext []byte) (json.RawMessage, error) {
+	if cipheredUserInfo.Privformat == PRIVFORMAT_JSON {
+		return json.RawMessage(plaintext), nil
+	}
+	return json.Marshal(ParseLegacyPrivdata(string(plaintext)))
+}
+
+// ParseLegacyPrivdata() splits the string "[a, b]" of the first version
+// into strings. NOTE: strings that contained ", " can't be recovered exactly
+func ParseLegacyPrivdata(privdata string) []string {
+	privdata = strings.TrimSuffix(strings.TrimPrefix(privdata, "["), "]")
+	if privdata == "" {
+		return []string{}
+	}
+	return strings.Split(privdata, ", ")
+}
+
+// NeedsMigration() reports whether private data of the record is kept
+// in the format of the previous version: the legacy string or the ciphertext
+// of the key of the service
+func NeedsMigration(cipheredUserInfo *CipheredUserInfo) bool {
+	return cipheredUserInfo.Privformat == PRIVFORMAT_LEGACY ||
+		(cipheredUserInfo.Userkey == "" && cipheredUserInfo.Keyformat == KEYFORMAT_SERVICE)
+}
+
+// MigratePrivdata() builds the record with private data of the record of
+// the previous version converted to the JSON document. plaintext is decrypted
+// private data, encrypt() encrypts the new plaintext by the key of keyformat
+// (the user key is kept)
+func MigratePrivdata(cipheredUserInfo *CipheredUserInfo, plaintext []byte, encrypt func([]byte) ([]byte, error), keyformat string) (*CipheredUserInfo, error) {
+	if !NeedsMigration(cipheredUserInfo) {
+		return nil, errors.New("private data is migrated already")
+	}
+	document, err := DecodePrivdata(cipheredUserInfo, plaintext)
+	if err != nil {
+		return nil, err
+	}
+	ciphertext, err := encrypt(document)
+	if err != nil {
+		return nil, err
+	}
+
+	record := *cipheredUserInfo
+	record.Privdata = hex.EncodeToString(ciphertext)
+	record.Privformat = PRIVFORMAT_JSON
+	record.Keyformat = keyformat
+	SetUserhash(&record)
+	return &record, nil
+}
+
+// userhashPrefix starts hashed data of HASHFORMAT_FIELDS, data of the legacy
+// format start with the username, so userhashes of formats don't collide
+const userhashPrefix = "\x00userhash:fields\x00"
+
+// ComputeUserhash() calculates Userhash field (a hash of all user info)
+// in the format of the record. Fields of the legacy format are joined as is,
+// so bytes can move between fields without changing the hash (e.g. "alice" +
+// "x@y" and "alic" + "ex@y"), fields of HASHFORMAT_FIELDS are prefixed by their lengths
+func ComputeUserhash(cipheredUserInfo *CipheredUserInfo) string {
+	fields := []string{
+		cipheredUserInfo.Username,
+		cipheredUserInfo.Email,
+		cipheredUserInfo.Hashedpassword,
+		cipheredUserInfo.Privdata,
+		cipheredUserInfo.Privformat,
+		cipheredUserInfo.Userkey,
+		cipheredUserInfo.Keyformat,
+	}
+	if cipheredUserInfo.Hashformat == HASHFORMAT_LEGACY {
+		return crypdata.Hash(strings.Join(fields, ""))
+	}
+
+	var data strings.Builder
+	data.WriteString(userhashPrefix)
+	data.WriteString(cipheredUserInfo.Hashformat)
+	for _, field := range fields {
+		data.WriteString(":")
+		data.WriteString(strconv.Itoa(len(field)))
+		data.WriteString(":")
+		data.WriteString(field)
+	}
+	return crypdata.Hash(data.String())
+}
+
+// SetUserhash() computes Userhash of the changed record in the current format
+// (records of the legacy format get the current one on every change)
+func SetUserhash(cipheredUserInfo *CipheredUserInfo) {
+	cipheredUserInfo.Hashformat = HASHFORMAT_FIELDS
+	cipheredUserInfo.Userhash = ComputeUserhash(cipheredUserInfo)
+}
+
+// integrity statuses of the record
+const (
+	INTEGRITY_VERIFIED = "verified" // fields of the record match the ledger userhash
+	INTEGRITY_TAMPERED = "tampered" // fields of the record were changed bypassing the ledger
+)
+
+// CheckIntegrity() recomputes userhash from fields of the record
+// and compares it with the userhash stored in the ledger for username
+// (the record of other user is tampered even if its userhash matches)
+func CheckIntegrity(cipheredUserInfo *CipheredUserInfo, username, ledgerUserhash string) string {
+	if cipheredUserInfo.Username != username ||
+		cipheredUserInfo.Userhash != ledgerUserhash ||
+		ComputeUserhash(cipheredUserInfo) != ledgerUserhash {
+		return INTEGRITY_TAMPERED
+	}
+	return INTEGRITY_VERIFIED
+}
+
+// DecryptPrivdata() decrypts private data of the record by the key of the record:
+// the user key unsealed by the user password (see crypdata.UnsealUserKey(),
+// crypdata.ErrUserKeyRequired is returned without it), the data key of the user
+// (crypdata.ErrDataKeyRequired is returned without it) or the key of the service.
+// The key is chosen by the record (Userkey, Keyformat), not by the ciphertext
+func DecryptPrivdata(cipheredUserInfo *CipheredUserInfo, key []byte) ([]byte, error) {
+	ciphertext, err := hex.DecodeString(cipheredUserInfo.Privdata)
+	if err != nil {
+		return nil, err
+	}
+
+	switch {
+	case cipheredUserInfo.Userkey != "":
+		if key == nil {
+			return nil, crypdata.ErrUserKeyRequired
+		}
+		return crypdata.DecryptForUser(key, ciphertext)
+	case cipheredUserInfo.Keyformat == KEYFORMAT_DATA_KEY:
+		if key == nil {
+			return nil, crypdata.ErrDataKeyRequired
+		}
+		return crypdata.DecryptByDataKey(key, ciphertext)
+	}
+	return crypdata.Decrypt(ciphertext)
+}
+
+// FieldChange is a field that differs between two versions of the record.
+// Values of secrets (the password hash, the sealed user key) aren't shown
+type FieldChange struct {
+	Field string
+	Old   interface{} `json:",omitempty"`
+	New   interface{} `json:",omitempty"`
+}
+
+// Diff() lists fields that differ between two versions of the record.
+// Private data are compared by decrypted documents (fromPrivdata, toPrivdata),
+// if any of them is nil (it can't be decrypted), only by ciphertexts
+func Diff(from, to *CipheredUserInfo, fromPrivdata, toPrivdata json.RawMessage) []FieldChange {
+	changes := []FieldChange{}
+	if from.Username != to.Username {
+		changes = append(changes, FieldChange{Field: "Username", Old: from.Username, New: to.Username})
+	}
+	if from.Email != to.Email {
+		changes = append(changes, FieldChange{Field: "Email", Old: from.Email, New: to.Email})
+	}
+	if from.Hashedpassword != to.Hashedpassword {
+		changes = append(changes, FieldChange{Field: "Hashedpassword"})
+	}
+	if fromPrivdata != nil && toPrivdata != nil {
+		if !bytes.Equal(fromPrivdata, toPrivdata) {
+			changes = append(changes, FieldChange{Field: "Privdata", Old: fromPrivdata, New: toPrivdata})
+		}
+	} else if from.Privdata != to.Privdata {
+		changes = append(changes, FieldChange{Field: "Privdata"})
+	}
+	if from.Privformat != to.Privformat {
+		changes = append(changes, FieldChange{Field: "Privformat", Old: from.Privformat, New: to.Privformat})
+	}
+	if from.Userkey != to.Userkey {
+		changes = append(changes, FieldChange{Field: "Userkey"})
+	}
+	if from.Keyformat != to.Keyformat {
+		changes = append(changes, FieldChange{Field: "Keyformat", Old: from.Keyformat, New: to.Keyformat})
+	}
+	if from.Hashformat != to.Hashformat {
+		changes = append(changes, FieldChange{Field: "Hashformat", Old: from.Hashformat, New: to.Hashformat})
+	}
+	return changes
+}
@@ -0,0 +1,80 @@
+package userinfo
+
+import (
+	"testing"
+)
+
+func newRecord(username, email string) *CipheredUserInfo {
+	record := &CipheredUserInfo{
+		Username:       username,
+		Email:          email,
+		Hashedpassword: "$argon2id$hash",
+		Privdata:       "abcdef",
+		Privformat:     PRIVFORMAT_JSON,
+		Keyformat:      KEYFORMAT_DATA_KEY,
+	}
+	SetUserhash(record)
+	return record
+}
+
+func TestUserhashFields(t *testing.T) {
+	record := newRecord("alice", "x@y")
+	if record.Hashformat != HASHFORMAT_FIELDS {
+		t.Fatalf("Hashformat = %q, want %q", record.Hashformat, HASHFORMAT_FIELDS)
+	}
+
+	// bytes moved between fields change the userhash
+	shifted := newRecord("alic", "ex@y")
+	if shifted.Userhash == record.Userhash {
+		t.Fatal("userhash doesn't bind the fields")
+	}
+	shifted.Userhash = record.Userhash
+	if CheckIntegrity(shifted, "alic", record.Userhash) != INTEGRITY_TAMPERED {
+		t.Fatal("the record with shifted fields is verified")
+	}
+
+	// the legacy format can't stand for the record of the current one
+	legacy := *record
+	legacy.Hashformat = HASHFORMAT_LEGACY
+	if ComputeUserhash(&legacy) == record.Userhash {
+		t.Fatal("userhashes of formats collide")
+	}
+}
+
+func TestLegacyUserhash(t *testing.T) {
+	// records of the previous versions keep their userhashes
+	legacy := &CipheredUserInfo{Username: "alice", Email: "x@y", Hashedpassword: "hash", Privdata: "abcdef"}
+	legacy.Userhash = ComputeUserhash(legacy)
+	if CheckIntegrity(legacy, "alice", legacy.Userhash) != INTEGRITY_VERIFIED {
+		t.Fatal("the legacy record isn't verified")
+	}
+
+	// the changed record gets the current format
+	changed := *legacy
+	changed.Email = "z@y"
+	SetUserhash(&changed)
+	if changed.Hashformat != HASHFORMAT_FIELDS || CheckIntegrity(&changed, "alice", changed.Userhash) != INTEGRITY_VERIFIED {
+		t.Fatalf("changed record: %+v", changed)
+	}
+}
+
+func TestCheckIntegrity(t *testing.T) {
+	record := newRecord("alice", "x@y")
+	if CheckIntegrity(record, "alice", record.Userhash) != INTEGRITY_VERIFIED {
+		t.Fatal("the record isn't verified")
+	}
+
+	// the record of other user matches its userhash, but not the ledger key
+	if CheckIntegrity(record, "bob", record.Userhash) != INTEGRITY_TAMPERED {
+		t.Fatal("the record of alice is verified for bob")
+	}
+
+	tampered := *record
+	tampered.Email = "evil@y"
+	if CheckIntegrity(&tampered, "alice", record.Userhash) != INTEGRITY_TAMPERED {
+		t.Fatal("the changed record is verified")
+	}
+	if CheckIntegrity(record, "alice", newRecord("alice", "z@y").Userhash) != INTEGRITY_TAMPERED {
+		t.Fatal("the record is verified by other userhash")
+	}
+}